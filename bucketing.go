@@ -0,0 +1,237 @@
+// bucketing.go
+//
+// Quantile methods: how the customers sorted by descending CA are cut into
+// buckets. Every method yields the end index of each bucket, so statistics,
+// ranks and exports are computed the same way whatever the method.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// quantile methods accepted by -method
+const (
+	methodEqualCount = "equal-count" // round(1/quantile) buckets of ceil(n / count) customers
+	methodRevenue    = "revenue"     // round(1/quantile) buckets holding the same share of total CA
+	methodCuts       = "cuts"        // buckets cut at cumulative customer fractions (-cuts)
+	methodThresholds = "thresholds"  // buckets cut at CA thresholds (-thresholds)
+)
+
+// bucketSpec describes the bucketing of a run
+type bucketSpec struct {
+	Method     string
+	Quantile   float64   // equal-count and revenue
+	Cuts       []float64 // cuts: increasing fractions in (0, 1)
+	Thresholds []int64   // thresholds: decreasing -rank-by values, bucket 0 is value >= Thresholds[0]
+	Ties       string
+	RankBy     string // metric ordering the customers; "" is the CA
+	Sketch     int    // KLL accuracy of -sketch (see sketch.go); 0 = exact bounds
+}
+
+// parseBucketSpec validates -method with its -cuts / -thresholds values;
+// thresholds are values of the rankBy metric
+func parseBucketSpec(method string, quantile float64, cuts, thresholds, ties, rankBy string) (bucketSpec, error) {
+	spec := bucketSpec{Method: method, Quantile: quantile, Ties: ties, RankBy: rankBy}
+	if err := validMetric(rankBy); err != nil {
+		return spec, err
+	}
+	if ties != tiesSplit && ties != tiesKeepHigher {
+		return spec, fmt.Errorf("invalid tie policy %q (expected %s or %s)", ties, tiesSplit, tiesKeepHigher)
+	}
+	if method != methodCuts && cuts != "" {
+		return spec, fmt.Errorf("-cuts requires -method=%s", methodCuts)
+	}
+	if method != methodThresholds && thresholds != "" {
+		return spec, fmt.Errorf("-thresholds requires -method=%s", methodThresholds)
+	}
+
+	switch method {
+	case methodEqualCount, methodRevenue:
+		if quantile <= 0 || quantile > 1 {
+			return spec, fmt.Errorf("invalid quantile %v (expected 0 < quantile <= 1)", quantile)
+		}
+	case methodCuts:
+		if cuts == "" {
+			return spec, fmt.Errorf("-method=%s requires -cuts, e.g. 0.01,0.05,0.2", methodCuts)
+		}
+		for _, f := range strings.Split(cuts, ",") {
+			c, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+			if err != nil || c <= 0 || c >= 1 {
+				return spec, fmt.Errorf("invalid cut %q (expected a fraction between 0 and 1)", f)
+			}
+			if n := len(spec.Cuts); n > 0 && c <= spec.Cuts[n-1] {
+				return spec, fmt.Errorf("cuts must be strictly increasing: %s", cuts)
+			}
+			spec.Cuts = append(spec.Cuts, c)
+		}
+	case methodThresholds:
+		if thresholds == "" {
+			return spec, fmt.Errorf("-method=%s requires -thresholds, e.g. 1000,500,100", methodThresholds)
+		}
+		for _, f := range strings.Split(thresholds, ",") {
+			m, err := parseMetric(rankBy, f)
+			if err != nil {
+				return spec, fmt.Errorf("invalid threshold: %w", err)
+			}
+			if n := len(spec.Thresholds); n > 0 && m >= spec.Thresholds[n-1] {
+				return spec, fmt.Errorf("thresholds must be strictly decreasing: %s", thresholds)
+			}
+			spec.Thresholds = append(spec.Thresholds, m)
+		}
+	default:
+		return spec, fmt.Errorf("invalid quantile method %q (expected %s, %s, %s or %s)",
+			method, methodEqualCount, methodRevenue, methodCuts, methodThresholds)
+	}
+	return spec, nil
+}
+
+// bounds returns the end index (exclusive) of every bucket of the sorted
+// slice; the last one is always len(sorted)
+func (b bucketSpec) bounds(sorted []CustomerCA) []int {
+	switch b.Method {
+	case methodRevenue:
+		return revenueBounds(sorted, b.Quantile, b.Ties, b.RankBy)
+	case methodCuts:
+		return cutBounds(sorted, b.Cuts, b.Ties, b.RankBy)
+	case methodThresholds:
+		return thresholdBounds(sorted, b.Thresholds, b.RankBy)
+	}
+	return quantileBounds(sorted, b.Quantile, b.Ties, b.RankBy)
+}
+
+// label describes bucket i in the quantile report
+func (b bucketSpec) label(i int) string {
+	switch b.Method {
+	case methodRevenue:
+		share := 100 / math.Round(1/b.Quantile)
+		return fmt.Sprintf("revenue %.1f%% - %.1f%%", float64(i)*share, float64(i+1)*share)
+	case methodCuts:
+		lo, hi := 0.0, 1.0
+		if i > 0 {
+			lo = b.Cuts[i-1]
+		}
+		if i < len(b.Cuts) {
+			hi = b.Cuts[i]
+		}
+		return fmt.Sprintf("%.1f%% - %.1f%%", lo*100, hi*100)
+	case methodThresholds:
+		name := b.RankBy
+		if name == "" || name == metricCA {
+			name = "CA"
+		}
+		switch {
+		case i == 0:
+			return fmt.Sprintf("%s >= %s", name, formatMetric(b.RankBy, b.Thresholds[0]))
+		case i == len(b.Thresholds):
+			return fmt.Sprintf("%s < %s", name, formatMetric(b.RankBy, b.Thresholds[i-1]))
+		default:
+			return fmt.Sprintf("%s <= %s < %s", formatMetric(b.RankBy, b.Thresholds[i]), name, formatMetric(b.RankBy, b.Thresholds[i-1]))
+		}
+	}
+	return fmt.Sprintf("%.1f%% - %.1f%%", float64(i)*b.Quantile*100, float64(i+1)*b.Quantile*100)
+}
+
+// String is the compact form stored with the run
+func (b bucketSpec) String() string {
+	if b.Sketch > 0 {
+		c := b
+		c.Sketch = 0
+		return fmt.Sprintf("%s sketch:%d", c, b.Sketch)
+	}
+	switch b.Method {
+	case methodCuts:
+		parts := make([]string, len(b.Cuts))
+		for i, c := range b.Cuts {
+			parts[i] = strconv.FormatFloat(c, 'f', -1, 64)
+		}
+		return b.Method + ":" + strings.Join(parts, ",")
+	case methodThresholds:
+		parts := make([]string, len(b.Thresholds))
+		for i, t := range b.Thresholds {
+			parts[i] = formatMetric(b.RankBy, t)
+		}
+		return b.Method + ":" + strings.Join(parts, ",")
+	}
+	return fmt.Sprintf("%s:%v", b.Method, b.Quantile)
+}
+
+// adjustBounds makes nominal ends non-decreasing and, with tiesKeepHigher,
+// pushes each cut past the customers tied with the last one of the bucket
+func adjustBounds(sorted []CustomerCA, ends []int, ties, rankBy string) []int {
+	n := len(sorted)
+	prev := 0
+	for i, end := range ends {
+		if end > n {
+			end = n
+		}
+		if end < prev {
+			end = prev
+		}
+		if ties == tiesKeepHigher {
+			for end > 0 && end < n && sorted[end].key(rankBy) == sorted[end-1].key(rankBy) {
+				end++
+			}
+		}
+		ends[i] = end
+		prev = end
+	}
+	ends[len(ends)-1] = n
+	return ends
+}
+
+// revenueBounds cuts where the cumulative CA reaches k/count of the total
+// (the CA weights the buckets whatever the -rank-by metric)
+func revenueBounds(sorted []CustomerCA, quantile float64, ties, rankBy string) []int {
+	n := len(sorted)
+	qCount, _ := quantileBuckets(n, quantile)
+	var total Money
+	for _, c := range sorted {
+		total += c.CA
+	}
+	ends := make([]int, qCount)
+	var cum Money
+	j := 0
+	for i := range ends {
+		// smallest j with cum(sorted[:j]) * qCount >= total * (i+1), in integers
+		for j < n && cum*Money(qCount) < total*Money(i+1) {
+			cum += sorted[j].CA
+			j++
+		}
+		ends[i] = j
+	}
+	return adjustBounds(sorted, ends, ties, rankBy)
+}
+
+// cutBounds cuts at ceil(cut * n) customers
+func cutBounds(sorted []CustomerCA, cuts []float64, ties, rankBy string) []int {
+	return adjustBounds(sorted, cutEnds(len(sorted), cuts), ties, rankBy)
+}
+
+// cutEnds are the nominal bucket ends of n customers, before the tie policy
+func cutEnds(n int, cuts []float64) []int {
+	ends := make([]int, len(cuts)+1)
+	for i, c := range cuts {
+		ends[i] = int(math.Ceil(c*float64(n) - 1e-9)) // 0.3*10 is 3.0000000000000004
+	}
+	ends[len(cuts)] = n
+	return ends
+}
+
+// thresholdBounds cuts before the first customer under each threshold; equal
+// values never straddle a threshold, so the tie policy does not apply
+func thresholdBounds(sorted []CustomerCA, thresholds []int64, rankBy string) []int {
+	ends := make([]int, len(thresholds)+1)
+	j := 0
+	for i, t := range thresholds {
+		for j < len(sorted) && sorted[j].key(rankBy) >= t {
+			j++
+		}
+		ends[i] = j
+	}
+	ends[len(thresholds)] = len(sorted)
+	return ends
+}
@@ -0,0 +1,141 @@
+// bucketing_test.go
+package main
+
+import "testing"
+
+// customers with the given CA in units, already sorted descending
+func sortedCA(cas ...int64) []CustomerCA {
+	out := make([]CustomerCA, len(cas))
+	for i, ca := range cas {
+		out[i] = CustomerCA{CustomerID: int64(100 + i), CA: Money(ca) * centsPerUnit}
+	}
+	return out
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// -------------------- Tests pour parseBucketSpec --------------------
+
+func TestParseBucketSpec(t *testing.T) {
+	t.Run("valid specs", func(t *testing.T) {
+		spec, err := parseBucketSpec(methodCuts, 0.025, "0.01, 0.05,0.2", "", tiesSplit, metricCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spec.Cuts) != 3 || spec.Cuts[2] != 0.2 || spec.String() != "cuts:0.01,0.05,0.2" {
+			t.Errorf("unexpected spec %+v (%s)", spec, spec)
+		}
+		spec, err = parseBucketSpec(methodThresholds, 0.025, "", "1000,500.50,100", tiesSplit, metricCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spec.Thresholds) != 3 || spec.Thresholds[1] != 50050 || spec.String() != "thresholds:1000.00,500.50,100.00" {
+			t.Errorf("unexpected spec %+v (%s)", spec, spec)
+		}
+		if spec, err := parseBucketSpec(methodRevenue, 0.1, "", "", tiesKeepHigher, metricCA); err != nil || spec.String() != "revenue:0.1" {
+			t.Errorf("unexpected spec %s (%v)", spec, err)
+		}
+	})
+
+	errCases := []struct {
+		name                     string
+		method, cuts, thresholds string
+		quantile                 float64
+	}{
+		{"unknown method", "deciles", "", "", 0.1},
+		{"cuts without method", methodEqualCount, "0.1", "", 0.1},
+		{"thresholds without method", methodEqualCount, "", "100", 0.1},
+		{"missing cuts", methodCuts, "", "", 0.1},
+		{"missing thresholds", methodThresholds, "", "", 0.1},
+		{"cut out of range", methodCuts, "0.5,1", "", 0.1},
+		{"cuts not increasing", methodCuts, "0.2,0.1", "", 0.1},
+		{"thresholds not decreasing", methodThresholds, "", "100,500", 0.1},
+		{"invalid threshold", methodThresholds, "", "abc", 0.1},
+		{"invalid quantile", methodRevenue, "", "", 0},
+	}
+	for _, tt := range errCases {
+		if _, err := parseBucketSpec(tt.method, tt.quantile, tt.cuts, tt.thresholds, tiesSplit, metricCA); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+	if _, err := parseBucketSpec(methodEqualCount, 0.1, "", "", "random", metricCA); err == nil {
+		t.Error("invalid tie policy: expected error")
+	}
+}
+
+// -------------------- Tests pour les méthodes de quantile --------------------
+
+func TestBucketBounds(t *testing.T) {
+	t.Run("revenue buckets hold equal shares", func(t *testing.T) {
+		// total 100: 40 | 30 | 20+10
+		sorted := sortedCA(40, 30, 20, 10)
+		ends := bucketSpec{Method: methodRevenue, Quantile: 1.0 / 3, Ties: tiesSplit}.bounds(sorted)
+		// cumulative 40 >= 33.3, 70 >= 66.6, 100 >= 100
+		if !equalInts(ends, []int{1, 2, 4}) {
+			t.Errorf("unexpected bounds %v", ends)
+		}
+	})
+
+	t.Run("revenue with a dominant customer", func(t *testing.T) {
+		sorted := sortedCA(900, 50, 30, 20)
+		ends := bucketSpec{Method: methodRevenue, Quantile: 0.25, Ties: tiesSplit}.bounds(sorted)
+		if !equalInts(ends, []int{1, 1, 1, 4}) {
+			t.Errorf("unexpected bounds %v", ends)
+		}
+	})
+
+	t.Run("cuts at customer fractions", func(t *testing.T) {
+		sorted := sortedCA(100, 90, 80, 70, 60, 50, 40, 30, 20, 10)
+		ends := bucketSpec{Method: methodCuts, Cuts: []float64{0.1, 0.3, 0.6}, Ties: tiesSplit}.bounds(sorted)
+		if !equalInts(ends, []int{1, 3, 6, 10}) {
+			t.Errorf("unexpected bounds %v", ends)
+		}
+	})
+
+	t.Run("cuts with ties kept higher", func(t *testing.T) {
+		sorted := sortedCA(100, 90, 90, 70)
+		ends := bucketSpec{Method: methodCuts, Cuts: []float64{0.5}, Ties: tiesKeepHigher}.bounds(sorted)
+		if !equalInts(ends, []int{3, 4}) {
+			t.Errorf("unexpected bounds %v", ends)
+		}
+	})
+
+	t.Run("thresholds", func(t *testing.T) {
+		sorted := sortedCA(1500, 1000, 700, 500, 20)
+		spec := bucketSpec{Method: methodThresholds, Thresholds: []int64{100000, 50000, 10000}}
+		ends := spec.bounds(sorted)
+		if !equalInts(ends, []int{2, 4, 4, 5}) {
+			t.Errorf("unexpected bounds %v", ends)
+		}
+		if spec.label(0) != "CA >= 1000.00" || spec.label(1) != "500.00 <= CA < 1000.00" || spec.label(3) != "CA < 100.00" {
+			t.Errorf("unexpected labels %q %q %q", spec.label(0), spec.label(1), spec.label(3))
+		}
+	})
+
+	t.Run("same stats and ranks for every method", func(t *testing.T) {
+		sorted := sortedCA(100, 90, 80, 70, 60, 50, 40, 30, 20, 10)
+		spec := bucketSpec{Method: methodCuts, Cuts: []float64{0.2, 0.5}, Ties: tiesSplit}
+		qStats, top := computeQuantiles(sorted, spec)
+		ranked := rankCustomers(sorted, spec)
+
+		if len(qStats) != 3 || len(top) != 2 {
+			t.Fatalf("expected 3 buckets and 2 top customers, got %d and %d", len(qStats), len(top))
+		}
+		if qStats[1].NbClients != 3 || qStats[1].TotalCA != mustParseMoney("210.00") {
+			t.Errorf("bucket 1: unexpected stats %+v", qStats[1])
+		}
+		if ranked[1].Quantile != 0 || ranked[2].Quantile != 1 || ranked[5].Quantile != 2 {
+			t.Errorf("unexpected quantiles %d %d %d", ranked[1].Quantile, ranked[2].Quantile, ranked[5].Quantile)
+		}
+	})
+}
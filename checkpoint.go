@@ -0,0 +1,289 @@
+// checkpoint.go
+//
+// Checkpoints (-checkpoint DIR): the result of the LOAD stage (CA, metrics
+// and emails per customer with the input counters) and of the quantile stage
+// (statistics and ranked customers to export) are saved to DIR, so that
+// -resume restarts after the last stage completed with the same parameters
+// instead of reloading every event. Checkpoints are gob-encoded and gzipped,
+// written to a temporary file renamed into place, and removed once a run
+// succeeds.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	stageLoaded    = "loaded"    // CA, metrics and emails per customer
+	stageQuantiles = "quantiles" // quantile statistics and ranked customers
+
+	checkpointMagic = "QCKPT1" // format of the checkpoint files, bumped on change
+)
+
+// loadParams identifies the data of the LOAD stage
+func loadParams(p period) string {
+	return fmt.Sprintf("period=%s pricing=%s currency=%s rates=%s%s source=%s purchase=%s refund=%s incremental=%t",
+		p, pricing, currency, ratesTbl, ratesFile, sourceStr, joinTypes(eventTypesCfg.Purchase), joinTypes(eventTypesCfg.Refund), incrState)
+}
+
+// computeParams identifies the result of the quantile stage
+func computeParams(p period) string {
+	return fmt.Sprintf("%s mode=%s buckets=%s ties=%s rank_by=%s export=%s",
+		loadParams(p), modeStr, buckets, buckets.Ties, buckets.RankBy, exportStr)
+}
+
+// runInputs are the fields of the run record filled by the LOAD stage
+type runInputs struct {
+	SnapshotAt             time.Time
+	Watermark              time.Time
+	NbEvents               int
+	NbPrices               int
+	NbEmails               int
+	SkippedMissingPrice    int
+	SkippedPredatingPrice  int
+	SkippedUnknownCurrency int
+	NbRefunds              int
+	Refunded               Money
+}
+
+func inputsOf(r *runRecord) runInputs {
+	return runInputs{
+		SnapshotAt: r.SnapshotAt, Watermark: r.Watermark,
+		NbEvents: r.NbEvents, NbPrices: r.NbPrices, NbEmails: r.NbEmails,
+		SkippedMissingPrice: r.SkippedMissingPrice, SkippedPredatingPrice: r.SkippedPredatingPrice,
+		SkippedUnknownCurrency: r.SkippedUnknownCurrency, NbRefunds: r.NbRefunds, Refunded: r.Refunded,
+	}
+}
+
+func (in runInputs) restore(r *runRecord) {
+	r.SnapshotAt, r.Watermark = in.SnapshotAt, in.Watermark
+	r.NbEvents, r.NbPrices, r.NbEmails = in.NbEvents, in.NbPrices, in.NbEmails
+	r.SkippedMissingPrice, r.SkippedPredatingPrice = in.SkippedMissingPrice, in.SkippedPredatingPrice
+	r.SkippedUnknownCurrency, r.NbRefunds, r.Refunded = in.SkippedUnknownCurrency, in.NbRefunds, in.Refunded
+}
+
+// loadedCheckpoint is the result of the LOAD stage
+type loadedCheckpoint struct {
+	Params  string
+	Inputs  runInputs
+	CA      map[int64]Money
+	Metrics map[int64]*Metrics
+	Emails  map[int64]string
+}
+
+// restore fills the run record and returns the aggregator and email map of
+// the checkpoint; the distinct product and day sets are not kept
+func (c *loadedCheckpoint) restore(run *runRecord) (*caAggregator, map[int64]string) {
+	c.Inputs.restore(run)
+	agg := newCAAggregator(nil)
+	// gob decodes an empty map as nil
+	if c.CA != nil {
+		agg.ca = c.CA
+	}
+	if c.Metrics != nil {
+		agg.metrics.counts = c.Metrics
+	}
+	agg.nbEvents = c.Inputs.NbEvents
+	return agg, c.Emails
+}
+
+// quantileCheckpoint is the result of the quantile stage, all the EXPORT
+// stage needs
+type quantileCheckpoint struct {
+	Params        string
+	Inputs        runInputs
+	NbCustomers   int
+	QStats        map[int]QuantileStats
+	Concentration *concentrationReport
+	Ranked        []RankedCustomer // customers exported
+}
+
+func (c *quantileCheckpoint) restore(run *runRecord) {
+	c.Inputs.restore(run)
+	run.NbCustomers = c.NbCustomers
+	run.Thresholds = quantileThresholds(c.QStats)
+	run.Concentration = c.Concentration
+}
+
+// checkpointer saves and reads the checkpoints of a run. A nil checkpointer
+// saves nothing.
+type checkpointer struct {
+	dir           string
+	loadParams    string
+	computeParams string
+}
+
+func newCheckpointer(dir, loadParams, computeParams string) (*checkpointer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &checkpointer{dir: dir, loadParams: loadParams, computeParams: computeParams}, nil
+}
+
+func (c *checkpointer) path(stage string) string {
+	return filepath.Join(c.dir, stage+".ckpt")
+}
+
+func (c *checkpointer) saveLoaded(agg *caAggregator, emailMap map[int64]string, run *runRecord) {
+	if c == nil {
+		return
+	}
+	c.save(stageLoaded, &loadedCheckpoint{
+		Params: c.loadParams, Inputs: inputsOf(run), CA: agg.ca, Metrics: agg.metrics.counts, Emails: emailMap,
+	})
+}
+
+func (c *checkpointer) saveQuantiles(run *runRecord, qStats map[int]QuantileStats, ranked []RankedCustomer) {
+	if c == nil {
+		return
+	}
+	c.save(stageQuantiles, &quantileCheckpoint{
+		Params: c.computeParams, Inputs: inputsOf(run), NbCustomers: run.NbCustomers,
+		QStats: qStats, Concentration: run.Concentration, Ranked: ranked,
+	})
+}
+
+// save writes the checkpoint of stage; a failure is only logged, the run
+// goes on without it
+func (c *checkpointer) save(stage string, v interface{}) {
+	start := time.Now()
+	size, err := writeCheckpoint(c.path(stage), v)
+	if err != nil {
+		log.WithField("stage", stage).Warnf("failed to save checkpoint: %v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"stage":    stage,
+		"path":     c.path(stage),
+		"bytes":    size,
+		"duration": time.Since(start).String(),
+	}).Info("checkpoint saved")
+}
+
+// resumeQuantiles returns the checkpoint of the quantile stage, nil when
+// there is none for the parameters of the run
+func (c *checkpointer) resumeQuantiles() *quantileCheckpoint {
+	var qc quantileCheckpoint
+	if !c.resume(stageQuantiles, c.computeParams, &qc, &qc.Params) {
+		return nil
+	}
+	return &qc
+}
+
+// resumeLoaded returns the checkpoint of the LOAD stage, nil when there is
+// none for the parameters of the run
+func (c *checkpointer) resumeLoaded() *loadedCheckpoint {
+	var lc loadedCheckpoint
+	if !c.resume(stageLoaded, c.loadParams, &lc, &lc.Params) {
+		return nil
+	}
+	return &lc
+}
+
+// resume reads the checkpoint of stage into v. A missing, unreadable or
+// foreign checkpoint is not an error: the stage is run again.
+func (c *checkpointer) resume(stage, want string, v interface{}, params *string) bool {
+	path := c.path(stage)
+	err := readCheckpoint(path, v)
+	switch {
+	case os.IsNotExist(err):
+		log.WithField("stage", stage).Info("no checkpoint to resume from")
+		return false
+	case err != nil:
+		log.WithFields(log.Fields{"stage": stage, "path": path}).Warnf("checkpoint ignored: %v", err)
+		return false
+	case *params != want:
+		log.WithFields(log.Fields{"stage": stage, "path": path, "checkpoint_params": *params}).Warn("checkpoint ignored: saved with other parameters")
+		return false
+	}
+	log.WithFields(log.Fields{"stage": stage, "path": path}).Info("resuming from checkpoint")
+	return true
+}
+
+// clear removes the checkpoints once the run succeeded, so that a later
+// -resume does not reuse stale data
+func (c *checkpointer) clear() {
+	for _, stage := range []string{stageLoaded, stageQuantiles} {
+		if err := os.Remove(c.path(stage)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("failed to remove checkpoint %s: %v", c.path(stage), err)
+		}
+	}
+}
+
+// writeCheckpoint writes v to path through a temporary file, so that an
+// interrupted write never leaves a truncated checkpoint; it returns the size
+// of the file
+func writeCheckpoint(path string, v interface{}) (int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	tmp := f.Name()
+	fail := func(err error) (int64, error) {
+		f.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	w := bufio.NewWriter(f)
+	if _, err := w.WriteString(checkpointMagic); err != nil {
+		return fail(err)
+	}
+	zw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return fail(err)
+	}
+	if err := gob.NewEncoder(zw).Encode(v); err != nil {
+		return fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// readCheckpoint decodes the checkpoint at path into v
+func readCheckpoint(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != checkpointMagic {
+		return fmt.Errorf("not a checkpoint file (or an older format)")
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return gob.NewDecoder(zr).Decode(v)
+}
@@ -0,0 +1,114 @@
+// checkpoint_test.go
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// -------------------- Tests pour checkpointer --------------------
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	ck, err := newCheckpointer(dir, "load-a", "compute-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agg := newCAAggregator(map[int]Money{10: mustParseMoney("9.99")})
+	agg.add(EventRow{CustomerID: 1, ContentID: 10, EventTypeID: 6, Quantity: 2, EventDate: mustParseDate("2021-03-01")})
+	agg.add(EventRow{CustomerID: 2, ContentID: 10, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2021-03-02")})
+	run := &runRecord{NbEvents: 2, NbPrices: 1, SnapshotAt: time.Date(2021, 3, 3, 12, 0, 0, 0, time.UTC), Refunded: mustParseMoney("1.50")}
+	ck.saveLoaded(agg, map[int64]string{1: "a@x.com"}, run)
+
+	t.Run("loaded stage", func(t *testing.T) {
+		lc := ck.resumeLoaded()
+		if lc == nil {
+			t.Fatal("no checkpoint resumed")
+		}
+		got := &runRecord{}
+		gotAgg, emails := lc.restore(got)
+		if got.NbEvents != 2 || got.NbPrices != 1 || !got.SnapshotAt.Equal(run.SnapshotAt) || got.Refunded != run.Refunded {
+			t.Errorf("run inputs: got %+v", got)
+		}
+		want := agg.customers(map[int64]string{1: "a@x.com"}, metricCA)
+		customers := gotAgg.customers(emails, metricCA)
+		if len(customers) != len(want) {
+			t.Fatalf("got %d customers, want %d", len(customers), len(want))
+		}
+		for i := range want {
+			if customers[i] != want[i] {
+				t.Errorf("customer %d: got %+v, want %+v", i, customers[i], want[i])
+			}
+		}
+	})
+
+	t.Run("quantile stage", func(t *testing.T) {
+		if ck.resumeQuantiles() != nil {
+			t.Fatal("resumed a quantile stage never saved")
+		}
+		sorted := agg.customers(nil, metricCA)
+		spec := bucketSpec{Method: methodEqualCount, Quantile: 0.5, Ties: tiesSplit, RankBy: metricCA}
+		qStats, _ := computeQuantiles(sorted, spec)
+		run.NbCustomers = len(sorted)
+		run.Concentration = concentration(sorted)
+		ck.saveQuantiles(run, qStats, rankCustomers(sorted, spec))
+
+		qc := ck.resumeQuantiles()
+		if qc == nil {
+			t.Fatal("no checkpoint resumed")
+		}
+		got := &runRecord{}
+		qc.restore(got)
+		if got.NbCustomers != 2 || len(got.Thresholds) != 2 || got.Concentration == nil || len(qc.Ranked) != 2 {
+			t.Errorf("got %+v, ranked %+v", got, qc.Ranked)
+		}
+		if qc.Ranked[0].CustomerID != 1 || qc.Ranked[0].Quantile != 0 || qc.QStats[1].TotalCA != mustParseMoney("9.99") {
+			t.Errorf("got ranked %+v, stats %+v", qc.Ranked, qc.QStats)
+		}
+	})
+
+	t.Run("other parameters", func(t *testing.T) {
+		other := &checkpointer{dir: dir, loadParams: "load-b", computeParams: "compute-a"}
+		if other.resumeLoaded() != nil {
+			t.Error("resumed a checkpoint saved with other parameters")
+		}
+	})
+
+	t.Run("not a checkpoint", func(t *testing.T) {
+		writeTestFile(t, dir, "loaded.ckpt", "garbage")
+		if ck.resumeLoaded() != nil {
+			t.Error("resumed an invalid checkpoint")
+		}
+	})
+
+	t.Run("cleared after success", func(t *testing.T) {
+		ck.clear()
+		for _, stage := range []string{stageLoaded, stageQuantiles} {
+			if _, err := os.Stat(ck.path(stage)); !os.IsNotExist(err) {
+				t.Errorf("%s checkpoint still present: %v", stage, err)
+			}
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 0 {
+			t.Errorf("leftover files: %v", entries)
+		}
+	})
+}
+
+func TestCheckpointNoCustomers(t *testing.T) {
+	ck, err := newCheckpointer(t.TempDir(), "load", "compute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ck.saveLoaded(newCAAggregator(nil), map[int64]string{}, &runRecord{})
+	lc := ck.resumeLoaded()
+	if lc == nil {
+		t.Fatal("no checkpoint resumed")
+	}
+	agg, _ := lc.restore(&runRecord{})
+	if agg.ca == nil || agg.metrics.counts == nil {
+		t.Error("empty maps restored as nil")
+	}
+}
@@ -0,0 +1,243 @@
+// cohort.go
+//
+// Monthly cohort retention (-cohorts): customers are grouped by the month of
+// their first purchase in the period, and for every following month the
+// cohort matrix gives how many of them purchased again and their net revenue.
+// The matrix is exported to MySQL next to the quantile export and, with
+// -cohort-csv, to a CSV file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// monthIndex numbers the UTC calendar months: year*12 + month-1
+func monthIndex(t time.Time) int {
+	t = t.UTC()
+	return t.Year()*12 + int(t.Month()) - 1
+}
+
+// monthString renders a monthIndex as YYYY-MM
+func monthString(m int) string {
+	return fmt.Sprintf("%04d-%02d", m/12, m%12+1)
+}
+
+// cohortTracker records, per customer, the months with a purchase and the net
+// revenue of every month, in the same pass as the CA
+type cohortTracker struct {
+	first   map[int64]int // CustomerID -> month of the first purchase
+	active  map[int64]map[int]struct{}
+	revenue map[int64]map[int]Money
+	last    int // latest month seen, purchases and refunds alike
+}
+
+func newCohortTracker() *cohortTracker {
+	return &cohortTracker{
+		first:   make(map[int64]int),
+		active:  make(map[int64]map[int]struct{}),
+		revenue: make(map[int64]map[int]Money),
+		last:    -1,
+	}
+}
+
+func (t *cohortTracker) addRevenue(customerID int64, m int, amount Money) {
+	if t.revenue[customerID] == nil {
+		t.revenue[customerID] = make(map[int]Money)
+	}
+	t.revenue[customerID][m] += amount
+	if m > t.last {
+		t.last = m
+	}
+}
+
+// purchase records a valued purchase; events arrive in EventDataID order, so
+// the first month is the earliest seen so far
+func (t *cohortTracker) purchase(customerID int64, at time.Time, amount Money) {
+	m := monthIndex(at)
+	if f, ok := t.first[customerID]; !ok || m < f {
+		t.first[customerID] = m
+	}
+	if t.active[customerID] == nil {
+		t.active[customerID] = make(map[int]struct{})
+	}
+	t.active[customerID][m] = struct{}{}
+	t.addRevenue(customerID, m, amount)
+}
+
+// refund records a valued refund, subtracted from the revenue of its month
+func (t *cohortTracker) refund(customerID int64, at time.Time, amount Money) {
+	t.addRevenue(customerID, monthIndex(at), -amount)
+}
+
+// CohortCell is one cell of the cohort matrix: customers first purchasing in
+// Cohort, Offset months later
+type CohortCell struct {
+	Cohort    int // monthIndex of the first purchase
+	Offset    int // months since the first purchase, 0 is the cohort month
+	Size      int // customers of the cohort
+	Active    int // customers of the cohort with a purchase in the month
+	Retention float64
+	Revenue   Money // net revenue of the cohort in the month
+}
+
+// matrix returns every cell from the cohort month to the latest month seen,
+// ordered by cohort then offset. Customers without a purchase have no cohort;
+// refunds dated before the first purchase are ignored.
+func (t *cohortTracker) matrix() []CohortCell {
+	type key struct{ cohort, offset int }
+	sizes := map[int]int{}
+	active := map[key]int{}
+	revenue := map[key]Money{}
+	for cid, c := range t.first {
+		sizes[c]++
+		for m := range t.active[cid] {
+			active[key{c, m - c}]++
+		}
+		for m, amount := range t.revenue[cid] {
+			if m >= c {
+				revenue[key{c, m - c}] += amount
+			}
+		}
+	}
+
+	months := make([]int, 0, len(sizes))
+	for c := range sizes {
+		months = append(months, c)
+	}
+	sort.Ints(months)
+	var out []CohortCell
+	for _, c := range months {
+		for off := 0; c+off <= t.last; off++ {
+			k := key{c, off}
+			out = append(out, CohortCell{
+				Cohort: c, Offset: off, Size: sizes[c], Active: active[k],
+				Retention: float64(active[k]) / float64(sizes[c]), Revenue: revenue[k],
+			})
+		}
+	}
+	return out
+}
+
+// logCohorts logs, per cohort, its size, its retention one month later and its revenue
+func logCohorts(cells []CohortCell) {
+	if len(cells) == 0 {
+		log.Warn("no cohorts (no purchases)")
+		return
+	}
+	log.Info("========== COHORT RETENTION ==========")
+	for i := 0; i < len(cells); {
+		j := i
+		var total Money
+		for ; j < len(cells) && cells[j].Cohort == cells[i].Cohort; j++ {
+			total += cells[j].Revenue
+		}
+		fields := log.Fields{"cohort": monthString(cells[i].Cohort), "size": cells[i].Size, "months": j - i, "total_revenue": total.String()}
+		if j-i > 1 {
+			fields["retention_m1"] = fmt.Sprintf("%.2f%%", cells[i+1].Retention*100)
+		}
+		log.WithFields(fields).Info("cohort summary")
+		i = j
+	}
+	log.Info("======================================")
+}
+
+// writeCohortCSV writes the matrix in long form, one line per cell
+func writeCohortCSV(w io.Writer, cells []CohortCell) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"cohort", "month_offset", "month", "cohort_size", "active_customers", "retention", "revenue"}); err != nil {
+		return err
+	}
+	for _, c := range cells {
+		rec := []string{
+			monthString(c.Cohort), strconv.Itoa(c.Offset), monthString(c.Cohort + c.Offset),
+			strconv.Itoa(c.Size), strconv.Itoa(c.Active), strconv.FormatFloat(c.Retention, 'f', 4, 64), c.Revenue.String(),
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func saveCohortCSV(path string, cells []CohortCell) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeCohortCSV(f, cells); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"stage": "EXPORT", "file": path, "cells": len(cells)}).Info("cohort matrix written")
+	return nil
+}
+
+// runCohorts logs the cohort matrix and writes it to -cohort-csv and to
+// test_cohorts_YYYYMMDD[_<since>_<until>]
+func runCohorts(db *sql.DB, p period, run *runRecord, cells []CohortCell) error {
+	logCohorts(cells)
+	if cohortCSV != "" {
+		if err := saveCohortCSV(cohortCSV, cells); err != nil {
+			return fmt.Errorf("failed to write cohort CSV: %w", err)
+		}
+	}
+	tableName := fmt.Sprintf("test_cohorts_%s%s", time.Now().Format("20060102"), p.tableSuffix())
+	if db == nil {
+		log.WithField("table", tableName).Warn("no database configured; cohort export skipped")
+		return nil
+	}
+	if err := exportCohorts(db, tableName, cells, run.ID); err != nil {
+		return fmt.Errorf("failed to export cohorts: %w", err)
+	}
+	run.CohortTable = tableName
+	return nil
+}
+
+func ensureCohortTable(db *sql.DB, tableName string) error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	Cohort CHAR(7) NOT NULL,
+	MonthOffset INT NOT NULL,
+	Month CHAR(7) NOT NULL,
+	CohortSize INT NOT NULL,
+	ActiveCustomers INT NOT NULL,
+	Retention DECIMAL(7,4) NOT NULL,
+	Revenue DECIMAL(18,2) NOT NULL,
+	RunID BIGINT NOT NULL,
+	PRIMARY KEY (Cohort, MonthOffset)
+) ENGINE=InnoDB;`, tableName)
+	_, err := db.Exec(q)
+	return err
+}
+
+// exportCohorts replaces tableName with the cohort matrix
+func exportCohorts(db *sql.DB, tableName string, cells []CohortCell, runID int64) error {
+	return replaceTable(db, tableName, func(staging string) error {
+		if err := ensureCohortTable(db, staging); err != nil {
+			return err
+		}
+		if len(cells) == 0 {
+			return nil
+		}
+		log.WithFields(log.Fields{"stage": "EXPORT", "table": staging, "count": len(cells)}).Info("exporting cohort matrix (batch)")
+		columns := []string{"Cohort", "MonthOffset", "Month", "CohortSize", "ActiveCustomers", "Retention", "Revenue", "RunID"}
+		return insertRows(db, staging, columns, len(cells), func(i int) []interface{} {
+			c := cells[i]
+			return []interface{}{monthString(c.Cohort), c.Offset, monthString(c.Cohort + c.Offset), c.Size, c.Active,
+				fmt.Sprintf("%.4f", c.Retention), c.Revenue, runID}
+		})
+	})
+}
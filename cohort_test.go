@@ -0,0 +1,63 @@
+// cohort_test.go
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// -------------------- Tests pour la matrice de cohortes --------------------
+
+func TestCohortMatrix(t *testing.T) {
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7}}
+	agg := newCAAggregator(map[int]Money{10: mustParseMoney("10.00")}).withEventTypes(et).withCohorts()
+	for _, e := range []EventRow{
+		// January cohort: 100 and 101; 100 comes back in February, 101 in March
+		{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2020-02-10")},
+		{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 2, EventDate: mustParseDate("2020-01-05")}, // older event loaded later
+		{ContentID: 10, CustomerID: 101, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2020-01-31")},
+		{ContentID: 10, CustomerID: 101, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2020-03-01")},
+		{ContentID: 10, CustomerID: 101, EventTypeID: 7, Quantity: 1, EventDate: mustParseDate("2020-03-15")},
+		// February cohort: 102
+		{ContentID: 10, CustomerID: 102, EventTypeID: 6, Quantity: 3, EventDate: mustParseDate("2020-02-20")},
+		// refunds only: no cohort
+		{ContentID: 10, CustomerID: 103, EventTypeID: 7, Quantity: 1, EventDate: mustParseDate("2020-02-01")},
+	} {
+		agg.add(e)
+	}
+
+	cells := agg.cohorts.matrix()
+	want := []CohortCell{
+		{Cohort: monthIndex(mustParseDate("2020-01-01")), Offset: 0, Size: 2, Active: 2, Retention: 1, Revenue: 3000},
+		{Cohort: monthIndex(mustParseDate("2020-01-01")), Offset: 1, Size: 2, Active: 1, Retention: 0.5, Revenue: 1000},
+		{Cohort: monthIndex(mustParseDate("2020-01-01")), Offset: 2, Size: 2, Active: 1, Retention: 0.5, Revenue: 0}, // purchase and refund
+		{Cohort: monthIndex(mustParseDate("2020-02-01")), Offset: 0, Size: 1, Active: 1, Retention: 1, Revenue: 3000},
+		{Cohort: monthIndex(mustParseDate("2020-02-01")), Offset: 1, Size: 1, Active: 0, Retention: 0, Revenue: 0},
+	}
+	if len(cells) != len(want) {
+		t.Fatalf("expected %d cells, got %d: %+v", len(want), len(cells), cells)
+	}
+	for i := range want {
+		if cells[i] != want[i] {
+			t.Errorf("cell %d: got %+v, want %+v", i, cells[i], want[i])
+		}
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeCohortCSV(&buf, cells[:2]); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 3 || lines[2] != "2020-01,1,2020-02,2,1,0.5000,10.00" {
+			t.Errorf("unexpected CSV:\n%s", buf.String())
+		}
+	})
+
+	t.Run("month index", func(t *testing.T) {
+		if m := monthIndex(mustParseDate("2020-12-31")); monthString(m) != "2020-12" || monthString(m+1) != "2021-01" {
+			t.Errorf("got %s, %s", monthString(m), monthString(m+1))
+		}
+	})
+}
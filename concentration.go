@@ -0,0 +1,119 @@
+// concentration.go
+//
+// Revenue concentration: Lorenz curve, Gini coefficient and Pareto shares
+// ("top X% of customers make Y% of revenue") of the CA distribution, logged
+// with the quantile summary and stored with the run.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const lorenzSteps = 20 // Lorenz curve points every 5% of customers
+
+// customer fractions of the Pareto shares
+var paretoCuts = []float64{0.01, 0.05, 0.1, 0.2, 0.5}
+
+// paretoTarget is the revenue share for which the smallest top fraction of
+// customers is reported (the "80/20" figure)
+const paretoTarget = 0.8
+
+type lorenzPoint struct {
+	Customers float64 `json:"customers"` // cumulative share of customers, lowest CA first
+	Revenue   float64 `json:"revenue"`   // cumulative share of revenue
+}
+
+type paretoShare struct {
+	Customers float64 `json:"top_customers"` // share of customers, highest CA first
+	Revenue   float64 `json:"revenue"`       // share of revenue they make
+}
+
+// concentrationReport describes how concentrated the CA is
+type concentrationReport struct {
+	NbClients    int           `json:"nb_clients"`
+	Gini         float64       `json:"gini"`
+	Lorenz       []lorenzPoint `json:"lorenz"`
+	TopShares    []paretoShare `json:"top_shares"`
+	TargetShare  float64       `json:"target_revenue"`   // paretoTarget
+	CustomersFor float64       `json:"target_customers"` // smallest top share of customers making TargetShare
+}
+
+// concentration computes the report from the customers' CA, in any order.
+// Negative CA (refunds exceeding purchases) counts as zero so the curve stays
+// monotonic; it returns nil when no customer has a positive CA.
+func concentration(customers []CustomerCA) *concentrationReport {
+	n := len(customers)
+	cas := make([]Money, n)
+	var total Money
+	for i, c := range customers {
+		if c.CA > 0 {
+			cas[i] = c.CA
+			total += c.CA
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+	sort.Slice(cas, func(i, j int) bool { return cas[i] < cas[j] })
+	// cum[k] = CA of the k lowest customers
+	cum := make([]Money, n+1)
+	for i, v := range cas {
+		cum[i+1] = cum[i] + v
+	}
+	share := func(m Money) float64 { return m.Float64() / total.Float64() }
+
+	r := &concentrationReport{NbClients: n, TargetShare: paretoTarget}
+
+	// Gini = 2 * sum(i * x_i) / (n * sum(x)) - (n + 1) / n, x ascending, i from 1
+	weighted := 0.0
+	for i, v := range cas {
+		weighted += float64(i+1) * v.Float64()
+	}
+	r.Gini = 2*weighted/(float64(n)*total.Float64()) - float64(n+1)/float64(n)
+
+	for s := 0; s <= lorenzSteps; s++ {
+		f := float64(s) / lorenzSteps
+		k := int(math.Round(f * float64(n)))
+		r.Lorenz = append(r.Lorenz, lorenzPoint{Customers: f, Revenue: share(cum[k])})
+	}
+
+	for _, f := range paretoCuts {
+		k := int(math.Ceil(f*float64(n) - 1e-9))
+		r.TopShares = append(r.TopShares, paretoShare{Customers: f, Revenue: share(total - cum[n-k])})
+	}
+
+	// smallest top k customers making at least paretoTarget of the revenue
+	for k := 1; k <= n; k++ {
+		if share(total-cum[n-k]) >= paretoTarget-1e-12 {
+			r.CustomersFor = float64(k) / float64(n)
+			break
+		}
+	}
+	return r
+}
+
+// logConcentration logs the Gini coefficient, the Pareto shares and the Lorenz curve
+func logConcentration(r *concentrationReport) {
+	if r == nil {
+		log.Warn("no revenue concentration (no positive CA)")
+		return
+	}
+	points := make([]string, len(r.Lorenz))
+	for i, p := range r.Lorenz {
+		points[i] = fmt.Sprintf("%.2f:%.4f", p.Customers, p.Revenue)
+	}
+	log.WithFields(log.Fields{
+		"gini":   fmt.Sprintf("%.4f", r.Gini),
+		"lorenz": strings.Join(points, " "),
+	}).Info("revenue concentration")
+	for _, s := range r.TopShares {
+		log.Infof("top %.1f%% of customers make %.2f%% of revenue", s.Customers*100, s.Revenue*100)
+	}
+	log.Infof("%.0f%% of revenue is made by the top %.2f%% of customers", r.TargetShare*100, r.CustomersFor*100)
+}
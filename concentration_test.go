@@ -0,0 +1,63 @@
+// concentration_test.go
+package main
+
+import "testing"
+
+// -------------------- Tests pour concentration --------------------
+
+func TestConcentration(t *testing.T) {
+	t.Run("equal revenue", func(t *testing.T) {
+		r := concentration(sortedCA(10, 10, 10, 10))
+		if !floatEqual(r.Gini, 0, 1e-9) {
+			t.Errorf("gini: got %v, want 0", r.Gini)
+		}
+		for _, p := range r.Lorenz {
+			if !floatEqual(p.Revenue, float64(int(p.Customers*4+0.5))/4, 1e-9) {
+				t.Errorf("lorenz point %+v off the diagonal", p)
+			}
+		}
+	})
+
+	t.Run("one customer makes everything", func(t *testing.T) {
+		r := concentration(sortedCA(100, 0, 0, 0))
+		if !floatEqual(r.Gini, 0.75, 1e-9) { // (n-1)/n
+			t.Errorf("gini: got %v, want 0.75", r.Gini)
+		}
+		if r.TopShares[0].Revenue != 1 || !floatEqual(r.CustomersFor, 0.25, 1e-9) {
+			t.Errorf("unexpected pareto figures %+v, %v", r.TopShares, r.CustomersFor)
+		}
+	})
+
+	t.Run("pareto shares and lorenz curve", func(t *testing.T) {
+		r := concentration(sortedCA(50, 20, 10, 5, 5, 4, 3, 1, 1, 1))
+		want := map[float64]float64{0.01: 0.5, 0.05: 0.5, 0.1: 0.5, 0.2: 0.7, 0.5: 0.9}
+		for _, s := range r.TopShares {
+			if !floatEqual(s.Revenue, want[s.Customers], 1e-9) {
+				t.Errorf("top %v: got %v, want %v", s.Customers, s.Revenue, want[s.Customers])
+			}
+		}
+		if !floatEqual(r.CustomersFor, 0.3, 1e-9) {
+			t.Errorf("customers for 80%%: got %v, want 0.3", r.CustomersFor)
+		}
+		if len(r.Lorenz) != lorenzSteps+1 || !floatEqual(r.Lorenz[10].Revenue, 0.1, 1e-9) || r.Lorenz[lorenzSteps].Revenue != 1 {
+			t.Errorf("unexpected lorenz curve %+v", r.Lorenz)
+		}
+	})
+
+	t.Run("negative CA counts as zero", func(t *testing.T) {
+		a := concentration(sortedCA(30, 10, -20))
+		b := concentration(sortedCA(30, 10, 0))
+		if !floatEqual(a.Gini, b.Gini, 1e-12) {
+			t.Errorf("gini: got %v, want %v", a.Gini, b.Gini)
+		}
+	})
+
+	t.Run("no positive revenue", func(t *testing.T) {
+		if r := concentration(sortedCA(0, -5)); r != nil {
+			t.Errorf("expected nil report, got %+v", r)
+		}
+		if r := concentration(nil); r != nil {
+			t.Errorf("expected nil report, got %+v", r)
+		}
+	})
+}
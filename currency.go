@@ -0,0 +1,177 @@
+// currency.go
+//
+// Exchange rates used to express every ContentPrice in a single reporting currency.
+// Rates are read from a MySQL table or a CSV file and may be dated: a dated rate
+// applies from its date until the next one, an undated rate applies at any date.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExchangeRateRow gives the value of 1 unit of Currency in the reporting currency.
+// RateDate is the zero time for undated rates.
+type ExchangeRateRow struct {
+	Currency string
+	Rate     float64
+	RateDate time.Time
+}
+
+// -------------------- LOAD --------------------
+
+// Read exchange rates from a MySQL table with columns Currency, Rate, RateDate (nullable)
+func loadExchangeRates(ctx context.Context, db queryer, tableName string) ([]ExchangeRateRow, error) {
+	log.WithFields(log.Fields{"stage": "LOAD", "table": tableName}).Info("loading exchange rates")
+	q := fmt.Sprintf(`SELECT Currency, Rate, RateDate FROM %s`, tableName)
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ExchangeRateRow
+	for rows.Next() {
+		var r ExchangeRateRow
+		var d sql.NullTime
+		if err := rows.Scan(&r.Currency, &r.Rate, &d); err != nil {
+			return nil, err
+		}
+		if d.Valid {
+			r.RateDate = d.Time
+		}
+		r.Currency = strings.ToUpper(strings.TrimSpace(r.Currency))
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	log.WithField("loaded_rates", len(out)).Info("exchange rates loaded")
+	return out, nil
+}
+
+// Read exchange rates from a CSV file with a header line: currency,rate[,date]
+func loadExchangeRatesCSV(path string) ([]ExchangeRateRow, error) {
+	log.WithFields(log.Fields{"stage": "LOAD", "file": path}).Info("loading exchange rates")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out, err := parseExchangeRatesCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	log.WithField("loaded_rates", len(out)).Info("exchange rates loaded")
+	return out, nil
+}
+
+func parseExchangeRatesCSV(r io.Reader) ([]ExchangeRateRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	curIdx, ok1 := col["currency"]
+	rateIdx, ok2 := col["rate"]
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("header must contain currency and rate columns, got %v", header)
+	}
+	dateIdx, hasDate := col["date"]
+
+	var out []ExchangeRateRow
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if curIdx >= len(rec) || rateIdx >= len(rec) {
+			return nil, fmt.Errorf("line %d: missing columns", line)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rec[rateIdx]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, rec[rateIdx])
+		}
+		r := ExchangeRateRow{Currency: strings.ToUpper(strings.TrimSpace(rec[curIdx])), Rate: rate}
+		if hasDate && dateIdx < len(rec) && strings.TrimSpace(rec[dateIdx]) != "" {
+			d, err := time.Parse("2006-01-02", strings.TrimSpace(rec[dateIdx]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid date %q", line, rec[dateIdx])
+			}
+			r.RateDate = d
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// -------------------- COMPUTE --------------------
+
+// Rate history per currency, sorted by RateDate ascending (undated rates first)
+type rateTable map[string][]ExchangeRateRow
+
+func buildRateTable(rates []ExchangeRateRow) rateTable {
+	rt := make(rateTable)
+	for _, r := range rates {
+		rt[r.Currency] = append(rt[r.Currency], r)
+	}
+	for _, hist := range rt {
+		sort.SliceStable(hist, func(i, j int) bool { return hist[i].RateDate.Before(hist[j].RateDate) })
+	}
+	return rt
+}
+
+// rateAt returns the rate converting currency into the reporting currency at date t.
+// Amounts already in the reporting currency use a rate of 1. When t is older than
+// every dated rate, the oldest rate is used.
+func (rt rateTable) rateAt(currency, reporting string, t time.Time) (float64, bool) {
+	currency = strings.ToUpper(currency)
+	if currency == reporting {
+		return 1, true
+	}
+	hist, ok := rt[currency]
+	if !ok || len(hist) == 0 {
+		return 0, false
+	}
+	i := sort.Search(len(hist), func(i int) bool { return hist[i].RateDate.After(t) })
+	if i == 0 {
+		return hist[0].Rate, true
+	}
+	return hist[i-1].Rate, true
+}
+
+// distinctCurrencies lists the currencies used by prices, sorted
+func distinctCurrencies(prices []ContentPriceRow) []string {
+	seen := map[string]bool{}
+	for _, p := range prices {
+		seen[strings.ToUpper(p.Currency)] = true
+	}
+	out := make([]string, 0, len(seen))
+	for c := range seen {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,131 @@
+// currency_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// -------------------- Tests pour parseExchangeRatesCSV --------------------
+
+func TestParseExchangeRatesCSV(t *testing.T) {
+	t.Run("dated and undated rates", func(t *testing.T) {
+		in := "currency,rate,date\nusd,0.9,2020-01-01\nUSD,0.8,2021-01-01\nGBP,1.15,\n"
+		rates, err := parseExchangeRatesCSV(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(rates) != 3 {
+			t.Fatalf("expected 3 rates, got %d", len(rates))
+		}
+		if rates[0].Currency != "USD" {
+			t.Errorf("expected currency upper-cased to USD, got %s", rates[0].Currency)
+		}
+		if !rates[2].RateDate.IsZero() {
+			t.Errorf("expected undated GBP rate, got %v", rates[2].RateDate)
+		}
+	})
+
+	t.Run("missing rate column", func(t *testing.T) {
+		if _, err := parseExchangeRatesCSV(strings.NewReader("currency,date\nUSD,2020-01-01\n")); err == nil {
+			t.Error("expected error for missing rate column")
+		}
+	})
+
+	t.Run("invalid rate", func(t *testing.T) {
+		if _, err := parseExchangeRatesCSV(strings.NewReader("currency,rate\nUSD,abc\n")); err == nil {
+			t.Error("expected error for invalid rate")
+		}
+	})
+}
+
+// -------------------- Tests pour rateTable --------------------
+
+func TestRateTableRateAt(t *testing.T) {
+	rt := buildRateTable([]ExchangeRateRow{
+		{Currency: "USD", Rate: 0.8, RateDate: mustParseDate("2021-01-01")},
+		{Currency: "USD", Rate: 0.9, RateDate: mustParseDate("2020-01-01")},
+		{Currency: "GBP", Rate: 1.15},
+	})
+
+	tests := []struct {
+		name     string
+		currency string
+		at       string
+		want     float64
+		wantOK   bool
+	}{
+		{"reporting currency", "EUR", "2020-06-01", 1, true},
+		{"dated rate in effect", "USD", "2020-06-01", 0.9, true},
+		{"latest dated rate", "usd", "2022-06-01", 0.8, true},
+		{"before first dated rate uses oldest", "USD", "2019-06-01", 0.9, true},
+		{"undated rate", "GBP", "2020-06-01", 1.15, true},
+		{"unknown currency", "JPY", "2020-06-01", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rt.rateAt(tt.currency, "EUR", mustParseDate(tt.at))
+			if ok != tt.wantOK {
+				t.Fatalf("ok: got %v, want %v", ok, tt.wantOK)
+			}
+			if !floatEqual(got, tt.want, 0.0001) {
+				t.Errorf("rate: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// -------------------- Tests pour la conversion du CA --------------------
+
+func TestCAAggregatorWithRates(t *testing.T) {
+	latest := map[int]ContentPriceRow{
+		10: {ContentID: 10, Price: mustParseMoney("10.00"), Currency: "EUR"},
+		11: {ContentID: 11, Price: mustParseMoney("10.00"), Currency: "USD"},
+		12: {ContentID: 12, Price: mustParseMoney("10.00"), Currency: "JPY"},
+	}
+	rt := buildRateTable([]ExchangeRateRow{{Currency: "USD", Rate: 0.5}})
+
+	agg := newLatestCAAggregator(latest).withRates(rt, "EUR")
+	for _, e := range []EventRow{
+		{ContentID: 10, CustomerID: 100, Quantity: 1},
+		{ContentID: 11, CustomerID: 100, Quantity: 2},
+		{ContentID: 12, CustomerID: 100, Quantity: 1},
+	} {
+		agg.add(e)
+	}
+	ca := agg.result()
+
+	want := mustParseMoney("20.00") // 10 + 2*10*0.5
+	if ca[100] != want {
+		t.Errorf("customer 100 CA: got %s, want %s", ca[100], want)
+	}
+	if agg.unknownCurrencies["JPY"] != 1 {
+		t.Errorf("expected 1 event with unknown currency JPY, got %d", agg.unknownCurrencies["JPY"])
+	}
+}
+
+func TestCAAggregatorWithoutRates(t *testing.T) {
+	latest := map[int]ContentPriceRow{
+		10: {ContentID: 10, Price: mustParseMoney("10.00"), Currency: "EUR"},
+		11: {ContentID: 11, Price: mustParseMoney("10.00"), Currency: "usd"},
+	}
+	// no rate table: prices in another currency are not summed with the euros
+	agg := newLatestCAAggregator(latest).withRates(buildRateTable(nil), "EUR")
+	for _, e := range []EventRow{
+		{ContentID: 10, CustomerID: 100, Quantity: 2},
+		{ContentID: 11, CustomerID: 100, Quantity: 1},
+		{ContentID: 11, CustomerID: 101, Quantity: 1},
+	} {
+		agg.add(e)
+	}
+	ca := agg.result()
+	if ca[100] != mustParseMoney("20.00") {
+		t.Errorf("customer 100 CA: got %s, want 20.00", ca[100])
+	}
+	if _, ok := ca[101]; ok {
+		t.Errorf("customer 101 has only USD purchases, got CA %s", ca[101])
+	}
+	if agg.unknownCurrencies["usd"] != 2 {
+		t.Errorf("expected 2 events with unknown currency usd, got %v", agg.unknownCurrencies)
+	}
+}
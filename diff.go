@@ -0,0 +1,285 @@
+// diff.go
+//
+// Run-over-run comparison (-mode=diff): two export tables, given by name or
+// as run:<RunID>, are compared on top-quantile membership. Customers who
+// entered, left or stayed in the top quantile are logged and written with
+// their CA and rank change to test_movers_YYYYMMDD for the CRM flows.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// movements of a customer between two runs
+const (
+	moveEntered = "entered" // in the new top quantile only
+	moveLeft    = "left"    // in the old top quantile only
+	moveStayed  = "stayed"  // in both
+)
+
+var tableNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// exportRow is a row of an export table
+type exportRow struct {
+	CustomerID int64
+	Email      string
+	CA         Money
+	Quantile   int
+	Rank       int
+}
+
+// exportSnapshot is the content of an export table
+type exportSnapshot struct {
+	Table string
+	RunID int64 // 0 when the table is empty
+	Rows  map[int64]exportRow
+}
+
+// resolveExportTable maps -diff-old / -diff-new to a table name: either the
+// name itself or run:<RunID>, looked up in quantile_runs
+func resolveExportTable(db *sql.DB, ref string) (table string, runID int64, err error) {
+	if strings.HasPrefix(ref, "run:") {
+		runID, err = strconv.ParseInt(strings.TrimPrefix(ref, "run:"), 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid run reference %q (expected run:<RunID>)", ref)
+		}
+		var t sql.NullString
+		err = db.QueryRow(`SELECT ExportTable FROM `+runsTable+` WHERE RunID = ?`, runID).Scan(&t)
+		if err == sql.ErrNoRows {
+			return "", 0, fmt.Errorf("run %d not found in %s", runID, runsTable)
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		if !t.Valid {
+			return "", 0, fmt.Errorf("run %d has no export table", runID)
+		}
+		ref = t.String
+	}
+	if !tableNameRe.MatchString(ref) {
+		return "", 0, fmt.Errorf("invalid table name %q", ref)
+	}
+	return ref, runID, nil
+}
+
+// loadExportTable reads every row of an export table
+func loadExportTable(db queryer, table string) (*exportSnapshot, error) {
+	log.WithFields(log.Fields{"stage": "LOAD", "table": table}).Info("loading export table")
+	rows, err := db.Query(fmt.Sprintf(`SELECT CustomerID, Email, CA, QuantileIndex, CustomerRank, RunID FROM %s`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snap := &exportSnapshot{Table: table, Rows: make(map[int64]exportRow)}
+	for rows.Next() {
+		var r exportRow
+		var email sql.NullString
+		var runID int64
+		if err := rows.Scan(&r.CustomerID, &email, &r.CA, &r.Quantile, &r.Rank, &runID); err != nil {
+			return nil, err
+		}
+		r.Email = email.String
+		if snap.RunID != 0 && runID != snap.RunID {
+			return nil, fmt.Errorf("%s mixes rows of runs %d and %d", table, snap.RunID, runID)
+		}
+		snap.RunID = runID
+		snap.Rows[r.CustomerID] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"rows": len(snap.Rows), "run_id": snap.RunID}).Info("export table loaded")
+	return snap, nil
+}
+
+// loadDiffSide resolves and loads one side of the comparison; a run
+// reference must still be the content of its table, which the next export
+// of the same day and period replaces
+func loadDiffSide(db *sql.DB, ref string) (*exportSnapshot, error) {
+	table, runID, err := resolveExportTable(db, ref)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := loadExportTable(db, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", table, err)
+	}
+	if runID != 0 && snap.RunID != runID {
+		return nil, fmt.Errorf("%s now holds run %d, not run %d", table, snap.RunID, runID)
+	}
+	return snap, nil
+}
+
+// Mover is a customer of the top quantile of either run; Old or New is nil
+// when the customer is absent from that export table
+type Mover struct {
+	CustomerID int64
+	Email      string
+	Movement   string
+	Old, New   *exportRow
+}
+
+// caChange is New.CA - Old.CA, nil unless the customer is in both tables
+func (m Mover) caChange() interface{} {
+	if m.Old == nil || m.New == nil {
+		return nil
+	}
+	return m.New.CA - m.Old.CA
+}
+
+// rankChange is positive when the customer moved up, nil unless in both tables
+func (m Mover) rankChange() interface{} {
+	if m.Old == nil || m.New == nil {
+		return nil
+	}
+	return m.Old.Rank - m.New.Rank
+}
+
+// diffTop compares the top quantile (QuantileIndex 0) of two exports; the
+// result holds the entered, left then stayed customers, each by rank
+func diffTop(old, cur map[int64]exportRow) []Mover {
+	var out []Mover
+	seen := map[int64]bool{}
+	for id, n := range cur {
+		if n.Quantile != 0 {
+			continue
+		}
+		n := n
+		m := Mover{CustomerID: id, Email: n.Email, Movement: moveEntered, New: &n}
+		if o, ok := old[id]; ok {
+			o := o
+			m.Old = &o
+			if o.Quantile == 0 {
+				m.Movement = moveStayed
+			}
+		}
+		out = append(out, m)
+		seen[id] = true
+	}
+	for id, o := range old {
+		if o.Quantile != 0 || seen[id] {
+			continue
+		}
+		o := o
+		m := Mover{CustomerID: id, Email: o.Email, Movement: moveLeft, Old: &o}
+		if n, ok := cur[id]; ok {
+			n := n
+			m.New = &n
+			m.Email = n.Email
+		}
+		out = append(out, m)
+	}
+
+	order := map[string]int{moveEntered: 0, moveLeft: 1, moveStayed: 2}
+	rank := func(m Mover) int {
+		if m.Movement == moveLeft {
+			return m.Old.Rank
+		}
+		return m.New.Rank
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Movement != out[j].Movement {
+			return order[out[i].Movement] < order[out[j].Movement]
+		}
+		if rank(out[i]) != rank(out[j]) {
+			return rank(out[i]) < rank(out[j])
+		}
+		return out[i].CustomerID < out[j].CustomerID
+	})
+	return out
+}
+
+// runDiff compares -diff-old and -diff-new and exports the movers
+func runDiff(db *sql.DB, run *runRecord, oldRef, newRef string) error {
+	old, err := loadDiffSide(db, oldRef)
+	if err != nil {
+		return err
+	}
+	cur, err := loadDiffSide(db, newRef)
+	if err != nil {
+		return err
+	}
+	movers := diffTop(old.Rows, cur.Rows)
+
+	counts := map[string]int{}
+	for _, m := range movers {
+		counts[m.Movement]++
+	}
+	log.WithFields(log.Fields{
+		"old_table": old.Table,
+		"new_table": cur.Table,
+		"entered":   counts[moveEntered],
+		"left":      counts[moveLeft],
+		"stayed":    counts[moveStayed],
+	}).Info("top quantile comparison")
+	if counts[moveEntered]+counts[moveLeft] > 0 && log.IsLevelEnabled(log.DebugLevel) {
+		for _, m := range movers {
+			if m.Movement != moveStayed {
+				log.WithFields(log.Fields{"customer_id": m.CustomerID, "movement": m.Movement, "ca_change": m.caChange(), "rank_change": m.rankChange()}).Debug("mover")
+			}
+		}
+	}
+	run.NbCustomers = len(movers)
+
+	tableName := fmt.Sprintf("test_movers_%s", time.Now().Format("20060102"))
+	err = replaceTable(db, tableName, func(staging string) error {
+		if err := ensureMoversTable(db, staging); err != nil {
+			return err
+		}
+		if len(movers) == 0 {
+			return nil
+		}
+		log.WithFields(log.Fields{"stage": "EXPORT", "table": staging, "count": len(movers)}).Info("exporting movers (batch)")
+		columns := []string{"CustomerID", "Email", "Movement", "OldCA", "NewCA", "CAChange", "OldRank", "NewRank", "RankChange",
+			"OldQuantileIndex", "NewQuantileIndex", "OldTable", "NewTable", "RunID"}
+		return insertRows(db, staging, columns, len(movers), func(i int) []interface{} {
+			m := movers[i]
+			var oldCA, newCA, oldRank, newRank, oldQ, newQ interface{}
+			if m.Old != nil {
+				oldCA, oldRank, oldQ = m.Old.CA, m.Old.Rank, m.Old.Quantile
+			}
+			if m.New != nil {
+				newCA, newRank, newQ = m.New.CA, m.New.Rank, m.New.Quantile
+			}
+			return []interface{}{m.CustomerID, m.Email, m.Movement, oldCA, newCA, m.caChange(), oldRank, newRank, m.rankChange(),
+				oldQ, newQ, old.Table, cur.Table, run.ID}
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export movers: %w", err)
+	}
+	run.ExportTable = tableName
+	return nil
+}
+
+func ensureMoversTable(db *sql.DB, tableName string) error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	CustomerID BIGINT NOT NULL PRIMARY KEY,
+	Email VARCHAR(255),
+	Movement VARCHAR(16) NOT NULL,
+	OldCA DECIMAL(18,2) NULL,
+	NewCA DECIMAL(18,2) NULL,
+	CAChange DECIMAL(18,2) NULL,
+	OldRank INT NULL,
+	NewRank INT NULL,
+	RankChange INT NULL,
+	OldQuantileIndex INT NULL,
+	NewQuantileIndex INT NULL,
+	OldTable VARCHAR(64) NOT NULL,
+	NewTable VARCHAR(64) NOT NULL,
+	RunID BIGINT NOT NULL,
+	KEY (Movement)
+) ENGINE=InnoDB;`, tableName)
+	_, err := db.Exec(q)
+	return err
+}
@@ -0,0 +1,59 @@
+// diff_test.go
+package main
+
+import "testing"
+
+// -------------------- Tests pour diffTop --------------------
+
+func TestDiffTop(t *testing.T) {
+	// old export (-export=all): 1 and 2 in the top quantile, 3 below
+	old := map[int64]exportRow{
+		1: {CustomerID: 1, CA: 50000, Quantile: 0, Rank: 1},
+		2: {CustomerID: 2, CA: 40000, Quantile: 0, Rank: 2},
+		3: {CustomerID: 3, CA: 10000, Quantile: 1, Rank: 3},
+	}
+	// new export (-export=top): 3 and 1 in the top quantile, 4 is new
+	cur := map[int64]exportRow{
+		3: {CustomerID: 3, Email: "c@x.com", CA: 60000, Quantile: 0, Rank: 1},
+		1: {CustomerID: 1, CA: 45000, Quantile: 0, Rank: 3},
+		4: {CustomerID: 4, CA: 55000, Quantile: 0, Rank: 2},
+	}
+	movers := diffTop(old, cur)
+
+	want := []struct {
+		id       int64
+		movement string
+		ca       interface{}
+		rank     interface{}
+	}{
+		{3, moveEntered, Money(50000), 2},
+		{4, moveEntered, nil, nil},
+		{2, moveLeft, nil, nil},
+		{1, moveStayed, Money(-5000), -2},
+	}
+	if len(movers) != len(want) {
+		t.Fatalf("expected %d movers, got %d: %+v", len(want), len(movers), movers)
+	}
+	for i, w := range want {
+		m := movers[i]
+		if m.CustomerID != w.id || m.Movement != w.movement || m.caChange() != w.ca || m.rankChange() != w.rank {
+			t.Errorf("mover %d: got %d %s %v %v, want %+v", i, m.CustomerID, m.Movement, m.caChange(), m.rankChange(), w)
+		}
+	}
+	if movers[0].Email != "c@x.com" || movers[0].Old.Quantile != 1 {
+		t.Errorf("customer 3 must carry its new email and old quantile, got %+v", movers[0])
+	}
+}
+
+// -------------------- Tests pour resolveExportTable --------------------
+
+func TestResolveExportTable(t *testing.T) {
+	if table, runID, err := resolveExportTable(nil, "test_export_20251004"); err != nil || table != "test_export_20251004" || runID != 0 {
+		t.Errorf("got %s, %d, %v", table, runID, err)
+	}
+	for _, ref := range []string{"test_export; DROP TABLE x", "", "run:abc", "run:"} {
+		if _, _, err := resolveExportTable(nil, ref); err == nil {
+			t.Errorf("%q: expected error", ref)
+		}
+	}
+}
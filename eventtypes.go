@@ -0,0 +1,94 @@
+// eventtypes.go
+//
+// Event types counted in the CA: purchases add Quantity × Price, refunds and
+// cancellations subtract it, so the CA of a customer is their net revenue.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// eventTypes lists the EventTypeID values read from CustomerEventData
+type eventTypes struct {
+	Purchase []int
+	Refund   []int
+}
+
+// defaultEventTypes is the historical behaviour: purchases (6) only
+var defaultEventTypes = eventTypes{Purchase: []int{6}}
+
+// parseEventTypes reads -purchase-types and -refund-types: comma-separated
+// ids, at least one purchase type, no id in both lists
+func parseEventTypes(purchase, refund string) (eventTypes, error) {
+	var et eventTypes
+	var err error
+	if et.Purchase, err = parseTypeList(purchase); err != nil {
+		return et, fmt.Errorf("invalid -purchase-types: %w", err)
+	}
+	if len(et.Purchase) == 0 {
+		return et, fmt.Errorf("-purchase-types must list at least one event type")
+	}
+	if et.Refund, err = parseTypeList(refund); err != nil {
+		return et, fmt.Errorf("invalid -refund-types: %w", err)
+	}
+	for _, r := range et.Refund {
+		if et.sign(r) > 0 {
+			return et, fmt.Errorf("event type %d is both a purchase and a refund type", r)
+		}
+	}
+	return et, nil
+}
+
+func parseTypeList(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var out []int
+	seen := map[int]bool{}
+	for _, f := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid event type %q", f)
+		}
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// all returns every type to load, sorted
+func (et eventTypes) all() []int {
+	out := append(append([]int(nil), et.Purchase...), et.Refund...)
+	sort.Ints(out)
+	return out
+}
+
+// sign is +1 for a purchase type, -1 for a refund type and 0 otherwise
+func (et eventTypes) sign(typeID int) int {
+	for _, t := range et.Purchase {
+		if t == typeID {
+			return 1
+		}
+	}
+	for _, t := range et.Refund {
+		if t == typeID {
+			return -1
+		}
+	}
+	return 0
+}
+
+func joinTypes(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
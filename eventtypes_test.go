@@ -0,0 +1,91 @@
+// eventtypes_test.go
+package main
+
+import "testing"
+
+// -------------------- Tests pour parseEventTypes --------------------
+
+func TestParseEventTypes(t *testing.T) {
+	t.Run("purchase and refund types", func(t *testing.T) {
+		et, err := parseEventTypes("6", " 8,7,7 ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if joinTypes(et.Refund) != "7,8" || joinTypes(et.all()) != "6,7,8" {
+			t.Errorf("unexpected types %+v", et)
+		}
+		if et.sign(6) != 1 || et.sign(7) != -1 || et.sign(5) != 0 {
+			t.Errorf("unexpected signs %d %d %d", et.sign(6), et.sign(7), et.sign(5))
+		}
+	})
+
+	errCases := map[string][2]string{
+		"no purchase type":  {"", "7"},
+		"invalid purchase":  {"six", ""},
+		"invalid refund":    {"6", "7,x"},
+		"type in both sets": {"6,7", "7"},
+	}
+	for name, in := range errCases {
+		if _, err := parseEventTypes(in[0], in[1]); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// -------------------- Tests pour le CA net --------------------
+
+func TestCAAggregatorRefunds(t *testing.T) {
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7, 8}}
+
+	t.Run("refunds subtract at the purchase price", func(t *testing.T) {
+		agg := newCAAggregator(map[int]Money{10: mustParseMoney("9.99"), 11: mustParseMoney("5.00")}).withEventTypes(et)
+		for _, e := range []EventRow{
+			{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 3},
+			{ContentID: 10, CustomerID: 100, EventTypeID: 7, Quantity: 2},
+			{ContentID: 11, CustomerID: 100, EventTypeID: 8, Quantity: -1}, // negative quantity in the log
+			{ContentID: 11, CustomerID: 101, EventTypeID: 6, Quantity: 1},
+		} {
+			agg.add(e)
+		}
+		ca := agg.result()
+
+		if want := mustParseMoney("4.99"); ca[100] != want { // 3*9.99 - 2*9.99 - 5.00
+			t.Errorf("customer 100 CA: got %s, want %s", ca[100], want)
+		}
+		if want := mustParseMoney("5.00"); ca[101] != want {
+			t.Errorf("customer 101 CA: got %s, want %s", ca[101], want)
+		}
+		if agg.nbRefunds != 2 || agg.refunded != mustParseMoney("24.98") {
+			t.Errorf("expected 2 refunds of 24.98, got %d of %s", agg.nbRefunds, agg.refunded)
+		}
+	})
+
+	t.Run("refunds use the as-of-event price", func(t *testing.T) {
+		d := mustParseDate
+		idx := buildPriceIndex([]ContentPriceRow{
+			{ContentID: 10, Price: mustParseMoney("10.00"), InsertDate: d("2020-01-01")},
+			{ContentID: 10, Price: mustParseMoney("20.00"), InsertDate: d("2021-01-01")},
+		})
+		agg := newAsOfCAAggregator(idx).withEventTypes(et)
+		agg.add(EventRow{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 1, EventDate: d("2021-06-01")})
+		agg.add(EventRow{ContentID: 10, CustomerID: 100, EventTypeID: 7, Quantity: 1, EventDate: d("2020-06-01")})
+		agg.add(EventRow{ContentID: 10, CustomerID: 100, EventTypeID: 7, Quantity: 1, EventDate: d("2019-06-01")})
+
+		if got := agg.result()[100]; got != mustParseMoney("10.00") {
+			t.Errorf("customer 100 CA: got %s, want 10.00", got)
+		}
+		if agg.predatingPrices[10] != 1 {
+			t.Errorf("expected the refund predating any price to be skipped, got %d", agg.predatingPrices[10])
+		}
+	})
+
+	t.Run("net negative customers rank last", func(t *testing.T) {
+		agg := newCAAggregator(map[int]Money{10: mustParseMoney("10.00")}).withEventTypes(et)
+		agg.add(EventRow{ContentID: 10, CustomerID: 100, EventTypeID: 7, Quantity: 1})
+		agg.add(EventRow{ContentID: 10, CustomerID: 101, EventTypeID: 6, Quantity: 1})
+		sorted := mapToSortedSlice(agg.result(), nil)
+		if sorted[0].CustomerID != 101 || sorted[1].CA != mustParseMoney("-10.00") {
+			t.Errorf("unexpected order %+v", sorted)
+		}
+	})
+}
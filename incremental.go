@@ -0,0 +1,404 @@
+// incremental.go
+//
+// Incremental CA (-incremental): the per-customer totals are kept in MySQL
+// state tables with the (InsertDate, EventDataID) watermark of the last event
+// applied. A run loads only the events after the watermark, merges their totals
+// into the state and moves the watermark in one transaction, then ranks the
+// customers from the whole state.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	stateTable         = "ca_state"          // running totals per customer
+	stateProductsTable = "ca_state_products" // distinct (customer, content) pairs
+	stateDaysTable     = "ca_state_days"     // distinct (customer, day) pairs
+	stateMetaTable     = "ca_state_meta"     // parameters and watermark, one row
+)
+
+// watermark is the position of the last event applied to the state. Events
+// are ordered by InsertDate, then by EventDataID: an event inserted in the
+// same second as the watermark but committed after the run is still loaded
+// by the next one, as long as its id is higher.
+type watermark struct {
+	InsertDate  time.Time
+	EventDataID int64
+}
+
+// IsZero reports an empty state: every event is loaded
+func (w watermark) IsZero() bool {
+	return w.InsertDate.IsZero()
+}
+
+// before reports whether w comes before o
+func (w watermark) before(o watermark) bool {
+	return w.InsertDate.Before(o.InsertDate) || w.InsertDate.Equal(o.InsertDate) && w.EventDataID < o.EventDataID
+}
+
+// precedes reports whether e comes after the watermark
+func (w watermark) precedes(e EventRow) bool {
+	return w.before(watermark{InsertDate: e.InsertDate, EventDataID: e.EventDataID})
+}
+
+func (w watermark) String() string {
+	return fmt.Sprintf("%s/%d", w.InsertDate.Format(time.RFC3339Nano), w.EventDataID)
+}
+
+// caState is the persisted aggregation of the incremental runs
+type caState struct {
+	Params    string    // parameters the totals were computed with
+	Watermark watermark // last event applied, zero when empty
+	Rebuild   bool      // the state is recomputed from every event
+}
+
+// stateParams identifies what the totals depend on: a state is only
+// extended by runs with the same parameters
+func stateParams(p period, pricing, currency string, et eventTypes) string {
+	return fmt.Sprintf("since=%s pricing=%s currency=%s purchase=%s refund=%s",
+		p.Since.Format("2006-01-02"), pricing, currency, joinTypes(et.Purchase), joinTypes(et.Refund))
+}
+
+func ensureStateTables(db *sql.DB) error {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS ` + stateTable + ` (
+	CustomerID BIGINT NOT NULL PRIMARY KEY,
+	CA DECIMAL(18,2) NOT NULL,
+	Purchases INT NOT NULL,
+	DistinctProducts INT NOT NULL,
+	Quantity INT NOT NULL,
+	ActiveDays INT NOT NULL,
+	LastPurchase DATETIME(6) NULL
+) ENGINE=InnoDB;`,
+		`CREATE TABLE IF NOT EXISTS ` + stateProductsTable + ` (
+	CustomerID BIGINT NOT NULL,
+	ContentID INT NOT NULL,
+	PRIMARY KEY (CustomerID, ContentID)
+) ENGINE=InnoDB;`,
+		`CREATE TABLE IF NOT EXISTS ` + stateDaysTable + ` (
+	CustomerID BIGINT NOT NULL,
+	Day INT NOT NULL,
+	PRIMARY KEY (CustomerID, Day)
+) ENGINE=InnoDB;`,
+		`CREATE TABLE IF NOT EXISTS ` + stateMetaTable + ` (
+	ID TINYINT NOT NULL PRIMARY KEY,
+	Params VARCHAR(255) NOT NULL,
+	Watermark DATETIME(6) NULL,
+	WatermarkID BIGINT NOT NULL DEFAULT 0,
+	RunID BIGINT NOT NULL,
+	UpdatedAt DATETIME(6) NOT NULL
+) ENGINE=InnoDB;`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return migrateTable(db, stateMetaTable, stateMetaMigrations)
+}
+
+// stateMetaMigrations lists the columns added to ca_state_meta after its
+// first version. A state written before WatermarkID had applied every event
+// of the watermark's InsertDate, hence the largest id as default.
+var stateMetaMigrations = []columnMigration{
+	{2, "WatermarkID", "BIGINT NOT NULL DEFAULT 9223372036854775807"},
+}
+
+// openState reads the watermark of the state built with params. An empty
+// state or rebuild loads every event; a state built with other parameters
+// is an error unless rebuild.
+func openState(db *sql.DB, params string, rebuild bool) (*caState, error) {
+	if err := ensureStateTables(db); err != nil {
+		return nil, err
+	}
+	st := &caState{Params: params, Rebuild: rebuild}
+	var stored string
+	var wm sql.NullTime
+	var wmID int64
+	err := db.QueryRow(`SELECT Params, Watermark, WatermarkID FROM `+stateMetaTable+` WHERE ID = 1`).Scan(&stored, &wm, &wmID)
+	switch {
+	case err == sql.ErrNoRows:
+		st.Rebuild = true
+	case err != nil:
+		return nil, err
+	case rebuild:
+	case stored != params:
+		return nil, fmt.Errorf("the CA state was built with %q, not %q; run with -rebuild to recompute it", stored, params)
+	default:
+		st.Watermark = watermark{InsertDate: wm.Time, EventDataID: wmID}
+	}
+	fields := log.Fields{"stage": "LOAD", "table": stateTable, "rebuild": st.Rebuild}
+	if !st.Watermark.IsZero() {
+		fields["watermark"] = st.Watermark.String()
+	}
+	log.WithFields(fields).Info("CA state opened")
+	return st, nil
+}
+
+// stateRow is a customer of the state with its distinct products and days
+type stateRow struct {
+	CustomerCA
+	products map[int]struct{}
+	days     map[int64]struct{}
+}
+
+func newStateRow(cid int64) *stateRow {
+	return &stateRow{CustomerCA: CustomerCA{CustomerID: cid}, products: map[int]struct{}{}, days: map[int64]struct{}{}}
+}
+
+// merge adds the CA and metrics of the new events of the customer to the
+// row and returns the products and days it did not hold yet
+func (r *stateRow) merge(ca Money, m *Metrics, products map[int]struct{}, days map[int64]struct{}) (newProducts []int, newDays []int64) {
+	r.CA += ca
+	if m != nil {
+		r.Purchases += m.Purchases
+		r.Quantity += m.Quantity
+		if m.LastPurchase.After(r.LastPurchase) {
+			r.LastPurchase = m.LastPurchase
+		}
+	}
+	for p := range products {
+		if _, ok := r.products[p]; !ok {
+			r.products[p] = struct{}{}
+			newProducts = append(newProducts, p)
+		}
+	}
+	for d := range days {
+		if _, ok := r.days[d]; !ok {
+			r.days[d] = struct{}{}
+			newDays = append(newDays, d)
+		}
+	}
+	r.Products, r.ActiveDays = len(r.products), len(r.days)
+	return newProducts, newDays
+}
+
+// apply merges the CA and metrics aggregated from the new events into the
+// state and stores the new watermark, in one transaction: a failed run
+// leaves the state and watermark as they were
+func (st *caState) apply(db *sql.DB, agg *caAggregator, runID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// the meta row stays locked until commit: a concurrent run waits, then
+	// finds the watermark moved and fails instead of applying its events twice
+	var current sql.NullTime
+	var currentID int64
+	err = tx.QueryRow(`SELECT Watermark, WatermarkID FROM `+stateMetaTable+` WHERE ID = 1 FOR UPDATE`).Scan(&current, &currentID)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	cur := watermark{InsertDate: current.Time, EventDataID: currentID}
+	if err == nil && !st.Rebuild && (cur.before(st.Watermark) || st.Watermark.before(cur)) {
+		tx.Rollback()
+		return fmt.Errorf("the CA state was updated by another run (watermark %s)", cur)
+	}
+	if err := st.merge(tx, agg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	wm := st.Watermark
+	if wm.before(agg.last) {
+		wm = agg.last
+	}
+	var wmDate interface{}
+	if !wm.IsZero() {
+		wmDate = wm.InsertDate
+	}
+	_, err = tx.Exec(`INSERT INTO `+stateMetaTable+` (ID, Params, Watermark, WatermarkID, RunID, UpdatedAt) VALUES (1, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE Params=VALUES(Params), Watermark=VALUES(Watermark), WatermarkID=VALUES(WatermarkID), RunID=VALUES(RunID), UpdatedAt=VALUES(UpdatedAt)`,
+		st.Params, wmDate, wm.EventDataID, runID, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"stage": "COMPUTE", "customers_updated": len(agg.ca), "watermark": wm.String()}).Info("CA state updated")
+	st.Watermark = wm
+	warnSkippedEvents(agg, wm)
+	return nil
+}
+
+// warnSkippedEvents logs the events of the run that could not be valued:
+// they are not in the state, and the watermark moved past them, so no later
+// incremental run loads them again; only -rebuild applies them
+func warnSkippedEvents(agg *caAggregator, wm watermark) {
+	missing, predating, unknown := agg.skipped()
+	if missing+predating+unknown == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"stage":                    "COMPUTE",
+		"skipped_missing_price":    missing,
+		"skipped_predating_price":  predating,
+		"skipped_unknown_currency": unknown,
+		"watermark":                wm.String(),
+	}).Warn("events skipped by this incremental run will not be reloaded; run -rebuild once their prices or exchange rates are available")
+}
+
+func (st *caState) merge(tx *sql.Tx, agg *caAggregator) error {
+	if st.Rebuild {
+		for _, t := range []string{stateTable, stateProductsTable, stateDaysTable} {
+			if _, err := tx.Exec(`DELETE FROM ` + t); err != nil {
+				return err
+			}
+		}
+	}
+	ids := make([]int64, 0, len(agg.ca))
+	for cid := range agg.ca {
+		ids = append(ids, cid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+		rows, err := loadStateRows(tx, batch)
+		if err != nil {
+			return err
+		}
+		var newProducts, newDays []interface{}
+		stateArgs := make([]interface{}, 0, len(batch)*7)
+		for _, cid := range batch {
+			r := rows[cid]
+			if r == nil {
+				r = newStateRow(cid)
+			}
+			products, days := r.merge(agg.ca[cid], agg.metrics.counts[cid], agg.metrics.products[cid], agg.metrics.days[cid])
+			for _, p := range products {
+				newProducts = append(newProducts, cid, p)
+			}
+			for _, d := range days {
+				newDays = append(newDays, cid, d)
+			}
+			var last interface{}
+			if !r.LastPurchase.IsZero() {
+				last = r.LastPurchase
+			}
+			stateArgs = append(stateArgs, cid, r.CA, r.Purchases, r.Products, r.Quantity, r.ActiveDays, last)
+		}
+		stmts := []struct {
+			table   string
+			columns []string
+			args    []interface{}
+		}{
+			{stateTable, []string{"CustomerID", "CA", "Purchases", "DistinctProducts", "Quantity", "ActiveDays", "LastPurchase"}, stateArgs},
+			{stateProductsTable, []string{"CustomerID", "ContentID"}, newProducts},
+			{stateDaysTable, []string{"CustomerID", "Day"}, newDays},
+		}
+		for _, s := range stmts {
+			if len(s.args) == 0 {
+				continue
+			}
+			if _, err := tx.Exec(upsertStatement(s.table, s.columns, len(s.args)/len(s.columns)), s.args...); err != nil {
+				return fmt.Errorf("%s: %w", s.table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadStateRows reads the state of the given customers, locking their rows
+// until the end of the transaction
+func loadStateRows(tx *sql.Tx, ids []int64) (map[int64]*stateRow, error) {
+	in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	out := make(map[int64]*stateRow, len(ids))
+
+	rows, err := tx.Query(`SELECT CustomerID, CA, Purchases, DistinctProducts, Quantity, ActiveDays, LastPurchase
+		FROM `+stateTable+` WHERE CustomerID IN `+in+` FOR UPDATE`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		r := newStateRow(0)
+		var last sql.NullTime
+		if err := rows.Scan(&r.CustomerID, &r.CA, &r.Purchases, &r.Products, &r.Quantity, &r.ActiveDays, &last); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.LastPurchase = last.Time
+		out[r.CustomerID] = r
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, set := range []struct {
+		table, column string
+		add           func(r *stateRow, v int64)
+	}{
+		{stateProductsTable, "ContentID", func(r *stateRow, v int64) { r.products[int(v)] = struct{}{} }},
+		{stateDaysTable, "Day", func(r *stateRow, v int64) { r.days[v] = struct{}{} }},
+	} {
+		rows, err := tx.Query(`SELECT CustomerID, `+set.column+` FROM `+set.table+` WHERE CustomerID IN `+in, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var cid, v int64
+			if err := rows.Scan(&cid, &v); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if r := out[cid]; r != nil {
+				set.add(r, v)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// loadState replaces the CA and metrics of agg with the whole state, so the
+// rest of the pipeline ranks every customer; the distinct sets stay in MySQL
+func loadState(db *sql.DB, agg *caAggregator) error {
+	log.WithFields(log.Fields{"stage": "LOAD", "table": stateTable}).Info("loading CA state")
+	rows, err := db.Query(`SELECT CustomerID, CA, Purchases, DistinctProducts, Quantity, ActiveDays, LastPurchase FROM ` + stateTable)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ca := make(map[int64]Money)
+	t := newMetricsTracker()
+	for rows.Next() {
+		var cid int64
+		var amount Money
+		var m Metrics
+		var last sql.NullTime
+		if err := rows.Scan(&cid, &amount, &m.Purchases, &m.Products, &m.Quantity, &m.ActiveDays, &last); err != nil {
+			return err
+		}
+		m.LastPurchase = last.Time
+		ca[cid] = amount
+		t.counts[cid] = &m
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	agg.ca, agg.metrics = ca, t
+	log.WithField("customers", len(ca)).Info("CA state loaded")
+	return nil
+}
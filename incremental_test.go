@@ -0,0 +1,142 @@
+// incremental_test.go
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// -------------------- Tests pour stateParams --------------------
+
+func TestStateParams(t *testing.T) {
+	p := period{Since: mustParseDate("2020-04-01")}
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7, 8}}
+	got := stateParams(p, pricingLatest, "EUR", et)
+	if want := "since=2020-04-01 pricing=latest currency=EUR purchase=6 refund=7,8"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// the watermark is not part of the parameters
+	p.InsertedAfter = watermark{InsertDate: time.Now(), EventDataID: 9}
+	if stateParams(p, pricingLatest, "EUR", et) != got {
+		t.Error("InsertedAfter changed the state parameters")
+	}
+	if stateParams(p, pricingAsOfEvent, "EUR", et) == got {
+		t.Error("pricing is not part of the state parameters")
+	}
+}
+
+// -------------------- Tests pour stateRow.merge --------------------
+
+func TestStateRowMerge(t *testing.T) {
+	// state of a previous run: 2 purchases of content 10 on one day
+	r := newStateRow(42)
+	r.merge(mustParseMoney("20.00"), &Metrics{Purchases: 2, Quantity: 2, LastPurchase: mustParseDate("2021-01-05")},
+		map[int]struct{}{10: {}}, map[int64]struct{}{18632: {}})
+
+	// new events: content 10 again and 11, on the same day and a new one
+	products, days := r.merge(mustParseMoney("7.50"), &Metrics{Purchases: 2, Quantity: 3, LastPurchase: mustParseDate("2021-02-01")},
+		map[int]struct{}{10: {}, 11: {}}, map[int64]struct{}{18632: {}, 18659: {}})
+
+	if r.CA != mustParseMoney("27.50") || r.Purchases != 4 || r.Quantity != 5 {
+		t.Errorf("totals: got CA %s, %d purchases, quantity %d", r.CA, r.Purchases, r.Quantity)
+	}
+	if r.Products != 2 || r.ActiveDays != 2 || !r.LastPurchase.Equal(mustParseDate("2021-02-01")) {
+		t.Errorf("metrics: got %+v", r.Metrics)
+	}
+	if len(products) != 1 || products[0] != 11 || len(days) != 1 || days[0] != 18659 {
+		t.Errorf("new pairs: got products %v, days %v", products, days)
+	}
+
+	// a refund only lowers the CA and keeps the last purchase
+	r.merge(mustParseMoney("-5.00"), &Metrics{Quantity: -1}, nil, nil)
+	if r.CA != mustParseMoney("22.50") || r.Quantity != 4 || !r.LastPurchase.Equal(mustParseDate("2021-02-01")) {
+		t.Errorf("after refund: got %+v", r.CustomerCA)
+	}
+}
+
+// -------------------- Tests pour le filtre InsertedAfter --------------------
+
+func TestInsertedAfter(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "CustomerEventData.csv", `EventDataID,EventID,ContentID,CustomerID,EventTypeID,EventDate,Quantity,InsertDate
+1,1,10,100,6,2020-04-02 10:00:00,1,2020-04-02 10:00:00
+2,2,10,101,6,2020-04-03 10:00:00,1,2020-04-05 12:00:00
+3,3,10,102,6,2020-04-01 10:00:00,1,2020-04-06 08:00:00
+4,4,10,103,6,2020-04-03 10:00:00,1,2020-04-05 12:00:00
+`)
+	writeTestFile(t, dir, "ContentPrice.csv", "ContentPriceID,ContentID,Price,Currency,InsertDate\n1,10,9.99,EUR,2020-01-01 00:00:00\n")
+	writeTestFile(t, dir, "CustomerData.csv", "CustomerChannelID,CustomerID,ChannelTypeID,ChannelValue,InsertDate\n")
+	src, err := newFileSource(sourceCSV, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	agg := newCAAggregator(map[int]Money{10: mustParseMoney("9.99")})
+	wm := watermark{InsertDate: time.Date(2020, 4, 5, 12, 0, 0, 0, time.UTC), EventDataID: 2}
+	p := period{Since: mustParseDate("2020-04-01"), InsertedAfter: wm}
+	caMap, err := streamCA(context.Background(), src, p, defaultEventTypes, agg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// event 2 is the watermark: it was applied by the previous run; event 4,
+	// inserted in the same second but committed after it, is not
+	if len(caMap) != 2 || caMap[102] != mustParseMoney("9.99") || caMap[103] != mustParseMoney("9.99") {
+		t.Errorf("got %v, want customers 102 and 103", caMap)
+	}
+	if want := time.Date(2020, 4, 6, 8, 0, 0, 0, time.UTC); !agg.last.InsertDate.Equal(want) || agg.last.EventDataID != 3 {
+		t.Errorf("last: got %s, want %s/3", agg.last, want.Format(time.RFC3339Nano))
+	}
+}
+
+// -------------------- Tests pour warnSkippedEvents --------------------
+
+func TestWarnSkippedEvents(t *testing.T) {
+	hook := test.NewLocal(log.StandardLogger())
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	wm := watermark{InsertDate: time.Date(2020, 4, 6, 8, 0, 0, 0, time.UTC), EventDataID: 1}
+
+	agg := newCAAggregator(map[int]Money{10: mustParseMoney("9.99")})
+	agg.add(EventRow{EventDataID: 1, CustomerID: 1, ContentID: 10, Quantity: 1, InsertDate: wm.InsertDate})
+	warnSkippedEvents(agg, wm)
+	if len(hook.Entries) != 0 {
+		t.Errorf("warned without skipped events: %v", hook.AllEntries())
+	}
+
+	// an unpriced event inserted before the new watermark is lost to later runs
+	agg.add(EventRow{EventDataID: 2, CustomerID: 2, ContentID: 99, Quantity: 1, InsertDate: wm.InsertDate.Add(-time.Hour)})
+	warnSkippedEvents(agg, wm)
+	e := hook.LastEntry()
+	if e == nil || e.Level != log.WarnLevel || e.Data["skipped_missing_price"] != 1 {
+		t.Errorf("expected a warning with 1 missing price, got %+v", e)
+	}
+}
+
+// -------------------- Tests pour watermark --------------------
+
+func TestWatermarkOrder(t *testing.T) {
+	at := time.Date(2020, 4, 5, 12, 0, 0, 0, time.UTC)
+	wm := watermark{InsertDate: at, EventDataID: 10}
+	tests := []struct {
+		e    EventRow
+		want bool
+	}{
+		{EventRow{EventDataID: 5, InsertDate: at.Add(time.Second)}, true},
+		{EventRow{EventDataID: 11, InsertDate: at}, true},
+		{EventRow{EventDataID: 10, InsertDate: at}, false},
+		{EventRow{EventDataID: 9, InsertDate: at}, false},
+		{EventRow{EventDataID: 50, InsertDate: at.Add(-time.Second)}, false},
+	}
+	for _, tt := range tests {
+		if got := wm.precedes(tt.e); got != tt.want {
+			t.Errorf("event %d at %s: got %v, want %v", tt.e.EventDataID, tt.e.InsertDate, got, tt.want)
+		}
+	}
+	if !(watermark{}).precedes(EventRow{EventDataID: 1, InsertDate: at}) {
+		t.Error("an empty watermark should load every event")
+	}
+}
@@ -0,0 +1,100 @@
+// load.go
+//
+// Concurrent LOAD: the loaders of ContentPrice, CustomerData and
+// CustomerEventData run in their own goroutines; the first failure cancels
+// the context shared by the others, and each loader's duration and row count
+// are logged along with the wall-clock time of the whole stage.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loaderTiming is the outcome of a successful loader
+type loaderTiming struct {
+	Name     string
+	Rows     int
+	Duration time.Duration
+}
+
+// loadGroup runs loaders concurrently with shared cancellation
+type loadGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	start  time.Time
+	// sequential is set when the loaders take turns on a single connection
+	// (MySQL shared snapshot): only their processing overlaps, not the queries
+	sequential bool
+
+	mu      sync.Mutex
+	err     error // first failure
+	timings []loaderTiming
+}
+
+func newLoadGroup(parent context.Context) *loadGroup {
+	ctx, cancel := context.WithCancel(parent)
+	return &loadGroup{ctx: ctx, cancel: cancel, start: time.Now()}
+}
+
+// Go starts fn; fn returns the number of rows it loaded. A loader failing
+// after another one has been canceled is reported as canceled only.
+func (g *loadGroup) Go(name string, fn func(ctx context.Context) (rows int, err error)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		t0 := time.Now()
+		rows, err := fn(g.ctx)
+		d := time.Since(t0)
+		fields := log.Fields{"stage": "LOAD", "loader": name, "rows": rows, "duration": d.String()}
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		switch {
+		case err == nil:
+			g.timings = append(g.timings, loaderTiming{Name: name, Rows: rows, Duration: d})
+			log.WithFields(fields).Info("loader finished")
+		case g.err != nil && errors.Is(err, context.Canceled):
+			log.WithFields(fields).Info("loader canceled")
+		default:
+			if g.err == nil {
+				g.err = err
+				g.cancel()
+			}
+			log.WithFields(fields).WithError(err).Warn("loader failed")
+		}
+	}()
+}
+
+// queries tells how the queries of the loaders ran, for the logs
+func (g *loadGroup) queries() string {
+	if g.sequential {
+		return "sequential"
+	}
+	return "concurrent"
+}
+
+// Wait blocks until every loader returned and gives the first failure
+func (g *loadGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	var sum time.Duration
+	for _, t := range g.timings {
+		sum += t.Duration
+	}
+	log.WithFields(log.Fields{
+		"stage":         "LOAD",
+		"loaders":       len(g.timings),
+		"queries":       g.queries(),
+		"wall_clock":    time.Since(g.start).String(),
+		"loaders_total": sum.String(),
+		"failed":        g.err != nil,
+	}).Info("LOAD stage finished")
+	return g.err
+}
@@ -0,0 +1,98 @@
+// load_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// -------------------- Tests pour loadGroup --------------------
+
+func TestLoadGroup(t *testing.T) {
+	t.Run("all loaders succeed", func(t *testing.T) {
+		g := newLoadGroup(context.Background())
+		g.Go("a", func(ctx context.Context) (int, error) { return 3, nil })
+		g.Go("b", func(ctx context.Context) (int, error) { return 5, nil })
+		if err := g.Wait(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rows := map[string]int{}
+		for _, tm := range g.timings {
+			rows[tm.Name] = tm.Rows
+		}
+		if len(rows) != 2 || rows["a"] != 3 || rows["b"] != 5 {
+			t.Errorf("unexpected timings %+v", g.timings)
+		}
+	})
+
+	t.Run("sequential queries are logged", func(t *testing.T) {
+		hook := test.NewLocal(log.StandardLogger())
+		defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+		for _, sequential := range []bool{true, false} {
+			g := newLoadGroup(context.Background())
+			g.sequential = sequential
+			g.Go("a", func(ctx context.Context) (int, error) { return 1, nil })
+			if err := g.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			want := "concurrent"
+			if sequential {
+				want = "sequential"
+			}
+			if e := hook.LastEntry(); e == nil || e.Message != "LOAD stage finished" || e.Data["queries"] != want {
+				t.Errorf("sequential=%v: got %+v, want queries=%s", sequential, e, want)
+			}
+		}
+	})
+
+	t.Run("first failure cancels the others", func(t *testing.T) {
+		boom := errors.New("boom")
+		g := newLoadGroup(context.Background())
+		g.Go("slow", func(ctx context.Context) (int, error) {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(5 * time.Second):
+				return 1, nil
+			}
+		})
+		g.Go("failing", func(ctx context.Context) (int, error) { return 0, boom })
+		begin := time.Now()
+		if err := g.Wait(); !errors.Is(err, boom) {
+			t.Fatalf("got %v, want %v", err, boom)
+		}
+		if time.Since(begin) > 2*time.Second {
+			t.Error("slow loader was not canceled")
+		}
+		if len(g.timings) != 0 {
+			t.Errorf("no loader should have succeeded, got %+v", g.timings)
+		}
+	})
+}
+
+// -------------------- Tests pour fileSource cancellation --------------------
+
+func TestFileSourceCanceled(t *testing.T) {
+	dir := t.TempDir()
+	content := "EventDataID,EventID,ContentID,CustomerID,EventTypeID,EventDate,Quantity,InsertDate\n"
+	for i := 1; i <= 2000; i++ {
+		content += fmt.Sprintf("%d,%d,10,100,6,2020-05-01 10:00:00,1,2020-05-01 10:00:00\n", i, i)
+	}
+	writeTestFile(t, dir, "CustomerEventData.csv", content)
+	src, err := newFileSource(sourceCSV, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = src.StreamEvents(ctx, period{Since: mustParseDate("2020-04-01")}, []int{6}, 10, func([]EventRow) error { return nil })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
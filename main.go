@@ -1,7 +1,7 @@
 // main.go
 //
 // Usage example:
-//   go run main.go -quantile=0.025 -since=2020-04-01
+//   go run . -quantile=0.025 -since=2020-04-01
 //
 // This program follows Load -> Compute in Memory -> Export, with no SQL JOINs.
 // It reads CustomerEventData (type 6 since 2020-04-01), ContentPrice, CustomerData(email),
@@ -10,6 +10,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -41,7 +42,7 @@ type EventRow struct {
 type ContentPriceRow struct {
 	ContentPriceID int64
 	ContentID      int
-	Price          float64
+	Price          Money
 	Currency       string
 	InsertDate     time.Time
 }
@@ -57,23 +58,98 @@ type CustomerDataRow struct {
 type CustomerCA struct {
 	CustomerID int64
 	Email      string
-	CA         float64
+	CA         Money
+	Metrics
+}
+
+// Customer with its position in the quantile analysis
+type RankedCustomer struct {
+	CustomerCA
+	Rank       int     // 1 = highest CA
+	Quantile   int     // 0 = top quantile
+	Percentile float64 // share of customers ranked at or above this one, in %
 }
 
 // Quantile stats
 type QuantileStats struct {
-	MinCA     float64
-	MaxCA     float64
-	NbClients int
+	MinCA        Money
+	MaxCA        Money
+	NbClients    int
+	TotalCA      Money
+	MeanCA       float64 // in currency units, like MedianCA and StdDevCA
+	MedianCA     float64
+	StdDevCA     float64 // population standard deviation
+	RevenueShare float64 // TotalCA / CA of all customers, in [0, 1]
+	MinValue     int64   // range of the -rank-by metric in the bucket
+	MaxValue     int64
 }
 
 // -------------------- Globals / config --------------------
 
 var (
-	quantile  = 0.025
-	sinceStr  = "2020-04-01"
-	verbose   = false
-	batchSize = 500
+	quantile      = 0.025
+	sinceStr      = "2020-04-01"
+	untilStr      = ""
+	windowStr     = ""
+	refStr        = ""
+	verbose       = false
+	batchSize     = 500
+	chunkSize     = 50000
+	pricing       = pricingLatest
+	currency      = "EUR"
+	ratesTbl      = ""
+	ratesFile     = ""
+	sourceStr     = sourceMySQL
+	exportStr     = exportTop
+	tiesStr       = tiesSplit
+	methodStr     = methodEqualCount
+	cutsStr       = ""
+	thrStr        = ""
+	buckets       bucketSpec
+	purchStr      = "6"
+	refundStr     = ""
+	eventTypesCfg = defaultEventTypes
+	rankBy        = metricCA
+	modeStr       = modeQuantile
+	rulesFile     = ""
+	rfmRules      = defaultRFMRules
+	cohorts       = false
+	cohortCSV     = ""
+	products      = false
+	diffOld       = ""
+	diffNew       = ""
+	parLoad       = false
+	sketch        = false
+	sketchK       = defaultSketchK
+	memStr        = ""
+	memLimit      int64
+	incrState     = false
+	rebuild       = false
+	ckptDir       = ""
+	resume        = false
+)
+
+// run modes
+const (
+	modeQuantile = "quantile" // quantile analysis of -rank-by
+	modeRFM      = "rfm"      // RFM scores and segments, see rfm.go
+	modeDiff     = "diff"     // top quantile movers between two exports, see diff.go
+)
+
+// export modes
+const (
+	exportTop = "top" // top quantile only
+	exportAll = "all" // every customer with its quantile
+
+	// tie policies at quantile boundaries
+	tiesSplit      = "split"       // cut at the bucket size, ties ordered by CustomerID
+	tiesKeepHigher = "keep-higher" // customers tied with the last one of a bucket stay in it
+)
+
+// pricing modes
+const (
+	pricingLatest    = "latest"      // latest ContentPrice per ContentID
+	pricingAsOfEvent = "as-of-event" // ContentPrice effective at the EventDate
 )
 
 // -------------------- Utility / logging --------------------
@@ -134,35 +210,149 @@ func openDB() (*sql.DB, error) {
 	return db, nil
 }
 
-// Read events (no joins): EventTypeID = 6, EventDate >= since
-func loadEvents(db *sql.DB, since time.Time) ([]EventRow, error) {
-	log.WithFields(log.Fields{"stage": "LOAD", "table": "CustomerEventData"}).Info("loading events")
-	q := `SELECT EventDataID, EventID, ContentID, CustomerID, EventTypeID, EventDate, Quantity, InsertDate
-	      FROM CustomerEventData
-	      WHERE EventTypeID = ? AND EventDate >= ?`
-	rows, err := db.Query(q, 6, since)
+// queryer is satisfied by *sql.DB, *sql.Tx and *snapshot, so loaders can run
+// either on the pool or inside the LOAD snapshot transaction.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// snapshot pins a single connection inside a read-only REPEATABLE READ transaction
+// started WITH CONSISTENT SNAPSHOT, so every LOAD query sees the same data state.
+type snapshot struct {
+	conn *sql.Conn
+	At   time.Time // server time at which the snapshot was taken
+}
+
+func beginSnapshot(ctx context.Context, db *sql.DB) (*snapshot, error) {
+	conn, err := db.Conn(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var out []EventRow
-	for rows.Next() {
-		var r EventRow
-		if err := rows.Scan(&r.EventDataID, &r.EventID, &r.ContentID, &r.CustomerID, &r.EventTypeID, &r.EventDate, &r.Quantity, &r.InsertDate); err != nil {
+	for _, q := range []string{
+		"SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+	} {
+		if _, err := conn.ExecContext(ctx, q); err != nil {
+			conn.Close()
 			return nil, err
 		}
-		out = append(out, r)
 	}
-	log.WithFields(log.Fields{"loaded_events": len(out)}).Info("events loaded")
-	return out, nil
+	s := &snapshot{conn: conn}
+	if err := conn.QueryRowContext(ctx, "SELECT NOW(6)").Scan(&s.At); err != nil {
+		s.Close()
+		return nil, err
+	}
+	log.WithFields(log.Fields{"stage": "LOAD", "snapshot_at": s.At.Format(time.RFC3339Nano)}).Info("consistent snapshot started")
+	return s, nil
+}
+
+func (s *snapshot) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (s *snapshot) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.conn.QueryContext(ctx, query, args...)
+}
+
+// Close ends the read-only transaction and releases the connection to the pool.
+// Closing an already closed snapshot is a no-op.
+func (s *snapshot) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	_, err := s.conn.ExecContext(context.Background(), "COMMIT")
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	s.conn = nil
+	return err
+}
+
+// Read events (no joins): EventTypeID in types, EventDate in the period.
+// Stream events page by page using keyset pagination on EventDataID (no OFFSET),
+// so memory stays bounded by chunkSize whatever the size of the history.
+// fn is called once per non-empty chunk; the slice is reused between calls.
+func streamEvents(ctx context.Context, db queryer, p period, types []int, chunkSize int, fn func([]EventRow) error) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("no event type to load")
+	}
+	log.WithFields(log.Fields{"stage": "LOAD", "table": "CustomerEventData", "chunk_size": chunkSize}).Info("loading events")
+	until, inserted := "", ""
+	if !p.Until.IsZero() {
+		until = "AND EventDate < ?"
+	}
+	if !p.InsertedAfter.IsZero() {
+		// events inserted in the same second as the watermark follow it by id
+		inserted = "AND (InsertDate > ? OR (InsertDate = ? AND EventDataID > ?))"
+	}
+	q := `SELECT EventDataID, EventID, ContentID, CustomerID, EventTypeID, EventDate, Quantity, InsertDate
+	      FROM CustomerEventData
+	      WHERE EventTypeID IN (?` + strings.Repeat(", ?", len(types)-1) + `) AND EventDate >= ? ` + until + ` ` + inserted + ` AND EventDataID > ?
+	      ORDER BY EventDataID
+	      LIMIT ?`
+
+	var lastID int64
+	total, chunks := 0, 0
+	chunk := make([]EventRow, 0, chunkSize)
+	for {
+		chunk = chunk[:0]
+		args := make([]interface{}, 0, len(types)+7)
+		for _, t := range types {
+			args = append(args, t)
+		}
+		args = append(args, p.Since)
+		if !p.Until.IsZero() {
+			args = append(args, p.Until)
+		}
+		if !p.InsertedAfter.IsZero() {
+			w := p.InsertedAfter
+			args = append(args, w.InsertDate, w.InsertDate, w.EventDataID)
+		}
+		rows, err := db.QueryContext(ctx, q, append(args, lastID, chunkSize)...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var r EventRow
+			if err := rows.Scan(&r.EventDataID, &r.EventID, &r.ContentID, &r.CustomerID, &r.EventTypeID, &r.EventDate, &r.Quantity, &r.InsertDate); err != nil {
+				rows.Close()
+				return err
+			}
+			chunk = append(chunk, r)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+
+		lastID = chunk[len(chunk)-1].EventDataID
+		total += len(chunk)
+		chunks++
+		log.WithFields(log.Fields{"chunk": chunks, "rows": len(chunk), "last_eventdataid": lastID}).Debug("events chunk loaded")
+		if err := fn(chunk); err != nil {
+			return err
+		}
+		if len(chunk) < chunkSize {
+			break
+		}
+	}
+	log.WithFields(log.Fields{"loaded_events": total, "chunks": chunks}).Info("events loaded")
+	return nil
 }
 
 // Read content prices (no joins). We will choose latest InsertDate per ContentID in memory.
-func loadContentPrices(db *sql.DB) ([]ContentPriceRow, error) {
+func loadContentPrices(ctx context.Context, db queryer) ([]ContentPriceRow, error) {
 	log.WithField("stage", "LOAD").Info("loading content prices")
 	q := `SELECT ContentPriceID, ContentID, Price, Currency, InsertDate FROM ContentPrice`
-	rows, err := db.Query(q)
+	rows, err := db.QueryContext(ctx, q)
 	if err != nil {
 		return nil, err
 	}
@@ -176,15 +366,18 @@ func loadContentPrices(db *sql.DB) ([]ContentPriceRow, error) {
 		}
 		out = append(out, r)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	log.WithField("loaded_prices", len(out)).Info("content prices loaded")
 	return out, nil
 }
 
 // Read customer emails (CustomerData with ChannelTypeID = 1)
-func loadCustomerEmails(db *sql.DB) ([]CustomerDataRow, error) {
+func loadCustomerEmails(ctx context.Context, db queryer) ([]CustomerDataRow, error) {
 	log.WithField("stage", "LOAD").Info("loading customer emails (CustomerData channel=1)")
 	q := `SELECT CustomerChannelID, CustomerID, ChannelTypeID, ChannelValue, InsertDate FROM CustomerData WHERE ChannelTypeID = ?`
-	rows, err := db.Query(q, 1)
+	rows, err := db.QueryContext(ctx, q, 1)
 	if err != nil {
 		return nil, err
 	}
@@ -198,6 +391,9 @@ func loadCustomerEmails(db *sql.DB) ([]CustomerDataRow, error) {
 		}
 		out = append(out, r)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	log.WithField("loaded_emails", len(out)).Info("customer emails loaded")
 	return out, nil
 }
@@ -205,7 +401,17 @@ func loadCustomerEmails(db *sql.DB) ([]CustomerDataRow, error) {
 // -------------------- COMPUTE phase --------------------
 
 // Build price map: choose latest InsertDate per ContentID
-func buildPriceMap(prices []ContentPriceRow) map[int]float64 {
+func buildPriceMap(prices []ContentPriceRow) map[int]Money {
+	latest := buildLatestPrices(prices)
+	out := make(map[int]Money, len(latest))
+	for k, v := range latest {
+		out[k] = v.Price
+	}
+	return out
+}
+
+// Same as buildPriceMap but keeps the whole row (currency included)
+func buildLatestPrices(prices []ContentPriceRow) map[int]ContentPriceRow {
 	priceMap := make(map[int]ContentPriceRow)
 	for _, p := range prices {
 		ex, ok := priceMap[p.ContentID]
@@ -213,11 +419,38 @@ func buildPriceMap(prices []ContentPriceRow) map[int]float64 {
 			priceMap[p.ContentID] = p
 		}
 	}
-	out := make(map[int]float64, len(priceMap))
-	for k, v := range priceMap {
-		out[k] = v.Price
+	return priceMap
+}
+
+// Price history per ContentID, sorted by InsertDate ascending.
+// A price is considered effective from its InsertDate until the next one.
+type priceIndex map[int][]ContentPriceRow
+
+func buildPriceIndex(prices []ContentPriceRow) priceIndex {
+	idx := make(priceIndex)
+	for _, p := range prices {
+		idx[p.ContentID] = append(idx[p.ContentID], p)
 	}
-	return out
+	for _, hist := range idx {
+		sort.SliceStable(hist, func(i, j int) bool { return hist[i].InsertDate.Before(hist[j].InsertDate) })
+	}
+	return idx
+}
+
+// priceAt returns the price row effective at date t for a content.
+// known is false when the content has no price at all; ok is false when
+// the content has prices but all of them were inserted after t.
+func (idx priceIndex) priceAt(contentID int, t time.Time) (p ContentPriceRow, known, ok bool) {
+	hist, known := idx[contentID]
+	if !known || len(hist) == 0 {
+		return ContentPriceRow{}, false, false
+	}
+	// first price strictly after t, the effective one is just before it
+	i := sort.Search(len(hist), func(i int) bool { return hist[i].InsertDate.After(t) })
+	if i == 0 {
+		return ContentPriceRow{}, true, false
+	}
+	return hist[i-1], true, true
 }
 
 // Build email map: choose latest InsertDate per CustomerID
@@ -236,48 +469,265 @@ func buildEmailMap(cd []CustomerDataRow) map[int64]string {
 	return out
 }
 
-// Compute CA per customer given events and price map
-func computeCA(events []EventRow, priceMap map[int]float64) map[int64]float64 {
-	ca := make(map[int64]float64)
-	missingPrices := make(map[int]int) // ContentID -> count of events with missing price
+// caAggregator accumulates CA per customer incrementally, so events can be
+// fed chunk by chunk while streaming instead of being held in memory.
+// With a priceIndex, events are valued at the price effective at their EventDate
+// instead of the latest one. With a rateTable, prices are converted into the
+// reporting currency before being summed.
+type caAggregator struct {
+	latest            map[int]ContentPriceRow
+	priceIndex        priceIndex
+	rates             rateTable
+	currency          string      // reporting currency; "" values every price as-is
+	types             *eventTypes // nil: every event is a purchase
+	ca                map[int64]Money
+	missingPrices     map[int]int    // ContentID -> count of events with missing price
+	predatingPrices   map[int]int    // ContentID -> count of events older than the first known price
+	unknownCurrencies map[string]int // Currency -> count of events with no exchange rate
+	metrics           *metricsTracker
+	cohorts           *cohortTracker  // nil unless -cohorts
+	products          *productTracker // nil unless -products
+	spill             *spiller        // nil unless -memory-limit
+	nbEvents          int
+	nbRefunds         int
+	refunded          Money     // total subtracted by refund events
+	last              watermark // latest event seen, the watermark of -incremental
+}
 
-	// progress bar
-	bar := progressbar.Default(int64(len(events)), "computing CA")
-	for _, e := range events {
-		if err := bar.Add(1); err != nil {
-			log.Warnf("progress bar error: %v", err)
-		}
+func newCAAggregator(priceMap map[int]Money) *caAggregator {
+	latest := make(map[int]ContentPriceRow, len(priceMap))
+	for k, v := range priceMap {
+		latest[k] = ContentPriceRow{ContentID: k, Price: v}
+	}
+	return newLatestCAAggregator(latest)
+}
+
+func newLatestCAAggregator(latest map[int]ContentPriceRow) *caAggregator {
+	return &caAggregator{
+		latest:            latest,
+		ca:                make(map[int64]Money),
+		metrics:           newMetricsTracker(),
+		missingPrices:     make(map[int]int),
+		predatingPrices:   make(map[int]int),
+		unknownCurrencies: make(map[string]int),
+	}
+}
+
+func newAsOfCAAggregator(idx priceIndex) *caAggregator {
+	agg := newLatestCAAggregator(nil)
+	agg.priceIndex = idx
+	return agg
+}
+
+// withEventTypes makes refund event types subtract from the CA instead of adding
+func (a *caAggregator) withEventTypes(et eventTypes) *caAggregator {
+	a.types = &et
+	return a
+}
+
+// withProducts also tracks the revenue of every content per customer
+func (a *caAggregator) withProducts() *caAggregator {
+	a.products = newProductTracker()
+	return a
+}
+
+// withCohorts also tracks the monthly activity needed by the cohort matrix
+func (a *caAggregator) withCohorts() *caAggregator {
+	a.cohorts = newCohortTracker()
+	return a
+}
+
+// withSpill writes the per-customer state to disk whenever it outgrows the
+// limit of s, see maybeSpill
+func (a *caAggregator) withSpill(s *spiller) *caAggregator {
+	a.spill = s
+	return a
+}
+
+// maybeSpill moves the per-customer state to a spill file once its estimated
+// size reaches the -memory-limit
+func (a *caAggregator) maybeSpill() error {
+	if a.spill == nil || a.metrics.size < a.spill.limit {
+		return nil
+	}
+	if err := a.spill.spillPartial(a.ca, a.metrics); err != nil {
+		return err
+	}
+	a.ca, a.metrics = make(map[int64]Money), newMetricsTracker()
+	return nil
+}
+
+// flushSpill writes what remains of the per-customer state to a last spill
+// file, including customers that only have metrics since the previous one
+func (a *caAggregator) flushSpill() error {
+	if len(a.ca) == 0 && len(a.metrics.counts) == 0 {
+		return nil
+	}
+	return a.spill.spillPartial(a.ca, a.metrics)
+}
 
-		price, ok := priceMap[e.ContentID]
+// withRates enables conversion of every price into the reporting currency
+func (a *caAggregator) withRates(rates rateTable, currency string) *caAggregator {
+	a.rates = rates
+	a.currency = currency
+	return a
+}
+
+func (a *caAggregator) add(e EventRow) {
+	a.nbEvents++
+	if a.last.precedes(e) {
+		a.last = watermark{InsertDate: e.InsertDate, EventDataID: e.EventDataID}
+	}
+	// quantities may be logged negative on refunds
+	refund := a.types != nil && a.types.sign(e.EventTypeID) < 0
+	qty := e.Quantity
+	if refund && qty < 0 {
+		qty = -qty
+	}
+	// metrics count every event, valued or not: a missing price or rate only
+	// leaves the event out of the CA (customers without any valued event are
+	// not ranked)
+	if refund {
+		a.metrics.refund(e.CustomerID, qty)
+	} else {
+		a.metrics.purchase(e)
+	}
+	p, ok := a.lookupPrice(e)
+	if !ok {
+		return
+	}
+	price := p.Price
+	if a.currency != "" {
+		rate, ok := a.rates.rateAt(p.Currency, a.currency, e.EventDate)
 		if !ok {
-			// missing price -> track and skip
-			missingPrices[e.ContentID]++
+			// unknown currency -> track and skip
+			a.unknownCurrencies[p.Currency]++
 			if log.IsLevelEnabled(log.DebugLevel) {
 				log.WithFields(log.Fields{
 					"content_id":  e.ContentID,
 					"eventdataid": e.EventDataID,
-				}).Debug("missing price for content; skipping")
+					"currency":    p.Currency,
+				}).Debug("no exchange rate for currency; skipping")
 			}
-			continue
+			return
+		}
+		price = price.convert(rate)
+	}
+	if refund {
+		// refund: same price as a purchase, subtracted
+		amount := price.mul(qty)
+		a.ca[e.CustomerID] -= amount
+		if a.cohorts != nil {
+			a.cohorts.refund(e.CustomerID, e.EventDate, amount)
 		}
-		ca[e.CustomerID] += price * float64(e.Quantity)
+		if a.products != nil {
+			a.products.refund(e.CustomerID, e.ContentID, qty, amount)
+		}
+		a.nbRefunds++
+		a.refunded += amount
+		return
+	}
+	amount := price.mul(e.Quantity)
+	a.ca[e.CustomerID] += amount
+	if a.cohorts != nil {
+		a.cohorts.purchase(e.CustomerID, e.EventDate, amount)
 	}
+	if a.products != nil {
+		a.products.purchase(e.CustomerID, e.ContentID, e.Quantity, amount)
+	}
+}
+
+// customers returns every customer with a CA, its metrics and email, sorted by rankBy
+func (a *caAggregator) customers(emailMap map[int64]string, rankBy string) []CustomerCA {
+	out := a.metrics.customers(a.ca, emailMap)
+	sortCustomers(out, rankBy)
+	return out
+}
 
-	if len(missingPrices) > 0 {
+// each calls fn with every customer, unsorted and without materialising them
+func (a *caAggregator) each(emailMap map[int64]string, fn func(CustomerCA)) {
+	a.metrics.each(a.ca, emailMap, fn)
+}
+
+// lookupPrice finds the price of an event, tracking events that cannot be valued
+func (a *caAggregator) lookupPrice(e EventRow) (ContentPriceRow, bool) {
+	if a.priceIndex == nil {
+		p, ok := a.latest[e.ContentID]
+		if !ok {
+			a.missingPrice(e)
+		}
+		return p, ok
+	}
+
+	p, known, ok := a.priceIndex.priceAt(e.ContentID, e.EventDate)
+	if !known {
+		a.missingPrice(e)
+		return p, false
+	}
+	if !ok {
+		// event older than any price of this content -> track and skip
+		a.predatingPrices[e.ContentID]++
+		if log.IsLevelEnabled(log.DebugLevel) {
+			log.WithFields(log.Fields{
+				"content_id":  e.ContentID,
+				"eventdataid": e.EventDataID,
+				"event_date":  e.EventDate.Format("2006-01-02"),
+			}).Debug("event predates any known price for content; skipping")
+		}
+		return p, false
+	}
+	return p, true
+}
+
+func (a *caAggregator) missingPrice(e EventRow) {
+	// missing price -> track and skip
+	a.missingPrices[e.ContentID]++
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithFields(log.Fields{
+			"content_id":  e.ContentID,
+			"eventdataid": e.EventDataID,
+		}).Debug("missing price for content; skipping")
+	}
+}
+
+// skipped returns the number of events skipped for each reason
+func (a *caAggregator) skipped() (missingPrice, predatingPrice, unknownCurrency int) {
+	for _, c := range a.missingPrices {
+		missingPrice += c
+	}
+	for _, c := range a.predatingPrices {
+		predatingPrice += c
+	}
+	for _, c := range a.unknownCurrencies {
+		unknownCurrency += c
+	}
+	return missingPrice, predatingPrice, unknownCurrency
+}
+
+// result logs the missing price report and returns the CA map
+func (a *caAggregator) result() map[int64]Money {
+	if a.nbRefunds > 0 {
+		log.WithFields(log.Fields{
+			"refund_events":   a.nbRefunds,
+			"refunded_amount": a.refunded.String(),
+		}).Info("refunds netted out of CA")
+	}
+
+	if len(a.missingPrices) > 0 {
 		totalSkipped := 0
-		for _, count := range missingPrices {
+		for _, count := range a.missingPrices {
 			totalSkipped += count
 		}
 		log.WithFields(log.Fields{
-			"unique_content_ids":   len(missingPrices),
+			"unique_content_ids":   len(a.missingPrices),
 			"total_events_skipped": totalSkipped,
-			"percentage_skipped":   fmt.Sprintf("%.2f%%", float64(totalSkipped)/float64(len(events))*100),
+			"percentage_skipped":   fmt.Sprintf("%.2f%%", float64(totalSkipped)/float64(a.nbEvents)*100),
 		}).Warn("missing prices detected")
 
 		// Log détail si verbose
 		if log.IsLevelEnabled(log.DebugLevel) {
 			log.Debug("missing price details:")
-			for contentID, count := range missingPrices {
+			for contentID, count := range a.missingPrices {
 				log.Debugf("  ContentID %d: %d events skipped", contentID, count)
 			}
 		}
@@ -285,10 +735,90 @@ func computeCA(events []EventRow, priceMap map[int]float64) map[int64]float64 {
 		log.Info("all events had corresponding prices")
 	}
 
-	return ca
+	if len(a.predatingPrices) > 0 {
+		totalSkipped := 0
+		for _, count := range a.predatingPrices {
+			totalSkipped += count
+		}
+		log.WithFields(log.Fields{
+			"unique_content_ids":   len(a.predatingPrices),
+			"total_events_skipped": totalSkipped,
+			"percentage_skipped":   fmt.Sprintf("%.2f%%", float64(totalSkipped)/float64(a.nbEvents)*100),
+		}).Warn("events predating any known price detected")
+
+		if log.IsLevelEnabled(log.DebugLevel) {
+			log.Debug("predating price details:")
+			for contentID, count := range a.predatingPrices {
+				log.Debugf("  ContentID %d: %d events skipped", contentID, count)
+			}
+		}
+	}
+
+	if len(a.unknownCurrencies) > 0 {
+		totalSkipped := 0
+		for _, count := range a.unknownCurrencies {
+			totalSkipped += count
+		}
+		log.WithFields(log.Fields{
+			"unique_currencies":    len(a.unknownCurrencies),
+			"total_events_skipped": totalSkipped,
+			"percentage_skipped":   fmt.Sprintf("%.2f%%", float64(totalSkipped)/float64(a.nbEvents)*100),
+		}).Warn("unknown currencies detected")
+
+		if log.IsLevelEnabled(log.DebugLevel) {
+			log.Debug("unknown currency details:")
+			for currency, count := range a.unknownCurrencies {
+				log.Debugf("  Currency %q: %d events skipped", currency, count)
+			}
+		}
+	}
+
+	return a.ca
+}
+
+// Compute CA per customer given events and price map
+func computeCA(events []EventRow, priceMap map[int]Money) map[int64]Money {
+	return aggregateCA(events, newCAAggregator(priceMap))
+}
+
+// Compute CA per customer valuing each event at the price effective at its EventDate
+func computeCAAsOf(events []EventRow, idx priceIndex) map[int64]Money {
+	return aggregateCA(events, newAsOfCAAggregator(idx))
 }
 
-func mapToSortedSlice(caMap map[int64]float64, emailMap map[int64]string) []CustomerCA {
+func aggregateCA(events []EventRow, agg *caAggregator) map[int64]Money {
+	// progress bar
+	bar := progressbar.Default(int64(len(events)), "computing CA")
+	for _, e := range events {
+		if err := bar.Add(1); err != nil {
+			log.Warnf("progress bar error: %v", err)
+		}
+		agg.add(e)
+	}
+	return agg.result()
+}
+
+// Stream events from the source straight into the CA aggregation, chunk by chunk
+func streamCA(ctx context.Context, src Source, p period, et eventTypes, agg *caAggregator) (map[int64]Money, error) {
+	agg.withEventTypes(et)
+	// total unknown while streaming -> spinner
+	bar := progressbar.Default(-1, "computing CA")
+	err := src.StreamEvents(ctx, p, et.all(), chunkSize, func(chunk []EventRow) error {
+		for _, e := range chunk {
+			agg.add(e)
+		}
+		if err := bar.Add(len(chunk)); err != nil {
+			log.Warnf("progress bar error: %v", err)
+		}
+		return agg.maybeSpill()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agg.result(), nil
+}
+
+func mapToSortedSlice(caMap map[int64]Money, emailMap map[int64]string) []CustomerCA {
 	out := make([]CustomerCA, 0, len(caMap))
 	for cid, v := range caMap {
 		email := emailMap[cid]
@@ -298,13 +828,23 @@ func mapToSortedSlice(caMap map[int64]float64, emailMap map[int64]string) []Cust
 			CA:         v,
 		})
 	}
-	// sort descending by CA
-	sort.Slice(out, func(i, j int) bool { return out[i].CA > out[j].CA })
+	sortCustomers(out, metricCA)
 	return out
 }
 
+// sort descending by the rankBy metric, then by CustomerID so the order is the same every run
+func sortCustomers(out []CustomerCA, rankBy string) {
+	sort.Slice(out, func(i, j int) bool {
+		ki, kj := out[i].key(rankBy), out[j].key(rankBy)
+		if ki != kj {
+			return ki > kj
+		}
+		return out[i].CustomerID < out[j].CustomerID
+	})
+}
+
 // print 10 random samples from map
-func printRandomSamples(caMap map[int64]float64, n int) {
+func printRandomSamples(caMap map[int64]Money, n int) {
 	total := len(caMap)
 	if total == 0 {
 		log.Info("no CA entries to sample")
@@ -319,48 +859,125 @@ func printRandomSamples(caMap map[int64]float64, n int) {
 	for i := 0; i < n && i < total; i++ {
 		idx := rand.Intn(len(ids))
 		cid := ids[idx]
-		log.Infof("sample %d: CustomerID=%d CA=%.2f", i+1, cid, caMap[cid])
+		log.Infof("sample %d: CustomerID=%d CA=%s", i+1, cid, caMap[cid])
 	}
 }
 
+// number of quantiles and size per quantile (ceil to distribute all)
+func quantileBuckets(n int, quantile float64) (qCount, size int) {
+	qCount = int(math.Round(1.0 / quantile))
+	if qCount <= 0 {
+		qCount = 1
+	}
+	size = int(math.Ceil(float64(n) / float64(qCount)))
+	return qCount, size
+}
+
+// end index (exclusive) of every bucket of the sorted slice. With tiesSplit the
+// cuts are at multiples of size; with tiesKeepHigher a cut is pushed down past
+// every customer with the same rankBy value as the last one of the bucket, so tied
+// customers never straddle two buckets (later buckets shrink accordingly).
+func quantileBounds(sorted []CustomerCA, quantile float64, ties, rankBy string) []int {
+	return adjustBounds(sorted, equalCountEnds(len(sorted), quantile), ties, rankBy)
+}
+
+// equalCountEnds are the nominal bucket ends of n customers, before the tie policy
+func equalCountEnds(n int, quantile float64) []int {
+	qCount, size := quantileBuckets(n, quantile)
+	ends := make([]int, qCount)
+	for i := range ends {
+		ends[i] = (i + 1) * size
+	}
+	return ends
+}
+
+// assign rank, quantile index and percentile to every customer of the sorted slice,
+// using the same buckets as computeQuantiles
+func rankCustomers(sorted []CustomerCA, spec bucketSpec) []RankedCustomer {
+	n := len(sorted)
+	if n == 0 {
+		return nil
+	}
+	ends := spec.bounds(sorted)
+	out := make([]RankedCustomer, n)
+	q := 0
+	for i, c := range sorted {
+		for i >= ends[q] {
+			q++
+		}
+		out[i] = RankedCustomer{
+			CustomerCA: c,
+			Rank:       i + 1,
+			Quantile:   q,
+			Percentile: float64(i+1) / float64(n) * 100,
+		}
+	}
+	return out
+}
+
+// bucketStats summarizes a non-empty bucket sorted by descending rankBy metric
+func bucketStats(bucket []CustomerCA, grandTotal Money, rankBy string) QuantileStats {
+	k := len(bucket)
+	s := QuantileStats{NbClients: k, MinValue: bucket[k-1].key(rankBy), MaxValue: bucket[0].key(rankBy)}
+	s.MinCA, s.MaxCA = bucket[0].CA, bucket[0].CA
+	cas := make([]Money, k)
+	for i, c := range bucket {
+		s.TotalCA += c.CA
+		if c.CA < s.MinCA {
+			s.MinCA = c.CA
+		}
+		if c.CA > s.MaxCA {
+			s.MaxCA = c.CA
+		}
+		cas[i] = c.CA
+	}
+	s.MeanCA = s.TotalCA.Float64() / float64(k)
+	// the bucket is ordered by the -rank-by metric, not necessarily by CA
+	sort.Slice(cas, func(i, j int) bool { return cas[i] < cas[j] })
+	if k%2 == 1 {
+		s.MedianCA = cas[k/2].Float64()
+	} else {
+		s.MedianCA = (cas[k/2-1] + cas[k/2]).Float64() / 2
+	}
+	variance := 0.0
+	for _, c := range bucket {
+		d := c.CA.Float64() - s.MeanCA
+		variance += d * d
+	}
+	s.StdDevCA = math.Sqrt(variance / float64(k))
+	if grandTotal != 0 {
+		s.RevenueShare = float64(s.TotalCA) / float64(grandTotal)
+	}
+	return s
+}
+
 // compute quantiles and stats
-func computeQuantiles(sorted []CustomerCA, quantile float64) (map[int]QuantileStats, []CustomerCA) {
+func computeQuantiles(sorted []CustomerCA, spec bucketSpec) (map[int]QuantileStats, []CustomerCA) {
 	n := len(sorted)
 	if n == 0 {
 		return nil, nil
 	}
-	qCount := int(math.Round(1.0 / quantile))
-	if qCount <= 0 {
-		qCount = 1
-	}
+	ends := spec.bounds(sorted)
+	qstats := make(map[int]QuantileStats, len(ends))
 
-	// size per quantile (ceil to distribute all)
-	size := int(math.Ceil(float64(n) / float64(qCount)))
-	qstats := make(map[int]QuantileStats, qCount)
+	var grandTotal Money
+	for _, c := range sorted {
+		grandTotal += c.CA
+	}
 
-	for i := 0; i < qCount; i++ {
-		start := i * size
-		end := start + size
-		if start >= n {
+	start := 0
+	for i, end := range ends {
+		if start >= end {
 			// empty bucket
 			qstats[i] = QuantileStats{MinCA: 0, MaxCA: 0, NbClients: 0}
 			continue
 		}
-		if end > n {
-			end = n
-		}
-		bucket := sorted[start:end]
-		min := bucket[len(bucket)-1].CA
-		max := bucket[0].CA
-		qstats[i] = QuantileStats{MinCA: min, MaxCA: max, NbClients: len(bucket)}
+		qstats[i] = bucketStats(sorted[start:end], grandTotal, spec.RankBy)
+		start = end
 	}
 
 	// first quantile (top quantile) = index 0 because sorted descending
-	topN := size
-	if topN > n {
-		topN = n
-	}
-	top := sorted[0:topN]
+	top := sorted[0:ends[0]]
 	return qstats, top
 }
 
@@ -371,49 +988,91 @@ func ensureExportTable(db *sql.DB, tableName string) error {
 	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
 	CustomerID BIGINT NOT NULL PRIMARY KEY,
 	Email VARCHAR(255),
-	CA DECIMAL(18,2) NOT NULL
+	CA DECIMAL(18,2) NOT NULL,
+	Purchases INT NOT NULL,
+	DistinctProducts INT NOT NULL,
+	Quantity INT NOT NULL,
+	ActiveDays INT NOT NULL,
+	LastPurchase DATE NULL,
+	QuantileIndex INT NOT NULL,
+	CustomerRank INT NOT NULL,
+	Percentile DECIMAL(7,4) NOT NULL,
+	RunID BIGINT NOT NULL
 ) ENGINE=InnoDB;`, tableName)
 	_, err := db.Exec(q)
 	return err
 }
 
-// batch insert (mass insert) with ON DUPLICATE KEY UPDATE
-func exportTopCustomers(db *sql.DB, tableName string, top []CustomerCA) error {
-	if len(top) == 0 {
-		log.Info("no top customers to export")
+// batch insert (mass insert) of the customers with ON DUPLICATE KEY UPDATE
+func exportCustomers(db *sql.DB, tableName string, customers []RankedCustomer, runID int64) error {
+	if len(customers) == 0 {
+		log.Info("no customers to export")
 		return nil
 	}
-	log.WithFields(log.Fields{"stage": "EXPORT", "table": tableName, "count": len(top)}).Info("exporting top customers (batch)")
+	log.WithFields(log.Fields{"stage": "EXPORT", "table": tableName, "count": len(customers)}).Info("exporting customers (batch)")
+	return insertRows(db, tableName, exportColumns, len(customers), func(i int) []interface{} {
+		return exportValues(customers[i], runID)
+	})
+}
 
-	// prepare batches
-	type batchRow struct {
-		cid   int64
-		email string
-		ca    float64
-	}
-	rows := make([]batchRow, 0, len(top))
-	for _, r := range top {
-		rows = append(rows, batchRow{cid: r.CustomerID, email: r.Email, ca: r.CA})
+var exportColumns = []string{"CustomerID", "Email", "CA", "Purchases", "DistinctProducts", "Quantity", "ActiveDays", "LastPurchase",
+	"QuantileIndex", "CustomerRank", "Percentile", "RunID"}
+
+// exportValues is the row of r, in the order of exportColumns
+func exportValues(r RankedCustomer, runID int64) []interface{} {
+	return []interface{}{r.CustomerID, r.Email, r.CA, r.Purchases, r.Products, r.Quantity, r.ActiveDays, sqlDate(r.LastPurchase),
+		r.Quantile, r.Rank, fmt.Sprintf("%.4f", r.Percentile), runID}
+}
+
+// exportCustomerStream is exportCustomers for n customers read one by one
+func exportCustomerStream(db *sql.DB, tableName string, n int, next func() (RankedCustomer, error), runID int64) error {
+	if n == 0 {
+		log.Info("no customers to export")
+		return nil
 	}
+	log.WithFields(log.Fields{"stage": "EXPORT", "table": tableName, "count": n}).Info("exporting customers (batch)")
+	return insertRowsFrom(db, tableName, exportColumns, n, func() ([]interface{}, error) {
+		r, err := next()
+		if err != nil {
+			return nil, err
+		}
+		return exportValues(r, runID), nil
+	})
+}
 
-	bar := progressbar.Default(int64(len(rows)), "exporting batches")
+// insertRows inserts n rows by batches of batchSize, one transaction per batch;
+// row(i) returns the values of row i in the order of columns, and every column
+// but the first is refreshed on duplicate key
+func insertRows(db *sql.DB, tableName string, columns []string, n int, row func(i int) []interface{}) error {
+	i := 0
+	return insertRowsFrom(db, tableName, columns, n, func() ([]interface{}, error) {
+		r := row(i)
+		i++
+		return r, nil
+	})
+}
+
+// insertRowsFrom is insertRows with the rows read in order from next, which
+// may fail
+func insertRowsFrom(db *sql.DB, tableName string, columns []string, n int, next func() ([]interface{}, error)) error {
+	bar := progressbar.Default(int64(n), "exporting batches")
 
-	for i := 0; i < len(rows); i += batchSize {
+	for i := 0; i < n; i += batchSize {
 		end := i + batchSize
-		if end > len(rows) {
-			end = len(rows)
+		if end > n {
+			end = n
 		}
-		sub := rows[i:end]
 
 		// build query
-		vals := make([]string, 0, len(sub))
-		args := make([]interface{}, 0, len(sub)*3)
-		for _, r := range sub {
-			vals = append(vals, "(?, ?, ?)")
-			args = append(args, r.cid, r.email, fmt.Sprintf("%.2f", r.ca))
-		}
-		q := fmt.Sprintf("INSERT INTO %s (CustomerID, Email, CA) VALUES %s ON DUPLICATE KEY UPDATE Email=VALUES(Email), CA=VALUES(CA)",
-			tableName, strings.Join(vals, ","))
+		args := make([]interface{}, 0, (end-i)*len(columns))
+		for j := i; j < end; j++ {
+			row, err := next()
+			if err != nil {
+				return err
+			}
+			args = append(args, row...)
+		}
+		q := upsertStatement(tableName, columns, end-i)
 		// exec
 		tx, err := db.Begin()
 		if err != nil {
@@ -427,20 +1086,145 @@ func exportTopCustomers(db *sql.DB, tableName string, top []CustomerCA) error {
 			return err
 		}
 
-		if err := bar.Add(len(sub)); err != nil {
+		if err := bar.Add(end - i); err != nil {
 			log.Warnf("progress bar error: %v", err)
 		}
 	}
 	return nil
 }
 
+// upsertStatement inserts n rows of columns, refreshing every column but the
+// first on duplicate key
+func upsertStatement(tableName string, columns []string, n int) string {
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	updates := make([]string, 0, len(columns)-1)
+	for _, c := range columns[1:] {
+		updates = append(updates, fmt.Sprintf("%s=VALUES(%s)", c, c))
+	}
+	return fmt.Sprintf(`INSERT INTO %s (%s) VALUES %s
+			ON DUPLICATE KEY UPDATE %s`,
+		tableName, strings.Join(columns, ", "), strings.TrimSuffix(strings.Repeat(placeholders+",", n), ","), strings.Join(updates, ", "))
+}
+
+// sqlDate is the DATE value of t, NULL when t is zero
+func sqlDate(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format("2006-01-02")
+}
+
+// Export into a staging table then swap it with the target in a single RENAME TABLE,
+// so readers never see a partially filled table nor rows left over by a previous run
+func exportAtomic(db *sql.DB, tableName string, customers []RankedCustomer, runID int64) error {
+	return replaceTable(db, tableName, func(staging string) error {
+		if err := ensureExportTable(db, staging); err != nil {
+			return err
+		}
+		return exportCustomers(db, staging, customers, runID)
+	})
+}
+
+// replaceTable fills a fresh staging table with fill, then swaps it with tableName
+func replaceTable(db *sql.DB, tableName string, fill func(staging string) error) error {
+	staging := tableName + "_staging"
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", staging)); err != nil {
+		return err
+	}
+	if err := fill(staging); err != nil {
+		dropTable(db, staging)
+		return err
+	}
+
+	exists, err := tableExists(db, tableName)
+	if err != nil {
+		dropTable(db, staging)
+		return err
+	}
+	swap, cleanup := swapStatements(tableName, staging, exists)
+	for _, q := range swap {
+		if _, err := db.Exec(q); err != nil {
+			dropTable(db, staging)
+			return err
+		}
+	}
+	// the new table is live: a failed cleanup leaves a stale _old table, not a failed export
+	for _, q := range cleanup {
+		if _, err := db.Exec(q); err != nil {
+			log.WithField("table", tableName).Warnf("table swapped in but cleanup failed (%s): %v", q, err)
+		}
+	}
+	log.WithFields(log.Fields{"stage": "EXPORT", "table": tableName, "replaced": exists}).Info("staging table swapped in")
+	return nil
+}
+
+// statements replacing target with staging, then dropping the replaced table;
+// RENAME TABLE of both names is atomic
+func swapStatements(target, staging string, targetExists bool) (swap, cleanup []string) {
+	if !targetExists {
+		return []string{fmt.Sprintf("RENAME TABLE %s TO %s", staging, target)}, nil
+	}
+	old := target + "_old"
+	return []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", old),
+		fmt.Sprintf("RENAME TABLE %s TO %s, %s TO %s", target, old, staging, target),
+	}, []string{
+		fmt.Sprintf("DROP TABLE %s", old),
+	}
+}
+
+func tableExists(db *sql.DB, tableName string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`, tableName).Scan(&n)
+	return n > 0, err
+}
+
+// best-effort cleanup after a failed export
+func dropTable(db *sql.DB, tableName string) {
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", tableName)); err != nil {
+		log.Warnf("failed to drop table %s: %v", tableName, err)
+	}
+}
+
 // -------------------- Main --------------------
 
 func main() {
 	// Define and parse flags in main() to avoid conflicts with test flags
 	flag.Float64Var(&quantile, "quantile", 0.025, "quantile fraction (ex: 0.025)")
 	flag.StringVar(&sinceStr, "since", "2020-04-01", "EventDate lower bound (YYYY-MM-DD)")
+	flag.StringVar(&untilStr, "until", "", "EventDate exclusive upper bound (YYYY-MM-DD)")
+	flag.StringVar(&windowStr, "window", "", "relative window ending at -ref-date, e.g. 90d, 12w, 6m, 1y (replaces -since/-until)")
+	flag.StringVar(&refStr, "ref-date", "", "reference date of -window (YYYY-MM-DD, default today)")
 	flag.BoolVar(&verbose, "verbose", false, "verbose logging")
+	flag.IntVar(&chunkSize, "chunk-size", 50000, "number of events loaded per page (keyset pagination on EventDataID)")
+	flag.StringVar(&pricing, "pricing", pricingLatest, "price used to value events: latest or as-of-event")
+	flag.StringVar(&currency, "currency", "EUR", "reporting currency of the computed CA")
+	flag.StringVar(&ratesTbl, "rates-table", "", "MySQL table of exchange rates (Currency, Rate, RateDate)")
+	flag.StringVar(&ratesFile, "rates-file", "", "CSV file of exchange rates (currency,rate[,date])")
+	flag.StringVar(&sourceStr, "source", sourceMySQL, "input data: mysql, csv:DIR or parquet:DIR")
+	flag.StringVar(&exportStr, "export", exportTop, "customers exported: top (top quantile) or all (every quantile)")
+	flag.StringVar(&tiesStr, "ties", tiesSplit, "customers with equal CA at a bucket boundary: split (by CustomerID) or keep-higher (all in the higher bucket)")
+	flag.StringVar(&purchStr, "purchase-types", "6", "EventTypeID values counted as revenue, comma-separated")
+	flag.StringVar(&refundStr, "refund-types", "", "EventTypeID values subtracted from revenue (returns, cancellations), comma-separated")
+	flag.StringVar(&methodStr, "method", methodEqualCount, "quantile method: equal-count, revenue, cuts or thresholds")
+	flag.StringVar(&cutsStr, "cuts", "", "cumulative customer fractions for -method=cuts, e.g. 0.01,0.05,0.2")
+	flag.StringVar(&thrStr, "thresholds", "", "decreasing -rank-by thresholds for -method=thresholds, e.g. 1000,500,100")
+	flag.StringVar(&modeStr, "mode", modeQuantile, "analysis: quantile (quantiles of -rank-by), rfm (RFM scores and segments) or diff (compare two exports)")
+	flag.StringVar(&diffOld, "diff-old", "", "older export compared by -mode=diff: table name or run:<RunID>")
+	flag.StringVar(&diffNew, "diff-new", "", "newer export compared by -mode=diff: table name or run:<RunID>")
+	flag.StringVar(&rulesFile, "rfm-rules", "", "CSV table of RFM segments (segment,r,f,m) replacing the default rules")
+	flag.BoolVar(&cohorts, "cohorts", false, "also compute the monthly cohort retention matrix")
+	flag.StringVar(&cohortCSV, "cohort-csv", "", "CSV file receiving the cohort matrix (requires -cohorts)")
+	flag.BoolVar(&products, "products", false, "also export revenue and units per ContentID, overall and per quantile")
+	flag.BoolVar(&sketch, "sketch", false, "approximate quantile thresholds with a KLL sketch instead of sorting every customer (top export only)")
+	flag.IntVar(&sketchK, "sketch-k", defaultSketchK, "accuracy of -sketch: thresholds within ±3/k of the customers")
+	flag.StringVar(&memStr, "memory-limit", "", "spill the per-customer aggregates to disk beyond this size, e.g. 512MB (default: all in memory)")
+	flag.BoolVar(&parLoad, "parallel-load", false, "MySQL loaders query concurrently, each in its own snapshot (no single consistent snapshot); by default their queries run one at a time in a shared snapshot")
+	flag.BoolVar(&incrState, "incremental", false, "keep the CA per customer in MySQL state tables and load only the events inserted since the last run (requires -pricing=as-of-event)")
+	flag.BoolVar(&rebuild, "rebuild", false, "with -incremental, recompute the state from every event")
+	flag.StringVar(&ckptDir, "checkpoint", "", "directory receiving the result of each stage, for -resume")
+	flag.BoolVar(&resume, "resume", false, "restart after the last stage saved in -checkpoint with the same parameters")
+	flag.StringVar(&rankBy, "rank-by", metricCA, "metric ordering the customers: ca, purchases, products, quantity or active-days")
 	flag.Parse()
 
 	// Update log level after parsing flags
@@ -449,47 +1233,434 @@ func main() {
 	}
 
 	start := time.Now()
-	log.WithField("stage", "START").Infof("starting process. quantile=%v since=%s", quantile, sinceStr)
 
-	// parse date
-	since := mustParseDate(sinceStr)
+	// resolve the EventDate period
+	opts := periodOptions{Since: sinceStr, Until: untilStr, Window: windowStr, RefDate: refStr}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "since":
+			opts.SinceSet = true
+		case "until":
+			opts.UntilSet = true
+		case "ref-date":
+			opts.RefSet = true
+		}
+	})
+	p, err := resolvePeriod(opts, start)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.WithField("stage", "START").Infof("starting process. mode=%s quantile=%v method=%s rank_by=%s period=%s pricing=%s currency=%s export=%s ties=%s purchase_types=%s refund_types=%s", modeStr, quantile, methodStr, rankBy, p, pricing, currency, exportStr, tiesStr, purchStr, refundStr)
 
-	// open DB
+	if pricing != pricingLatest && pricing != pricingAsOfEvent {
+		log.Fatalf("invalid pricing mode %q (expected %s or %s)", pricing, pricingLatest, pricingAsOfEvent)
+	}
+	if ratesTbl != "" && ratesFile != "" {
+		log.Fatal("-rates-table and -rates-file are mutually exclusive")
+	}
+	currency = strings.ToUpper(currency)
+	if exportStr != exportTop && exportStr != exportAll {
+		log.Fatalf("invalid export mode %q (expected %s or %s)", exportStr, exportTop, exportAll)
+	}
+	if eventTypesCfg, err = parseEventTypes(purchStr, refundStr); err != nil {
+		log.Fatal(err)
+	}
+	if buckets, err = parseBucketSpec(methodStr, quantile, cutsStr, thrStr, tiesStr, rankBy); err != nil {
+		log.Fatal(err)
+	}
+	if modeStr != modeQuantile && modeStr != modeRFM && modeStr != modeDiff {
+		log.Fatalf("invalid mode %q (expected %s, %s or %s)", modeStr, modeQuantile, modeRFM, modeDiff)
+	}
+	if modeStr == modeDiff && (diffOld == "" || diffNew == "") {
+		log.Fatalf("-mode=%s requires -diff-old and -diff-new", modeDiff)
+	}
+	if modeStr != modeDiff && (diffOld != "" || diffNew != "") {
+		log.Fatalf("-diff-old and -diff-new require -mode=%s", modeDiff)
+	}
+	if rulesFile != "" {
+		if modeStr != modeRFM {
+			log.Fatalf("-rfm-rules requires -mode=%s", modeRFM)
+		}
+		if rfmRules, err = loadRFMRules(rulesFile); err != nil {
+			log.Fatalf("failed to load RFM rules: %v", err)
+		}
+	}
+	if products && modeStr != modeQuantile {
+		log.Fatalf("-products requires -mode=%s", modeQuantile)
+	}
+	if cohortCSV != "" && !cohorts {
+		log.Fatal("-cohort-csv requires -cohorts")
+	}
+	if sketch {
+		switch {
+		case modeStr != modeQuantile:
+			log.Fatalf("-sketch requires -mode=%s", modeQuantile)
+		case buckets.Method == methodRevenue:
+			log.Fatalf("-sketch does not support -method=%s (cumulative revenue needs every customer sorted)", methodRevenue)
+		case exportStr != exportTop:
+			log.Fatalf("-sketch requires -export=%s: only the top quantile is kept in memory", exportTop)
+		case products:
+			log.Fatal("-sketch and -products are mutually exclusive (the breakdown needs every customer ranked)")
+		case sketchK < minSketchK:
+			log.Fatalf("invalid -sketch-k %d (expected at least %d)", sketchK, minSketchK)
+		}
+		buckets.Sketch = sketchK
+	}
+	if memLimit, err = parseByteSize(memStr); err != nil {
+		log.Fatalf("invalid -memory-limit: %v", err)
+	}
+	if memLimit > 0 {
+		switch {
+		case memLimit < minMemoryLimit:
+			log.Fatalf("-memory-limit must be at least 1MB, got %s", memStr)
+		case modeStr != modeQuantile:
+			log.Fatalf("-memory-limit requires -mode=%s", modeQuantile)
+		case sketch:
+			log.Fatal("-memory-limit and -sketch are mutually exclusive")
+		case products || cohorts:
+			log.Fatal("-memory-limit does not support -products nor -cohorts (their per-customer state is not spilled)")
+		}
+	}
+	if incrState {
+		switch {
+		case modeStr == modeDiff:
+			log.Fatalf("-incremental does not apply to -mode=%s", modeDiff)
+		case pricing != pricingAsOfEvent:
+			// with the latest prices, every price change would revalue the
+			// whole history while the state keeps the events at the old price
+			log.Fatalf("-incremental requires -pricing=%s", pricingAsOfEvent)
+		case !p.Until.IsZero():
+			log.Fatal("-incremental does not support -until nor -window: the state accumulates every event since -since")
+		case memLimit > 0:
+			log.Fatal("-incremental and -memory-limit are mutually exclusive")
+		case products || cohorts:
+			log.Fatal("-incremental does not support -products nor -cohorts (their per-customer state is not persisted)")
+		}
+	}
+	if rebuild && !incrState {
+		log.Fatal("-rebuild requires -incremental")
+	}
+	if ckptDir != "" {
+		switch {
+		case modeStr == modeDiff:
+			log.Fatalf("-checkpoint does not apply to -mode=%s", modeDiff)
+		case memLimit > 0:
+			log.Fatal("-checkpoint and -memory-limit are mutually exclusive (the aggregates are already on disk)")
+		case products || cohorts:
+			log.Fatal("-checkpoint does not support -products nor -cohorts (their per-customer state is not saved)")
+		}
+	}
+	if resume && ckptDir == "" {
+		log.Fatal("-resume requires -checkpoint")
+	}
+	sourceKind, _, err := parseSource(sourceStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ratesTbl != "" && sourceKind != sourceMySQL {
+		log.Fatal("-rates-table requires -source=mysql; use -rates-file with file sources")
+	}
+	if parLoad && sourceKind != sourceMySQL {
+		log.Fatal("-parallel-load requires -source=mysql; file loaders always run concurrently")
+	}
+
+	// open DB (optional with file sources: only needed for the export and run metadata)
 	db, err := openDB()
 	if err != nil {
-		log.Fatalf("db open error: %v", err)
+		if sourceKind == sourceMySQL || modeStr == modeDiff || incrState {
+			log.Fatalf("db open error: %v", err)
+		}
+		log.Warnf("no database configured, export will be skipped: %v", err)
+		db = nil
+	} else {
+		defer db.Close()
+	}
+
+	run := &runRecord{
+		Mode:       modeStr,
+		Quantile:   quantile,
+		Since:      p.Since,
+		Until:      p.Until,
+		WindowSpec: p.Window,
+		Pricing:    pricing,
+		Currency:   currency,
+		Source:     sourceStr,
+		ExportMode: exportStr,
+		TiePolicy:  tiesStr,
+		Buckets:    buckets.String(),
+		RankBy:     rankBy,
+		Purchase:   joinTypes(eventTypesCfg.Purchase),
+		Refund:     joinTypes(eventTypesCfg.Refund),
+		StartedAt:  start,
+	}
+	if modeStr == modeDiff {
+		run.Source = diffOld + " -> " + diffNew
+	}
+	if db != nil {
+		if err := startRun(db, run); err != nil {
+			log.Fatalf("failed to record run: %v", err)
+		}
 	}
-	defer db.Close()
 
-	// LOAD
-	events, err := loadEvents(db, since)
+	if modeStr == modeDiff {
+		err = runDiff(db, run, diffOld, diffNew)
+	} else {
+		err = runPipeline(db, p, run)
+	}
+
+	run.FinishedAt = time.Now()
+	run.Status = runSuccess
 	if err != nil {
-		log.Fatalf("failed to load events: %v", err)
+		run.Status, run.Error = runFailed, err.Error()
+	}
+	if db != nil {
+		if ferr := finishRun(db, run); ferr != nil {
+			log.Warnf("failed to record run status: %v", ferr)
+		}
 	}
-	prices, err := loadContentPrices(db)
 	if err != nil {
-		log.Fatalf("failed to load content prices: %v", err)
+		log.WithField("run_id", run.ID).Fatal(err)
 	}
-	emails, err := loadCustomerEmails(db)
+
+	fields := log.Fields{"duration": run.FinishedAt.Sub(start).String(), "source": sourceStr, "run_id": run.ID}
+	if !run.SnapshotAt.IsZero() {
+		fields["snapshot_at"] = run.SnapshotAt.Format(time.RFC3339Nano)
+	}
+	log.WithFields(fields).Info("process finished")
+}
+
+// buildAggregator builds the aggregator valuing events with prices, converted
+// with rates when given, and the trackers enabled by the flags
+func buildAggregator(prices []ContentPriceRow, rates []ExchangeRateRow) *caAggregator {
+	var agg *caAggregator
+	if pricing == pricingAsOfEvent {
+		idx := buildPriceIndex(prices)
+		log.WithField("price_index_size", len(idx)).Info("price index built")
+		agg = newAsOfCAAggregator(idx)
+	} else {
+		latest := buildLatestPrices(prices)
+		log.WithField("price_map_size", len(latest)).Info("price map built")
+		agg = newLatestCAAggregator(latest)
+	}
+	// without rates, only prices in the reporting currency can be valued; the
+	// others are skipped as unknown currencies
+	rt := buildRateTable(rates)
+	if rates != nil {
+		log.WithFields(log.Fields{"currencies": len(rt), "reporting_currency": currency}).Info("exchange rate table built")
+	} else if cs := distinctCurrencies(prices); len(cs) > 1 || (len(cs) == 1 && cs[0] != currency) {
+		log.WithFields(log.Fields{"currencies": strings.Join(cs, ","), "reporting_currency": currency}).Warn("no exchange rates given; prices in other currencies than the reporting one are skipped")
+	}
+	agg.withRates(rt, currency)
+	if cohorts {
+		agg.withCohorts()
+	}
+	if products {
+		agg.withProducts()
+	}
+	return agg
+}
+
+// logQuantiles logs the statistics of every bucket
+func logQuantiles(qStats map[int]QuantileStats, spec bucketSpec, topSize int) {
+	if qStats == nil {
+		log.Warn("no quantile stats (no customers)")
+		return
+	}
+	log.Info("========== QUANTILE ANALYSIS ==========")
+	for i := 0; i < len(qStats); i++ {
+		s := qStats[i]
+		log.WithFields(log.Fields{
+			"quantile_index": i,
+			"quantile_range": spec.label(i),
+			"rank_by":        spec.RankBy,
+			"min_value":      formatMetric(spec.RankBy, s.MinValue),
+			"max_value":      formatMetric(spec.RankBy, s.MaxValue),
+			"nb_clients":     s.NbClients,
+			"min_ca":         s.MinCA.String(),
+			"max_ca":         s.MaxCA.String(),
+			"total_ca":       s.TotalCA.String(),
+			"mean_ca":        fmt.Sprintf("%.2f", s.MeanCA),
+			"median_ca":      fmt.Sprintf("%.2f", s.MedianCA),
+			"stddev_ca":      fmt.Sprintf("%.2f", s.StdDevCA),
+			"revenue_share":  fmt.Sprintf("%.2f%%", s.RevenueShare*100),
+		}).Info("quantile summary")
+	}
+	log.Info("=======================================")
+	log.WithField("top_quantile_size", topSize).Info("top quantile extracted")
+}
+
+// loadStage runs the LOAD stage and the CA aggregation, filling the input
+// counters of the run record. With sp, the aggregates are spilled to disk.
+func loadStage(db *sql.DB, p period, run *runRecord, sp *spiller) (*caAggregator, map[int64]string, error) {
+	sourceKind, sourceDir, err := parseSource(sourceStr)
 	if err != nil {
-		log.Fatalf("failed to load customer emails: %v", err)
+		return nil, nil, err
 	}
 
-	// COMPUTE
-	priceMap := buildPriceMap(prices)
-	log.WithField("price_map_size", len(priceMap)).Info("price map built")
+	// LOAD: the three loaders run concurrently (see load.go); events are
+	// streamed straight into the CA aggregation, which needs the prices first
+	var src Source
+	if sourceKind == sourceMySQL {
+		src, err = newMySQLSource(context.Background(), db, parLoad)
+	} else {
+		src, err = newFileSource(sourceKind, sourceDir)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s source: %w", sourceKind, err)
+	}
+	defer src.Close()
+	var st *caState
+	if incrState {
+		// only the events inserted after the watermark are loaded (see incremental.go)
+		if st, err = openState(db, stateParams(p, pricing, currency, eventTypesCfg), rebuild); err != nil {
+			return nil, nil, fmt.Errorf("failed to open CA state: %w", err)
+		}
+		p.InsertedAfter = st.Watermark
+	}
+
+	var (
+		agg         *caAggregator
+		emails      []CustomerDataRow
+		pricesReady = make(chan struct{})
+	)
+	g := newLoadGroup(context.Background())
+	// one snapshot is one connection: without -parallel-load the MySQL
+	// loaders query it one at a time
+	g.sequential = sourceKind == sourceMySQL && !parLoad
+	log.WithFields(log.Fields{"stage": "LOAD", "source": sourceKind, "queries": g.queries()}).Info("starting loaders")
+	g.Go("ContentPrice", func(ctx context.Context) (int, error) {
+		prices, err := src.ContentPrices(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load content prices: %w", err)
+		}
+		var rates []ExchangeRateRow
+		switch {
+		case ratesTbl != "":
+			rates, err = src.(*mysqlSource).ExchangeRates(ctx, ratesTbl)
+		case ratesFile != "":
+			rates, err = loadExchangeRatesCSV(ratesFile)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to load exchange rates: %w", err)
+		}
+		if (ratesTbl != "" || ratesFile != "") && len(rates) == 0 {
+			return 0, fmt.Errorf("no exchange rate in %s%s", ratesTbl, ratesFile)
+		}
+		run.NbPrices = len(prices)
+		agg = buildAggregator(prices, rates)
+		if sp != nil {
+			agg.withSpill(sp)
+		}
+		close(pricesReady)
+		return len(prices), nil
+	})
+	g.Go("CustomerData", func(ctx context.Context) (int, error) {
+		var err error
+		if emails, err = src.CustomerEmails(ctx); err != nil {
+			return 0, fmt.Errorf("failed to load customer emails: %w", err)
+		}
+		return len(emails), nil
+	})
+	g.Go("CustomerEventData", func(ctx context.Context) (int, error) {
+		select {
+		case <-pricesReady:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		if _, err := streamCA(ctx, src, p, eventTypesCfg, agg); err != nil {
+			return 0, fmt.Errorf("failed to load events: %w", err)
+		}
+		return agg.nbEvents, nil
+	})
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	if err := src.Close(); err != nil {
+		log.Warnf("failed to close %s source: %v", sourceKind, err)
+	}
+	if ms, ok := src.(*mysqlSource); ok {
+		run.SnapshotAt = ms.SnapshotAt()
+	}
+	run.NbEmails = len(emails)
 	emailMap := buildEmailMap(emails)
 	log.WithField("email_map_size", len(emailMap)).Info("email map built")
 
-	caMap := computeCA(events, priceMap)
+	run.NbEvents = agg.nbEvents
+	run.SkippedMissingPrice, run.SkippedPredatingPrice, run.SkippedUnknownCurrency = agg.skipped()
+	run.NbRefunds, run.Refunded = agg.nbRefunds, agg.refunded
+	if st != nil {
+		// the new events are merged into the state, which is then ranked whole
+		if err := st.apply(db, agg, run.ID); err != nil {
+			return nil, nil, fmt.Errorf("failed to update CA state: %w", err)
+		}
+		run.Watermark = st.Watermark.InsertDate
+		if err := loadState(db, agg); err != nil {
+			return nil, nil, fmt.Errorf("failed to load CA state: %w", err)
+		}
+	}
+	return agg, emailMap, nil
+}
+
+// runPipeline runs LOAD -> COMPUTE -> EXPORT, filling the run record as it goes.
+// db may be nil with file sources, in which case the export is skipped. With
+// -checkpoint, the result of each stage is saved and -resume restarts after
+// the last one saved with the same parameters (see checkpoint.go).
+func runPipeline(db *sql.DB, p period, run *runRecord) (err error) {
+	var ck *checkpointer
+	if ckptDir != "" {
+		if ck, err = newCheckpointer(ckptDir, loadParams(p), computeParams(p)); err != nil {
+			return fmt.Errorf("failed to open checkpoint directory: %w", err)
+		}
+		defer func() {
+			if err == nil {
+				ck.clear()
+			}
+		}()
+	}
+	if resume {
+		if qc := ck.resumeQuantiles(); qc != nil {
+			qc.restore(run)
+			logQuantiles(qc.QStats, buckets, qc.QStats[0].NbClients)
+			return exportStage(db, p, run, qc.Ranked)
+		}
+	}
+
+	var (
+		agg      *caAggregator
+		emailMap map[int64]string
+	)
+	if resume {
+		if lc := ck.resumeLoaded(); lc != nil {
+			agg, emailMap = lc.restore(run)
+		}
+	}
+	if agg == nil {
+		var sp *spiller
+		if memLimit > 0 {
+			if sp, err = newSpiller(memLimit); err != nil {
+				return fmt.Errorf("failed to create spill directory: %w", err)
+			}
+			defer sp.Close()
+		}
+		if agg, emailMap, err = loadStage(db, p, run, sp); err != nil {
+			return err
+		}
+		if agg.spill != nil {
+			// the customers are merged and sorted on disk (see spill.go)
+			return runSpilled(db, p, run, agg, emailMap)
+		}
+		ck.saveLoaded(agg, emailMap, run)
+	}
+	caMap := agg.ca
 	log.WithField("customers_with_ca", len(caMap)).Info("computed CA per customer")
+	run.NbCustomers = len(caMap)
 
 	// Debug: Log CA for specific customers mentioned in the issue
 	if log.IsLevelEnabled(log.DebugLevel) {
 		testCustomers := []int64{46, 114, 237, 417, 10, 933, 836}
 		for _, cid := range testCustomers {
 			if ca, ok := caMap[cid]; ok {
-				log.Debugf("Customer %d CA: %.2f", cid, ca)
+				log.Debugf("Customer %d CA: %s", cid, ca)
 			}
 		}
 	}
@@ -497,43 +1668,74 @@ func main() {
 	// print 10 samples
 	printRandomSamples(caMap, 10)
 
-	// sorted slice
-	sorted := mapToSortedSlice(caMap, emailMap)
+	if cohorts {
+		if err := runCohorts(db, p, run, agg.cohorts.matrix()); err != nil {
+			return err
+		}
+	}
 
-	// quantiles
-	qStats, top := computeQuantiles(sorted, quantile)
-	if qStats == nil {
-		log.Warn("no quantile stats (no customers)")
-	} else {
-		log.Info("========== QUANTILE ANALYSIS ==========")
-		for i := 0; i < len(qStats); i++ {
-			s := qStats[i]
-			startPct := float64(i) * quantile * 100
-			endPct := float64(i+1) * quantile * 100
+	if modeStr == modeRFM {
+		// recency is measured at the end of the period, or today when open-ended
+		ref := p.Until
+		if ref.IsZero() {
+			ref = run.StartedAt
+		}
+		return runRFM(db, p, run, agg.customers(emailMap, metricCA), rfmRules, ref)
+	}
 
-			log.WithFields(log.Fields{
-				"quantile_index": i,
-				"quantile_range": fmt.Sprintf("%.1f%% - %.1f%%", startPct, endPct),
-				"nb_clients":     s.NbClients,
-				"min_ca":         fmt.Sprintf("%.2f", s.MinCA),
-				"max_ca":         fmt.Sprintf("%.2f", s.MaxCA),
-				"avg_ca":         fmt.Sprintf("%.2f", (s.MinCA+s.MaxCA)/2),
-			}).Info("quantile summary")
+	// quantiles: exact on every customer sorted, or with -sketch approximate
+	// thresholds and only the top quantile in memory (see sketch.go)
+	var (
+		sorted []CustomerCA
+		qStats map[int]QuantileStats
+		top    []CustomerCA
+	)
+	if buckets.Sketch > 0 {
+		var info sketchInfo
+		qStats, top, info = sketchQuantiles(func(fn func(CustomerCA)) { agg.each(emailMap, fn) }, buckets)
+		logSketch(info, buckets)
+	} else {
+		// sorted slice, with the metrics tracked in the same pass as the CA
+		sorted = agg.customers(emailMap, rankBy)
+		qStats, top = computeQuantiles(sorted, buckets)
+	}
+	logQuantiles(qStats, buckets, len(top))
+	run.Thresholds = quantileThresholds(qStats)
+
+	// EXPORT (top quantile = first len(top) ranked customers)
+	var ranked []RankedCustomer
+	if buckets.Sketch > 0 {
+		// the concentration needs every customer
+		log.Info("revenue concentration skipped with -sketch")
+		ranked = rankTop(top, len(caMap))
+	} else {
+		run.Concentration = concentration(sorted)
+		logConcentration(run.Concentration)
+		ranked = rankCustomers(sorted, buckets)
+		if products {
+			if err := runProducts(db, p, run, agg.products.breakdown(ranked)); err != nil {
+				return err
+			}
+		}
+		if exportStr == exportTop {
+			ranked = ranked[:len(top)]
 		}
-		log.Info("=======================================")
-		log.WithField("top_quantile_size", len(top)).Info("top quantile extracted")
 	}
+	ck.saveQuantiles(run, qStats, ranked)
+	return exportStage(db, p, run, ranked)
+}
 
-	// EXPORT
+// exportStage exports the ranked customers to the table of the day
+func exportStage(db *sql.DB, p period, run *runRecord, ranked []RankedCustomer) error {
 	dateSuffix := time.Now().Format("20060102")
-	tableName := fmt.Sprintf("test_export_%s", dateSuffix)
-	if err := ensureExportTable(db, tableName); err != nil {
-		log.Fatalf("failed to ensure export table: %v", err)
+	tableName := fmt.Sprintf("test_export_%s%s", dateSuffix, p.tableSuffix())
+	if db == nil {
+		log.WithField("table", tableName).Warn("no database configured; export skipped")
+		return nil
 	}
-	if err := exportTopCustomers(db, tableName, top); err != nil {
-		log.Fatalf("failed to export top customers: %v", err)
+	if err := exportAtomic(db, tableName, ranked, run.ID); err != nil {
+		return fmt.Errorf("failed to export customers: %w", err)
 	}
-
-	elapsed := time.Since(start)
-	log.WithField("duration", elapsed.String()).Info("process finished")
+	run.ExportTable = tableName
+	return nil
 }
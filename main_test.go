@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"io"
 	"math"
 	"testing"
@@ -20,18 +21,18 @@ func init() {
 func TestBuildPriceMap(t *testing.T) {
 	t.Run("single price per content", func(t *testing.T) {
 		prices := []ContentPriceRow{
-			{ContentPriceID: 1, ContentID: 1, Price: 10.0, InsertDate: time.Now()},
-			{ContentPriceID: 2, ContentID: 2, Price: 20.0, InsertDate: time.Now()},
+			{ContentPriceID: 1, ContentID: 1, Price: mustParseMoney("10.00"), InsertDate: time.Now()},
+			{ContentPriceID: 2, ContentID: 2, Price: mustParseMoney("20.00"), InsertDate: time.Now()},
 		}
 		result := buildPriceMap(prices)
 
 		if len(result) != 2 {
 			t.Errorf("expected 2 prices, got %d", len(result))
 		}
-		if result[1] != 10.0 {
+		if result[1] != mustParseMoney("10.00") {
 			t.Errorf("ContentID 1: expected 10.0, got %v", result[1])
 		}
-		if result[2] != 20.0 {
+		if result[2] != mustParseMoney("20.00") {
 			t.Errorf("ContentID 2: expected 20.0, got %v", result[2])
 		}
 	})
@@ -39,16 +40,16 @@ func TestBuildPriceMap(t *testing.T) {
 	t.Run("multiple prices - keeps latest InsertDate", func(t *testing.T) {
 		now := time.Now()
 		prices := []ContentPriceRow{
-			{ContentID: 1, Price: 10.0, InsertDate: now.Add(-24 * time.Hour)},
-			{ContentID: 1, Price: 15.0, InsertDate: now},
-			{ContentID: 1, Price: 12.0, InsertDate: now.Add(-48 * time.Hour)},
+			{ContentID: 1, Price: mustParseMoney("10.00"), InsertDate: now.Add(-24 * time.Hour)},
+			{ContentID: 1, Price: mustParseMoney("15.00"), InsertDate: now},
+			{ContentID: 1, Price: mustParseMoney("12.00"), InsertDate: now.Add(-48 * time.Hour)},
 		}
 		result := buildPriceMap(prices)
 
 		if len(result) != 1 {
 			t.Errorf("expected 1 content, got %d", len(result))
 		}
-		if result[1] != 15.0 {
+		if result[1] != mustParseMoney("15.00") {
 			t.Errorf("expected latest price 15.0, got %v", result[1])
 		}
 	})
@@ -61,6 +62,43 @@ func TestBuildPriceMap(t *testing.T) {
 	})
 }
 
+// -------------------- Tests pour buildPriceIndex --------------------
+
+func TestPriceIndexPriceAt(t *testing.T) {
+	d := func(s string) time.Time { return mustParseDate(s) }
+	idx := buildPriceIndex([]ContentPriceRow{
+		{ContentID: 1, Price: mustParseMoney("12.00"), InsertDate: d("2021-01-01")},
+		{ContentID: 1, Price: mustParseMoney("10.00"), InsertDate: d("2020-01-01")},
+		{ContentID: 1, Price: mustParseMoney("15.00"), InsertDate: d("2022-01-01")},
+	})
+
+	tests := []struct {
+		name      string
+		contentID int
+		at        time.Time
+		wantPrice string
+		wantKnown bool
+		wantOK    bool
+	}{
+		{"before first price", 1, d("2019-06-01"), "0", true, false},
+		{"exactly at insert date", 1, d("2020-01-01"), "10.00", true, true},
+		{"between two prices", 1, d("2021-06-15"), "12.00", true, true},
+		{"after last price", 1, d("2023-03-01"), "15.00", true, true},
+		{"unknown content", 2, d("2021-06-15"), "0", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, known, ok := idx.priceAt(tt.contentID, tt.at)
+			if known != tt.wantKnown || ok != tt.wantOK {
+				t.Fatalf("known/ok: got %v/%v, want %v/%v", known, ok, tt.wantKnown, tt.wantOK)
+			}
+			if want := mustParseMoney(tt.wantPrice); p.Price != want {
+				t.Errorf("price: got %s, want %s", p.Price, want)
+			}
+		})
+	}
+}
+
 // -------------------- Tests pour buildEmailMap --------------------
 
 func TestBuildEmailMap(t *testing.T) {
@@ -114,9 +152,9 @@ func TestComputeCA(t *testing.T) {
 			{EventDataID: 3, ContentID: 10, CustomerID: 101, Quantity: 1},
 		}
 
-		priceMap := map[int]float64{
-			10: 9.99,
-			11: 5.00,
+		priceMap := map[int]Money{
+			10: mustParseMoney("9.99"),
+			11: mustParseMoney("5.00"),
 		}
 
 		ca := computeCA(events, priceMap)
@@ -125,14 +163,14 @@ func TestComputeCA(t *testing.T) {
 			t.Fatalf("expected 2 customers, got %d", len(ca))
 		}
 
-		wantCustomer100 := 2*9.99 + 1*5.00
-		if !floatEqual(ca[100], wantCustomer100, 0.001) {
-			t.Errorf("customer 100 CA: got %.2f, want %.2f", ca[100], wantCustomer100)
+		wantCustomer100 := mustParseMoney("24.98") // 2*9.99 + 1*5.00
+		if ca[100] != wantCustomer100 {
+			t.Errorf("customer 100 CA: got %s, want %s", ca[100], wantCustomer100)
 		}
 
-		wantCustomer101 := 9.99
-		if !floatEqual(ca[101], wantCustomer101, 0.001) {
-			t.Errorf("customer 101 CA: got %.2f, want %.2f", ca[101], wantCustomer101)
+		wantCustomer101 := mustParseMoney("9.99")
+		if ca[101] != wantCustomer101 {
+			t.Errorf("customer 101 CA: got %s, want %s", ca[101], wantCustomer101)
 		}
 	})
 
@@ -142,15 +180,15 @@ func TestComputeCA(t *testing.T) {
 			{EventDataID: 2, ContentID: 99, CustomerID: 100, Quantity: 5},
 		}
 
-		priceMap := map[int]float64{
-			10: 10.0,
+		priceMap := map[int]Money{
+			10: mustParseMoney("10.00"),
 		}
 
 		ca := computeCA(events, priceMap)
 
-		want := 2 * 10.0
-		if !floatEqual(ca[100], want, 0.001) {
-			t.Errorf("customer 100 CA: got %.2f, want %.2f (missing price should be ignored)", ca[100], want)
+		want := mustParseMoney("20.00")
+		if ca[100] != want {
+			t.Errorf("customer 100 CA: got %s, want %s (missing price should be ignored)", ca[100], want)
 		}
 	})
 
@@ -161,16 +199,16 @@ func TestComputeCA(t *testing.T) {
 			{ContentID: 11, CustomerID: 100, Quantity: 1},
 		}
 
-		priceMap := map[int]float64{
-			10: 10.0,
-			11: 5.0,
+		priceMap := map[int]Money{
+			10: mustParseMoney("10.00"),
+			11: mustParseMoney("5.00"),
 		}
 
 		ca := computeCA(events, priceMap)
 
-		want := 1*10.0 + 2*10.0 + 1*5.0
-		if !floatEqual(ca[100], want, 0.001) {
-			t.Errorf("customer 100 CA: got %.2f, want %.2f", ca[100], want)
+		want := mustParseMoney("35.00") // 1*10 + 2*10 + 1*5
+		if ca[100] != want {
+			t.Errorf("customer 100 CA: got %s, want %s", ca[100], want)
 		}
 	})
 
@@ -179,19 +217,19 @@ func TestComputeCA(t *testing.T) {
 			{ContentID: 10, CustomerID: 100, Quantity: 0},
 		}
 
-		priceMap := map[int]float64{
-			10: 10.0,
+		priceMap := map[int]Money{
+			10: mustParseMoney("10.00"),
 		}
 
 		ca := computeCA(events, priceMap)
 
-		if ca[100] != 0.0 {
-			t.Errorf("customer 100 CA: got %.2f, want 0.0", ca[100])
+		if ca[100] != 0 {
+			t.Errorf("customer 100 CA: got %s, want 0.00", ca[100])
 		}
 	})
 
 	t.Run("empty events", func(t *testing.T) {
-		ca := computeCA([]EventRow{}, map[int]float64{10: 10.0})
+		ca := computeCA([]EventRow{}, map[int]Money{10: mustParseMoney("10.00")})
 		if len(ca) != 0 {
 			t.Errorf("expected empty CA map, got %d entries", len(ca))
 		}
@@ -201,7 +239,7 @@ func TestComputeCA(t *testing.T) {
 		events := []EventRow{
 			{ContentID: 10, CustomerID: 100, Quantity: 1},
 		}
-		ca := computeCA(events, map[int]float64{})
+		ca := computeCA(events, map[int]Money{})
 
 		if len(ca) != 0 {
 			t.Errorf("expected empty CA map (all prices missing), got %d entries", len(ca))
@@ -209,14 +247,141 @@ func TestComputeCA(t *testing.T) {
 	})
 }
 
+// -------------------- Tests pour computeCAAsOf --------------------
+
+func TestComputeCAAsOf(t *testing.T) {
+	d := func(s string) time.Time { return mustParseDate(s) }
+	idx := buildPriceIndex([]ContentPriceRow{
+		{ContentID: 10, Price: mustParseMoney("10.00"), InsertDate: d("2020-01-01")},
+		{ContentID: 10, Price: mustParseMoney("20.00"), InsertDate: d("2021-01-01")},
+	})
+
+	t.Run("values events at price effective on EventDate", func(t *testing.T) {
+		events := []EventRow{
+			{ContentID: 10, CustomerID: 100, Quantity: 1, EventDate: d("2020-06-01")},
+			{ContentID: 10, CustomerID: 100, Quantity: 2, EventDate: d("2021-06-01")},
+		}
+		ca := computeCAAsOf(events, idx)
+
+		want := mustParseMoney("50.00") // 1*10 + 2*20
+		if ca[100] != want {
+			t.Errorf("customer 100 CA: got %s, want %s", ca[100], want)
+		}
+	})
+
+	t.Run("events predating any price are skipped and reported", func(t *testing.T) {
+		events := []EventRow{
+			{ContentID: 10, CustomerID: 100, Quantity: 1, EventDate: d("2019-06-01")},
+			{ContentID: 10, CustomerID: 100, Quantity: 1, EventDate: d("2020-06-01")},
+			{ContentID: 99, CustomerID: 101, Quantity: 1, EventDate: d("2020-06-01")},
+		}
+		agg := newAsOfCAAggregator(idx)
+		for _, e := range events {
+			agg.add(e)
+		}
+		ca := agg.result()
+
+		if ca[100] != mustParseMoney("10.00") {
+			t.Errorf("customer 100 CA: got %s, want 10.00", ca[100])
+		}
+		if agg.predatingPrices[10] != 1 {
+			t.Errorf("expected 1 predating event for ContentID 10, got %d", agg.predatingPrices[10])
+		}
+		if agg.missingPrices[99] != 1 {
+			t.Errorf("expected 1 missing price event for ContentID 99, got %d", agg.missingPrices[99])
+		}
+	})
+}
+
+// -------------------- Tests pour caAggregator --------------------
+
+// chunkedSource serves events in chunks of chunkSize through a reused slice,
+// as streamEvents does, and records the size of every chunk
+type chunkedSource struct {
+	events []EventRow
+	chunks []int
+}
+
+func (s *chunkedSource) StreamEvents(ctx context.Context, p period, types []int, chunkSize int, fn func([]EventRow) error) error {
+	chunk := make([]EventRow, 0, chunkSize)
+	for i := 0; i < len(s.events); i += chunkSize {
+		end := i + chunkSize
+		if end > len(s.events) {
+			end = len(s.events)
+		}
+		chunk = append(chunk[:0], s.events[i:end]...)
+		s.chunks = append(s.chunks, len(chunk))
+		if err := fn(chunk); err != nil {
+			return err
+		}
+		// the caller must not keep the chunk: overwrite it before the next one
+		for j := range chunk {
+			chunk[j] = EventRow{}
+		}
+	}
+	return nil
+}
+
+func (s *chunkedSource) ContentPrices(ctx context.Context) ([]ContentPriceRow, error) {
+	return nil, nil
+}
+
+func (s *chunkedSource) CustomerEmails(ctx context.Context) ([]CustomerDataRow, error) {
+	return nil, nil
+}
+
+func (s *chunkedSource) Close() error { return nil }
+
+func TestCAAggregatorChunked(t *testing.T) {
+	events := []EventRow{
+		{EventDataID: 1, ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 2},
+		{EventDataID: 2, ContentID: 11, CustomerID: 101, EventTypeID: 6, Quantity: 1},
+		{EventDataID: 3, ContentID: 99, CustomerID: 100, EventTypeID: 6, Quantity: 4},
+		{EventDataID: 4, ContentID: 11, CustomerID: 100, EventTypeID: 6, Quantity: 3},
+		{EventDataID: 5, ContentID: 10, CustomerID: 102, EventTypeID: 6, Quantity: 1},
+	}
+	priceMap := map[int]Money{10: mustParseMoney("9.99"), 11: mustParseMoney("5.00")}
+
+	want := computeCA(events, priceMap)
+
+	// stream the same events in chunks of 2 through streamCA
+	defer func(n int) { chunkSize = n }(chunkSize)
+	chunkSize = 2
+	src := &chunkedSource{events: events}
+	agg := newCAAggregator(priceMap)
+	got, err := streamCA(context.Background(), src, period{}, defaultEventTypes, agg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalInts(src.chunks, []int{2, 2, 1}) {
+		t.Fatalf("expected chunks of [2 2 1], got %v", src.chunks)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d customers, got %d", len(want), len(got))
+	}
+	for cid, v := range want {
+		if got[cid] != v {
+			t.Errorf("customer %d CA: got %s, want %s", cid, got[cid], v)
+		}
+	}
+	if agg.missingPrices[99] != 1 {
+		t.Errorf("expected 1 missing price event for ContentID 99, got %d", agg.missingPrices[99])
+	}
+	// the unpriced event still counts in the metrics of customer 100
+	if m := agg.metrics.counts[100]; m == nil || m.Quantity != 9 || m.Purchases != 3 {
+		t.Errorf("customer 100 metrics: got %+v, want quantity 9 over 3 purchases", m)
+	}
+}
+
 // -------------------- Tests pour mapToSortedSlice --------------------
 
 func TestMapToSortedSlice(t *testing.T) {
 	t.Run("sorts descending by CA", func(t *testing.T) {
-		caMap := map[int64]float64{
-			100: 50.0,
-			101: 100.0,
-			102: 25.0,
+		caMap := map[int64]Money{
+			100: mustParseMoney("50.00"),
+			101: mustParseMoney("100.00"),
+			102: mustParseMoney("25.00"),
 		}
 		emailMap := map[int64]string{
 			100: "user100@test.com",
@@ -230,22 +395,22 @@ func TestMapToSortedSlice(t *testing.T) {
 			t.Fatalf("expected 3 customers, got %d", len(result))
 		}
 
-		if result[0].CustomerID != 101 || !floatEqual(result[0].CA, 100.0, 0.001) {
-			t.Errorf("position 0: expected CustomerID=101 CA=100.0, got CustomerID=%d CA=%.2f",
+		if result[0].CustomerID != 101 || result[0].CA != mustParseMoney("100.00") {
+			t.Errorf("position 0: expected CustomerID=101 CA=100.00, got CustomerID=%d CA=%s",
 				result[0].CustomerID, result[0].CA)
 		}
-		if result[1].CustomerID != 100 || !floatEqual(result[1].CA, 50.0, 0.001) {
-			t.Errorf("position 1: expected CustomerID=100 CA=50.0, got CustomerID=%d CA=%.2f",
+		if result[1].CustomerID != 100 || result[1].CA != mustParseMoney("50.00") {
+			t.Errorf("position 1: expected CustomerID=100 CA=50.00, got CustomerID=%d CA=%s",
 				result[1].CustomerID, result[1].CA)
 		}
-		if result[2].CustomerID != 102 || !floatEqual(result[2].CA, 25.0, 0.001) {
-			t.Errorf("position 2: expected CustomerID=102 CA=25.0, got CustomerID=%d CA=%.2f",
+		if result[2].CustomerID != 102 || result[2].CA != mustParseMoney("25.00") {
+			t.Errorf("position 2: expected CustomerID=102 CA=25.00, got CustomerID=%d CA=%s",
 				result[2].CustomerID, result[2].CA)
 		}
 	})
 
 	t.Run("includes emails", func(t *testing.T) {
-		caMap := map[int64]float64{100: 50.0}
+		caMap := map[int64]Money{100: mustParseMoney("50.00")}
 		emailMap := map[int64]string{100: "test@example.com"}
 
 		result := mapToSortedSlice(caMap, emailMap)
@@ -256,7 +421,7 @@ func TestMapToSortedSlice(t *testing.T) {
 	})
 
 	t.Run("missing email", func(t *testing.T) {
-		caMap := map[int64]float64{100: 50.0}
+		caMap := map[int64]Money{100: mustParseMoney("50.00")}
 		emailMap := map[int64]string{}
 
 		result := mapToSortedSlice(caMap, emailMap)
@@ -267,7 +432,7 @@ func TestMapToSortedSlice(t *testing.T) {
 	})
 
 	t.Run("empty input", func(t *testing.T) {
-		result := mapToSortedSlice(map[int64]float64{}, map[int64]string{})
+		result := mapToSortedSlice(map[int64]Money{}, map[int64]string{})
 		if len(result) != 0 {
 			t.Errorf("expected empty slice, got %d entries", len(result))
 		}
@@ -279,19 +444,19 @@ func TestMapToSortedSlice(t *testing.T) {
 func TestComputeQuantiles(t *testing.T) {
 	t.Run("basic quantile calculation", func(t *testing.T) {
 		sorted := []CustomerCA{
-			{CustomerID: 100, CA: 100.0},
-			{CustomerID: 101, CA: 90.0},
-			{CustomerID: 102, CA: 80.0},
-			{CustomerID: 103, CA: 70.0},
-			{CustomerID: 104, CA: 60.0},
-			{CustomerID: 105, CA: 50.0},
-			{CustomerID: 106, CA: 40.0},
-			{CustomerID: 107, CA: 30.0},
-			{CustomerID: 108, CA: 20.0},
-			{CustomerID: 109, CA: 10.0},
+			{CustomerID: 100, CA: mustParseMoney("100.00")},
+			{CustomerID: 101, CA: mustParseMoney("90.00")},
+			{CustomerID: 102, CA: mustParseMoney("80.00")},
+			{CustomerID: 103, CA: mustParseMoney("70.00")},
+			{CustomerID: 104, CA: mustParseMoney("60.00")},
+			{CustomerID: 105, CA: mustParseMoney("50.00")},
+			{CustomerID: 106, CA: mustParseMoney("40.00")},
+			{CustomerID: 107, CA: mustParseMoney("30.00")},
+			{CustomerID: 108, CA: mustParseMoney("20.00")},
+			{CustomerID: 109, CA: mustParseMoney("10.00")},
 		}
 
-		qStats, top := computeQuantiles(sorted, 0.25)
+		qStats, top := computeQuantiles(sorted, equalCount(0.25, tiesSplit))
 
 		if len(qStats) != 4 {
 			t.Errorf("expected 4 quantiles, got %d", len(qStats))
@@ -300,11 +465,11 @@ func TestComputeQuantiles(t *testing.T) {
 		if qStats[0].NbClients != 3 {
 			t.Errorf("quantile 0: expected 3 clients, got %d", qStats[0].NbClients)
 		}
-		if !floatEqual(qStats[0].MaxCA, 100.0, 0.001) {
-			t.Errorf("quantile 0 MaxCA: expected 100.0, got %.2f", qStats[0].MaxCA)
+		if qStats[0].MaxCA != mustParseMoney("100.00") {
+			t.Errorf("quantile 0 MaxCA: expected 100.00, got %s", qStats[0].MaxCA)
 		}
-		if !floatEqual(qStats[0].MinCA, 80.0, 0.001) {
-			t.Errorf("quantile 0 MinCA: expected 80.0, got %.2f", qStats[0].MinCA)
+		if qStats[0].MinCA != mustParseMoney("80.00") {
+			t.Errorf("quantile 0 MinCA: expected 80.00, got %s", qStats[0].MinCA)
 		}
 
 		if len(top) != 3 {
@@ -320,11 +485,11 @@ func TestComputeQuantiles(t *testing.T) {
 		for i := 0; i < 100; i++ {
 			sorted[i] = CustomerCA{
 				CustomerID: int64(i),
-				CA:         float64(100 - i),
+				CA:         Money(100-i) * centsPerUnit,
 			}
 		}
 
-		qStats, top := computeQuantiles(sorted, 0.025)
+		qStats, top := computeQuantiles(sorted, equalCount(0.025, tiesSplit))
 
 		if len(qStats) != 40 {
 			t.Errorf("expected 40 quantiles, got %d", len(qStats))
@@ -337,14 +502,14 @@ func TestComputeQuantiles(t *testing.T) {
 		if len(top) != 3 {
 			t.Errorf("expected 3 top customers, got %d", len(top))
 		}
-		if !floatEqual(top[0].CA, 100.0, 0.001) {
-			t.Errorf("top customer CA: expected 100.0, got %.2f", top[0].CA)
+		if top[0].CA != mustParseMoney("100.00") {
+			t.Errorf("top customer CA: expected 100.00, got %s", top[0].CA)
 		}
 	})
 
 	t.Run("single customer", func(t *testing.T) {
-		sorted := []CustomerCA{{CustomerID: 100, CA: 50.0}}
-		qStats, top := computeQuantiles(sorted, 0.5)
+		sorted := []CustomerCA{{CustomerID: 100, CA: mustParseMoney("50.00")}}
+		qStats, top := computeQuantiles(sorted, equalCount(0.5, tiesSplit))
 
 		if len(qStats) != 2 {
 			t.Errorf("expected 2 quantiles, got %d", len(qStats))
@@ -355,7 +520,7 @@ func TestComputeQuantiles(t *testing.T) {
 	})
 
 	t.Run("empty input", func(t *testing.T) {
-		qStats, top := computeQuantiles([]CustomerCA{}, 0.25)
+		qStats, top := computeQuantiles([]CustomerCA{}, equalCount(0.25, tiesSplit))
 		if qStats != nil {
 			t.Errorf("expected nil qStats, got %d entries", len(qStats))
 		}
@@ -366,13 +531,13 @@ func TestComputeQuantiles(t *testing.T) {
 
 	t.Run("quantile edge case - exact division", func(t *testing.T) {
 		sorted := []CustomerCA{
-			{CustomerID: 100, CA: 100.0},
-			{CustomerID: 101, CA: 80.0},
-			{CustomerID: 102, CA: 60.0},
-			{CustomerID: 103, CA: 40.0},
+			{CustomerID: 100, CA: mustParseMoney("100.00")},
+			{CustomerID: 101, CA: mustParseMoney("80.00")},
+			{CustomerID: 102, CA: mustParseMoney("60.00")},
+			{CustomerID: 103, CA: mustParseMoney("40.00")},
 		}
 
-		qStats, top := computeQuantiles(sorted, 0.5)
+		qStats, top := computeQuantiles(sorted, equalCount(0.5, tiesSplit))
 
 		if len(qStats) != 2 {
 			t.Errorf("expected 2 quantiles, got %d", len(qStats))
@@ -389,8 +554,243 @@ func TestComputeQuantiles(t *testing.T) {
 	})
 }
 
+// -------------------- Tests pour bucketStats --------------------
+
+func TestQuantileStatsAggregates(t *testing.T) {
+	// CA: 100, 90, 80 | 70, 60, 50 | 40, 30, 20 | 10 -> total 550
+	sorted := make([]CustomerCA, 10)
+	for i := range sorted {
+		sorted[i] = CustomerCA{CustomerID: int64(100 + i), CA: Money(100-10*i) * centsPerUnit}
+	}
+	qStats, _ := computeQuantiles(sorted, equalCount(0.25, tiesSplit))
+
+	t.Run("odd bucket", func(t *testing.T) {
+		s := qStats[0]
+		if s.TotalCA != mustParseMoney("270.00") {
+			t.Errorf("TotalCA: expected 270.00, got %s", s.TotalCA)
+		}
+		if !floatEqual(s.MeanCA, 90.0, 0.001) {
+			t.Errorf("MeanCA: expected 90, got %.2f", s.MeanCA)
+		}
+		if !floatEqual(s.MedianCA, 90.0, 0.001) {
+			t.Errorf("MedianCA: expected 90, got %.2f", s.MedianCA)
+		}
+		// population stddev of 100, 90, 80 = sqrt(200/3)
+		if !floatEqual(s.StdDevCA, math.Sqrt(200.0/3), 0.0001) {
+			t.Errorf("StdDevCA: expected %.4f, got %.4f", math.Sqrt(200.0/3), s.StdDevCA)
+		}
+		if !floatEqual(s.RevenueShare, 270.0/550.0, 0.0001) {
+			t.Errorf("RevenueShare: expected %.4f, got %.4f", 270.0/550.0, s.RevenueShare)
+		}
+	})
+
+	t.Run("single customer bucket", func(t *testing.T) {
+		s := qStats[3]
+		if s.NbClients != 1 || !floatEqual(s.MeanCA, 10.0, 0.001) || !floatEqual(s.MedianCA, 10.0, 0.001) || s.StdDevCA != 0 {
+			t.Errorf("unexpected stats %+v", s)
+		}
+	})
+
+	t.Run("shares sum to one", func(t *testing.T) {
+		total := 0.0
+		for _, s := range qStats {
+			total += s.RevenueShare
+		}
+		if !floatEqual(total, 1.0, 0.0001) {
+			t.Errorf("expected shares to sum to 1, got %.4f", total)
+		}
+	})
+
+	t.Run("even bucket median and skewed mean", func(t *testing.T) {
+		s := bucketStats([]CustomerCA{{CA: 100000}, {CA: 3000}, {CA: 2000}, {CA: 1000}}, 106000, metricCA)
+		if !floatEqual(s.MedianCA, 25.0, 0.001) {
+			t.Errorf("MedianCA: expected 25, got %.2f", s.MedianCA)
+		}
+		if !floatEqual(s.MeanCA, 265.0, 0.001) {
+			t.Errorf("MeanCA: expected 265 (not (min+max)/2 = 505), got %.2f", s.MeanCA)
+		}
+	})
+
+	t.Run("zero revenue", func(t *testing.T) {
+		s := bucketStats([]CustomerCA{{CA: 0}, {CA: 0}}, 0, metricCA)
+		if s.RevenueShare != 0 || s.MeanCA != 0 {
+			t.Errorf("unexpected stats %+v", s)
+		}
+	})
+}
+
+// -------------------- Tests pour rankCustomers --------------------
+
+func TestRankCustomers(t *testing.T) {
+	t.Run("matches computeQuantiles buckets", func(t *testing.T) {
+		sorted := make([]CustomerCA, 10)
+		for i := range sorted {
+			sorted[i] = CustomerCA{CustomerID: int64(100 + i), CA: Money(100-10*i) * centsPerUnit}
+		}
+
+		qStats, top := computeQuantiles(sorted, equalCount(0.25, tiesSplit))
+		ranked := rankCustomers(sorted, equalCount(0.25, tiesSplit))
+
+		if len(ranked) != len(sorted) {
+			t.Fatalf("expected %d ranked customers, got %d", len(sorted), len(ranked))
+		}
+		counts := make(map[int]int)
+		for _, r := range ranked {
+			counts[r.Quantile]++
+		}
+		for i, s := range qStats {
+			if counts[i] != s.NbClients {
+				t.Errorf("quantile %d: %d ranked customers, stats say %d", i, counts[i], s.NbClients)
+			}
+		}
+		for i := range top {
+			if ranked[i].Quantile != 0 || ranked[i].CustomerID != top[i].CustomerID {
+				t.Errorf("ranked[%d] should be top customer %d in quantile 0, got %+v", i, top[i].CustomerID, ranked[i])
+			}
+		}
+	})
+
+	t.Run("rank and percentile", func(t *testing.T) {
+		sorted := []CustomerCA{
+			{CustomerID: 100, CA: mustParseMoney("100.00")},
+			{CustomerID: 101, CA: mustParseMoney("80.00")},
+			{CustomerID: 102, CA: mustParseMoney("60.00")},
+			{CustomerID: 103, CA: mustParseMoney("40.00")},
+		}
+		ranked := rankCustomers(sorted, equalCount(0.5, tiesSplit))
+
+		if ranked[0].Rank != 1 || ranked[3].Rank != 4 {
+			t.Errorf("expected ranks 1..4, got %d..%d", ranked[0].Rank, ranked[3].Rank)
+		}
+		if ranked[1].Quantile != 0 || ranked[2].Quantile != 1 {
+			t.Errorf("expected quantiles 0 then 1, got %d and %d", ranked[1].Quantile, ranked[2].Quantile)
+		}
+		if !floatEqual(ranked[1].Percentile, 50.0, 0.001) || !floatEqual(ranked[3].Percentile, 100.0, 0.001) {
+			t.Errorf("unexpected percentiles %.2f, %.2f", ranked[1].Percentile, ranked[3].Percentile)
+		}
+	})
+
+	t.Run("empty input", func(t *testing.T) {
+		if ranked := rankCustomers(nil, equalCount(0.25, tiesSplit)); ranked != nil {
+			t.Errorf("expected nil, got %d entries", len(ranked))
+		}
+	})
+}
+
+// -------------------- Tests pour la gestion des ex aequo --------------------
+
+func TestTieHandling(t *testing.T) {
+	// 100 | 50 50 50 | 10 10 : ties across the 2nd and 3rd cut with 3 buckets of 2
+	caMap := map[int64]Money{
+		7: 10000,
+		5: 5000, 3: 5000, 9: 5000,
+		2: 1000, 8: 1000,
+	}
+
+	t.Run("ordering is CA desc then CustomerID", func(t *testing.T) {
+		want := []int64{7, 3, 5, 9, 2, 8}
+		for run := 0; run < 20; run++ {
+			sorted := mapToSortedSlice(caMap, nil)
+			for i, id := range want {
+				if sorted[i].CustomerID != id {
+					t.Fatalf("run %d: position %d: got CustomerID %d, want %d", run, i, sorted[i].CustomerID, id)
+				}
+			}
+		}
+	})
+
+	sorted := mapToSortedSlice(caMap, nil)
+	quantileOf := func(ranked []RankedCustomer) map[int64]int {
+		out := make(map[int64]int, len(ranked))
+		for _, r := range ranked {
+			out[r.CustomerID] = r.Quantile
+		}
+		return out
+	}
+
+	t.Run("split cuts at the bucket size", func(t *testing.T) {
+		ends := quantileBounds(sorted, 1.0/3, tiesSplit, metricCA)
+		if len(ends) != 3 || ends[0] != 2 || ends[1] != 4 || ends[2] != 6 {
+			t.Fatalf("unexpected bounds %v", ends)
+		}
+		q := quantileOf(rankCustomers(sorted, equalCount(1.0/3, tiesSplit)))
+		if q[3] != 0 || q[5] != 1 || q[9] != 1 {
+			t.Errorf("expected tied customers split by CustomerID, got %v", q)
+		}
+	})
+
+	t.Run("keep-higher keeps ties in the higher bucket", func(t *testing.T) {
+		ends := quantileBounds(sorted, 1.0/3, tiesKeepHigher, metricCA)
+		// bucket 1 is already consumed by the ties; 2 and 8 stay at their nominal bucket
+		if len(ends) != 3 || ends[0] != 4 || ends[1] != 4 || ends[2] != 6 {
+			t.Fatalf("unexpected bounds %v", ends)
+		}
+		qStats, top := computeQuantiles(sorted, equalCount(1.0/3, tiesKeepHigher))
+		if len(top) != 4 {
+			t.Errorf("expected the 3 tied customers in the top bucket, got %d customers", len(top))
+		}
+		if qStats[0].NbClients != 4 || qStats[1].NbClients != 0 || qStats[2].NbClients != 2 {
+			t.Errorf("unexpected bucket sizes %d/%d/%d", qStats[0].NbClients, qStats[1].NbClients, qStats[2].NbClients)
+		}
+		q := quantileOf(rankCustomers(sorted, equalCount(1.0/3, tiesKeepHigher)))
+		if q[7] != 0 || q[3] != 0 || q[5] != 0 || q[9] != 0 || q[2] != 2 || q[8] != 2 {
+			t.Errorf("unexpected quantiles %v", q)
+		}
+	})
+
+	t.Run("keep-higher without ties matches split", func(t *testing.T) {
+		sorted := make([]CustomerCA, 10)
+		for i := range sorted {
+			sorted[i] = CustomerCA{CustomerID: int64(i), CA: Money(100-i) * centsPerUnit}
+		}
+		a := quantileBounds(sorted, 0.25, tiesSplit, metricCA)
+		b := quantileBounds(sorted, 0.25, tiesKeepHigher, metricCA)
+		for i := range a {
+			if a[i] != b[i] {
+				t.Errorf("bucket %d: split end %d, keep-higher end %d", i, a[i], b[i])
+			}
+		}
+	})
+}
+
+// -------------------- Tests pour swapStatements --------------------
+
+func TestSwapStatements(t *testing.T) {
+	t.Run("new table", func(t *testing.T) {
+		got, cleanup := swapStatements("test_export_20251004", "test_export_20251004_staging", false)
+		want := []string{"RENAME TABLE test_export_20251004_staging TO test_export_20251004"}
+		if len(got) != len(want) || got[0] != want[0] || cleanup != nil {
+			t.Errorf("got %q then %q, want %q", got, cleanup, want)
+		}
+	})
+
+	t.Run("existing table swapped in one RENAME", func(t *testing.T) {
+		got, cleanup := swapStatements("t", "t_staging", true)
+		want := []string{
+			"DROP TABLE IF EXISTS t_old",
+			"RENAME TABLE t TO t_old, t_staging TO t",
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("statement %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+		// dropping the replaced table comes after the swap and may fail
+		if len(cleanup) != 1 || cleanup[0] != "DROP TABLE t_old" {
+			t.Errorf("cleanup: got %q", cleanup)
+		}
+	})
+}
+
 // -------------------- Helper functions --------------------
 
+func equalCount(quantile float64, ties string) bucketSpec {
+	return bucketSpec{Method: methodEqualCount, Quantile: quantile, Ties: ties}
+}
+
 func floatEqual(a, b, epsilon float64) bool {
 	return math.Abs(a-b) < epsilon
 }
@@ -407,9 +807,9 @@ func BenchmarkComputeCA(b *testing.B) {
 		}
 	}
 
-	priceMap := make(map[int]float64)
+	priceMap := make(map[int]Money)
 	for i := 0; i < 100; i++ {
-		priceMap[i] = float64(i) * 1.5
+		priceMap[i] = Money(i) * 150
 	}
 
 	b.ResetTimer()
@@ -424,7 +824,7 @@ func BenchmarkBuildPriceMap(b *testing.B) {
 	for i := 0; i < 1000; i++ {
 		prices[i] = ContentPriceRow{
 			ContentID:  i % 100,
-			Price:      float64(i) * 1.5,
+			Price:      Money(i) * 150,
 			InsertDate: now.Add(time.Duration(i) * time.Second),
 		}
 	}
@@ -436,10 +836,10 @@ func BenchmarkBuildPriceMap(b *testing.B) {
 }
 
 func BenchmarkMapToSortedSlice(b *testing.B) {
-	caMap := make(map[int64]float64)
+	caMap := make(map[int64]Money)
 	emailMap := make(map[int64]string)
 	for i := 0; i < 1000; i++ {
-		caMap[int64(i)] = float64(i) * 2.5
+		caMap[int64(i)] = Money(i) * 250
 		emailMap[int64(i)] = "test@example.com"
 	}
 
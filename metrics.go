@@ -0,0 +1,180 @@
+// metrics.go
+//
+// Per-customer metrics computed in the same pass as the CA: purchase count,
+// distinct products, net quantity and active days. -rank-by picks the metric
+// that orders customers and drives the buckets; every metric is exported.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metrics accepted by -rank-by
+const (
+	metricCA         = "ca"          // net revenue
+	metricPurchases  = "purchases"   // number of purchase events
+	metricProducts   = "products"    // distinct ContentID purchased
+	metricQuantity   = "quantity"    // units purchased minus units refunded
+	metricActiveDays = "active-days" // distinct days with a purchase
+	metricRecency    = "recency"     // day of the last purchase, most recent first
+)
+
+var rankMetrics = []string{metricCA, metricPurchases, metricProducts, metricQuantity, metricActiveDays, metricRecency}
+
+func validMetric(m string) error {
+	for _, v := range rankMetrics {
+		if v == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid metric %q (expected %s)", m, strings.Join(rankMetrics, ", "))
+}
+
+// Metrics are the counters of a customer besides the CA
+type Metrics struct {
+	Purchases    int
+	Products     int
+	Quantity     int
+	ActiveDays   int
+	LastPurchase time.Time // zero without any purchase, valued or not
+}
+
+// dayNumber is the UTC calendar day of t, counted from the Unix epoch
+func dayNumber(t time.Time) int64 {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+// key returns the value of metric for the customer; "" is the CA
+func (c CustomerCA) key(metric string) int64 {
+	switch metric {
+	case metricPurchases:
+		return int64(c.Purchases)
+	case metricProducts:
+		return int64(c.Products)
+	case metricQuantity:
+		return int64(c.Quantity)
+	case metricActiveDays:
+		return int64(c.ActiveDays)
+	case metricRecency:
+		if c.LastPurchase.IsZero() {
+			return math.MinInt64
+		}
+		return dayNumber(c.LastPurchase)
+	}
+	return int64(c.CA)
+}
+
+// formatMetric renders a metric value: amounts with two decimals, days as
+// dates, counts as integers
+func formatMetric(metric string, v int64) string {
+	switch metric {
+	case metricCA, "":
+		return Money(v).String()
+	case metricRecency:
+		if v == math.MinInt64 {
+			return "-"
+		}
+		return time.Unix(v*86400, 0).UTC().Format("2006-01-02")
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// parseMetric reads a value of metric, e.g. a -thresholds entry
+func parseMetric(metric, s string) (int64, error) {
+	switch metric {
+	case metricCA, "":
+		m, err := parseMoney(s)
+		return int64(m), err
+	case metricRecency:
+		d, err := time.Parse("2006-01-02", strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s value %q (expected YYYY-MM-DD)", metric, s)
+		}
+		return dayNumber(d), nil
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q", metric, s)
+	}
+	return v, nil
+}
+
+// metricsTracker accumulates Metrics per customer, keeping the sets needed for
+// the distinct counts
+type metricsTracker struct {
+	counts   map[int64]*Metrics
+	products map[int64]map[int]struct{}
+	days     map[int64]map[int64]struct{}
+	size     int64 // estimated heap bytes of the state, checked by -memory-limit
+}
+
+func newMetricsTracker() *metricsTracker {
+	return &metricsTracker{
+		counts:   make(map[int64]*Metrics),
+		products: make(map[int64]map[int]struct{}),
+		days:     make(map[int64]map[int64]struct{}),
+	}
+}
+
+func (t *metricsTracker) get(customerID int64) *Metrics {
+	m, ok := t.counts[customerID]
+	if !ok {
+		m = &Metrics{}
+		t.size += customerStateBytes
+		t.counts[customerID] = m
+		t.products[customerID] = make(map[int]struct{})
+		t.days[customerID] = make(map[int64]struct{})
+	}
+	return m
+}
+
+// purchase records a purchase event, valued or not
+func (t *metricsTracker) purchase(e EventRow) {
+	m := t.get(e.CustomerID)
+	m.Purchases++
+	m.Quantity += e.Quantity
+	if _, ok := t.products[e.CustomerID][e.ContentID]; !ok {
+		t.products[e.CustomerID][e.ContentID] = struct{}{}
+		t.size += setEntryBytes
+		m.Products++
+	}
+	if e.EventDate.After(m.LastPurchase) {
+		m.LastPurchase = e.EventDate
+	}
+	day := dayNumber(e.EventDate)
+	if _, ok := t.days[e.CustomerID][day]; !ok {
+		t.days[e.CustomerID][day] = struct{}{}
+		t.size += setEntryBytes
+		m.ActiveDays++
+	}
+}
+
+// refund records a refund event of qty units, valued or not
+func (t *metricsTracker) refund(customerID int64, qty int) {
+	t.get(customerID).Quantity -= qty
+}
+
+// customers joins CA, metrics and emails into an unsorted slice
+func (t *metricsTracker) customers(caMap map[int64]Money, emailMap map[int64]string) []CustomerCA {
+	out := make([]CustomerCA, 0, len(caMap))
+	t.each(caMap, emailMap, func(c CustomerCA) { out = append(out, c) })
+	return out
+}
+
+// each calls fn with every customer of caMap, in no particular order, without
+// materialising them
+func (t *metricsTracker) each(caMap map[int64]Money, emailMap map[int64]string, fn func(CustomerCA)) {
+	for cid, ca := range caMap {
+		c := CustomerCA{CustomerID: cid, Email: emailMap[cid], CA: ca}
+		if m, ok := t.counts[cid]; ok {
+			c.Metrics = *m
+		}
+		fn(c)
+	}
+}
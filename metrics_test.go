@@ -0,0 +1,119 @@
+// metrics_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// -------------------- Tests pour metricsTracker --------------------
+
+func TestMetricsTracker(t *testing.T) {
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7}}
+	agg := newCAAggregator(map[int]Money{10: mustParseMoney("10.00"), 11: mustParseMoney("1.00")}).withEventTypes(et)
+	for _, e := range []EventRow{
+		{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2020-05-01").Add(2 * time.Hour)},
+		{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 2, EventDate: mustParseDate("2020-05-01").Add(20 * time.Hour)},
+		{ContentID: 11, CustomerID: 100, EventTypeID: 6, Quantity: 5, EventDate: mustParseDate("2020-05-03")},
+		{ContentID: 11, CustomerID: 100, EventTypeID: 7, Quantity: 2, EventDate: mustParseDate("2020-05-04")},
+		{ContentID: 11, CustomerID: 101, EventTypeID: 6, Quantity: 40, EventDate: mustParseDate("2020-05-02")},
+		{ContentID: 99, CustomerID: 102, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2020-05-02")}, // no price
+		{ContentID: 99, CustomerID: 101, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2020-05-06")}, // no price
+	} {
+		agg.add(e)
+	}
+	agg.result()
+
+	t.Run("counters", func(t *testing.T) {
+		got := agg.customers(map[int64]string{100: "a@x.com"}, metricCA)
+		if len(got) != 2 {
+			t.Fatalf("expected 2 customers, got %d", len(got))
+		}
+		c := got[1] // 101 ranks first with 40.00
+		// the refund is not a purchase: LastPurchase stays on 2020-05-03
+		want := Metrics{Purchases: 3, Products: 2, Quantity: 6, ActiveDays: 2, LastPurchase: mustParseDate("2020-05-03")}
+		if c.CustomerID != 100 || c.Email != "a@x.com" || c.Metrics != want {
+			t.Errorf("customer 100: got %+v, want %+v", c, want)
+		}
+		if c.CA != mustParseMoney("33.00") { // 3*10 + 5*1 - 2*1
+			t.Errorf("customer 100 CA: got %s, want 33.00", c.CA)
+		}
+	})
+
+	t.Run("unpriced events", func(t *testing.T) {
+		// counted in the metrics, left out of the CA; a customer without any
+		// valued event is not ranked
+		got := agg.customers(nil, metricCA)
+		want := Metrics{Purchases: 2, Products: 2, Quantity: 41, ActiveDays: 2, LastPurchase: mustParseDate("2020-05-06")}
+		if got[0].CustomerID != 101 || got[0].Metrics != want || got[0].CA != mustParseMoney("40.00") {
+			t.Errorf("customer 101: got %+v, want CA 40.00 and %+v", got[0], want)
+		}
+		if agg.missingPrices[99] != 2 {
+			t.Errorf("expected 2 unpriced events, got %d", agg.missingPrices[99])
+		}
+	})
+
+	t.Run("rank by another metric", func(t *testing.T) {
+		got := agg.customers(nil, metricQuantity)
+		if got[0].CustomerID != 101 || got[1].CustomerID != 100 {
+			t.Errorf("expected 101 before 100 by quantity, got %d, %d", got[0].CustomerID, got[1].CustomerID)
+		}
+		got = agg.customers(nil, metricPurchases)
+		if got[0].CustomerID != 100 {
+			t.Errorf("expected 100 first by purchases, got %d", got[0].CustomerID)
+		}
+	})
+}
+
+// -------------------- Tests pour -rank-by --------------------
+
+func TestRankByMetric(t *testing.T) {
+	t.Run("invalid metric", func(t *testing.T) {
+		if _, err := parseBucketSpec(methodEqualCount, 0.5, "", "", tiesSplit, "clicks"); err == nil {
+			t.Error("expected error for unknown metric")
+		}
+	})
+
+	t.Run("thresholds on counts", func(t *testing.T) {
+		spec, err := parseBucketSpec(methodThresholds, 0.025, "", "10,2", tiesSplit, metricPurchases)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spec.String() != "thresholds:10,2" || spec.label(1) != "2 <= purchases < 10" {
+			t.Errorf("unexpected spec %s, label %q", spec, spec.label(1))
+		}
+		if _, err := parseBucketSpec(methodThresholds, 0.025, "", "10.5", tiesSplit, metricPurchases); err == nil {
+			t.Error("expected error for fractional purchase threshold")
+		}
+
+		sorted := []CustomerCA{
+			{CustomerID: 1, CA: 100, Metrics: Metrics{Purchases: 12}},
+			{CustomerID: 2, CA: 90000, Metrics: Metrics{Purchases: 3}},
+			{CustomerID: 3, CA: 500, Metrics: Metrics{Purchases: 2}},
+			{CustomerID: 4, CA: 700, Metrics: Metrics{Purchases: 1}},
+		}
+		if ends := spec.bounds(sorted); !equalInts(ends, []int{1, 3, 4}) {
+			t.Errorf("bounds: got %v, want [1 3 4]", ends)
+		}
+		stats, _ := computeQuantiles(sorted, spec)
+		s := stats[1]
+		if s.MinValue != 2 || s.MaxValue != 3 {
+			t.Errorf("purchases range: got %d - %d, want 2 - 3", s.MinValue, s.MaxValue)
+		}
+		if s.MinCA != 500 || s.MaxCA != 90000 || !floatEqual(s.MedianCA, 452.50, 0.001) {
+			t.Errorf("CA stats: got min %s max %s median %v", s.MinCA, s.MaxCA, s.MedianCA)
+		}
+	})
+
+	t.Run("ties on the ranking metric", func(t *testing.T) {
+		sorted := []CustomerCA{
+			{CustomerID: 1, CA: 100, Metrics: Metrics{ActiveDays: 5}},
+			{CustomerID: 2, CA: 900, Metrics: Metrics{ActiveDays: 5}},
+			{CustomerID: 3, CA: 100, Metrics: Metrics{ActiveDays: 1}},
+			{CustomerID: 4, CA: 100, Metrics: Metrics{ActiveDays: 1}},
+		}
+		if ends := quantileBounds(sorted, 0.25, tiesKeepHigher, metricActiveDays); !equalInts(ends, []int{2, 2, 4, 4}) {
+			t.Errorf("got %v, want [2 2 4 4]", ends)
+		}
+	})
+}
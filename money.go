@@ -0,0 +1,170 @@
+// money.go
+//
+// Fixed-point money: prices and CA are held as integer cents from the scan of
+// ContentPrice.Price to the DECIMAL(18,2) export column, so sums are exact and
+// match a SQL SUM(Quantity * Price) to the cent.
+
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in cents
+type Money int64
+
+const centsPerUnit = 100
+
+// parseMoney reads a decimal amount such as "9.99", "-3.5" or "12". Digits
+// beyond the cent are accepted only when they are zeros (DECIMAL(10,4) values
+// like 9.9900), anything else would need rounding and is rejected.
+func parseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	intPart, frac, _ := strings.Cut(digits, ".")
+	if intPart == "" && frac == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if len(frac) > 2 {
+		if strings.Trim(frac[2:], "0") != "" {
+			return 0, fmt.Errorf("invalid amount %q: more than 2 decimal places", s)
+		}
+		frac = frac[:2]
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	if intPart == "" {
+		intPart = "0"
+	}
+	for _, part := range []string{intPart, frac} {
+		if strings.TrimLeft(part, "0123456789") != "" {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil || units > math.MaxInt64/centsPerUnit-1 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+	m := Money(units*centsPerUnit + cents)
+	if neg {
+		m = -m
+	}
+	return m, nil
+}
+
+// moneyFromDecimal converts the exact value unscaled × 10^-scale of a DECIMAL
+// column (Parquet) to cents. Like parseMoney, non-zero digits below the cent
+// are rejected rather than rounded.
+func moneyFromDecimal(unscaled *big.Int, scale int) (Money, error) {
+	v := new(big.Int).Set(unscaled)
+	if scale <= 2 {
+		v.Mul(v, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(2-scale)), nil))
+	} else {
+		var rem big.Int
+		v.QuoRem(v, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-2)), nil), &rem)
+		if rem.Sign() != 0 {
+			return 0, fmt.Errorf("invalid amount %s: more than 2 decimal places", decimalString(unscaled, scale))
+		}
+	}
+	if !v.IsInt64() || v.Int64() > math.MaxInt64-centsPerUnit || v.Int64() < -(math.MaxInt64-centsPerUnit) {
+		return 0, fmt.Errorf("invalid amount %s", decimalString(unscaled, scale))
+	}
+	return Money(v.Int64()), nil
+}
+
+// decimalString formats unscaled × 10^-scale exactly, e.g. 9.9900
+func decimalString(unscaled *big.Int, scale int) string {
+	s := new(big.Int).Abs(unscaled).String()
+	if scale > 0 {
+		if len(s) <= scale {
+			s = strings.Repeat("0", scale-len(s)+1) + s
+		}
+		s = s[:len(s)-scale] + "." + s[len(s)-scale:]
+	}
+	if unscaled.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// moneyFromFloat rounds a binary floating-point amount (FLOAT / DOUBLE columns,
+// Parquet doubles) to the nearest cent
+func moneyFromFloat(f float64) Money {
+	return Money(math.Round(f * centsPerUnit))
+}
+
+// mul returns the amount of qty units
+func (m Money) mul(qty int) Money {
+	return m * Money(qty)
+}
+
+// convert applies an exchange rate, rounding the result to the nearest cent
+func (m Money) convert(rate float64) Money {
+	if rate == 1 {
+		return m
+	}
+	return Money(math.Round(float64(m) * rate))
+}
+
+// Float64 returns the amount in currency units, for statistics and ratios only
+func (m Money) Float64() float64 {
+	return float64(m) / centsPerUnit
+}
+
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/centsPerUnit, v%centsPerUnit)
+}
+
+// MarshalJSON writes the amount as a JSON number with two decimals
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Scan implements sql.Scanner: DECIMAL columns arrive as text and are parsed
+// exactly, FLOAT / DOUBLE columns are rounded to the cent.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case []byte:
+		return m.scanText(string(v))
+	case string:
+		return m.scanText(v)
+	case int64:
+		*m = Money(v * centsPerUnit)
+	case float64:
+		*m = moneyFromFloat(v)
+	case float32:
+		*m = moneyFromFloat(float64(v))
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	return nil
+}
+
+func (m *Money) scanText(s string) error {
+	v, err := parseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Value implements driver.Valuer: the amount is sent as decimal text so MySQL
+// stores it in DECIMAL columns without going through a float
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
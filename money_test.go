@@ -0,0 +1,256 @@
+// money_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustParseMoney(s string) Money {
+	m, err := parseMoney(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// -------------------- Tests pour parseMoney --------------------
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{"9.99", 999, false},
+		{"12", 1200, false},
+		{"0.5", 50, false},
+		{".07", 7, false},
+		{"-3.10", -310, false},
+		{"+1.01", 101, false},
+		{" 19.9900 ", 1999, false}, // DECIMAL(10,4)
+		{"1.999", 0, true},
+		{"abc", 0, true},
+		{"1.2.3", 0, true},
+		{"", 0, true},
+		{"-", 0, true},
+		{"1e3", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %d cents, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+// -------------------- Tests pour moneyFromDecimal --------------------
+
+func TestMoneyFromDecimal(t *testing.T) {
+	tests := []struct {
+		unscaled string
+		scale    int
+		want     Money
+		wantErr  bool
+	}{
+		{"999", 2, 999, false},
+		{"199900", 4, 1999, false}, // DECIMAL(10,4)
+		{"-31", 1, -310, false},
+		{"12", 0, 1200, false},
+		{"7", 2, 7, false},
+		{"1005", 3, 0, true}, // 1.005
+		{"1", 5, 0, true},
+		{"-99999999999999999999999", 2, 0, true},
+	}
+	for _, tt := range tests {
+		v, _ := new(big.Int).SetString(tt.unscaled, 10)
+		got, err := moneyFromDecimal(v, tt.scale)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s scale %d: error = %v, wantErr %v", tt.unscaled, tt.scale, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s scale %d: got %d cents, want %d", tt.unscaled, tt.scale, got, tt.want)
+		}
+	}
+	if s := decimalString(big.NewInt(-5), 3); s != "-0.005" {
+		t.Errorf("decimalString: got %s, want -0.005", s)
+	}
+}
+
+// -------------------- Tests pour Money (SQL / JSON) --------------------
+
+func TestMoneyConversions(t *testing.T) {
+	t.Run("string", func(t *testing.T) {
+		for m, want := range map[Money]string{0: "0.00", 7: "0.07", 999: "9.99", -310: "-3.10", 123456789: "1234567.89"} {
+			if m.String() != want {
+				t.Errorf("%d cents: got %s, want %s", m, m.String(), want)
+			}
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		tests := []struct {
+			src  interface{}
+			want Money
+		}{
+			{[]byte("19.99"), 1999},
+			{"0.10", 10},
+			{int64(5), 500},
+			{0.1 + 0.2, 30}, // FLOAT / DOUBLE column rounded to the cent
+			{nil, 0},
+		}
+		for _, tt := range tests {
+			var m Money
+			if err := m.Scan(tt.src); err != nil {
+				t.Errorf("%v: unexpected error %v", tt.src, err)
+				continue
+			}
+			if m != tt.want {
+				t.Errorf("%v: got %s, want %s", tt.src, m, tt.want)
+			}
+		}
+		var m Money
+		if err := m.Scan([]byte("1.005")); err == nil {
+			t.Error("expected error for sub-cent DECIMAL value")
+		}
+	})
+
+	t.Run("value sent as decimal text", func(t *testing.T) {
+		v, err := Money(1999).Value()
+		if err != nil || v != "19.99" {
+			t.Errorf("got %v (%v), want 19.99", v, err)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		b, _ := json.Marshal(map[string]Money{"ca": 1050})
+		if string(b) != `{"ca":10.50}` {
+			t.Errorf("got %s", b)
+		}
+	})
+
+	t.Run("exchange rate rounded to the cent", func(t *testing.T) {
+		if got := Money(999).convert(0.5); got != 500 { // 4.995 -> 5.00
+			t.Errorf("got %s, want 5.00", got)
+		}
+		if got := Money(999).convert(1); got != 999 {
+			t.Errorf("got %s, want 9.99", got)
+		}
+	})
+}
+
+// -------------------- Tests pour l'exactitude des sommes --------------------
+
+// sqlSum computes SUM(Quantity * Price) the way MySQL does on DECIMAL columns:
+// exact decimal arithmetic, here with big.Rat on the textual prices.
+func sqlSum(prices map[int]string, events []EventRow) map[int64]string {
+	sums := make(map[int64]*big.Rat)
+	for _, e := range events {
+		p, ok := new(big.Rat).SetString(prices[e.ContentID])
+		if !ok {
+			panic("bad price " + prices[e.ContentID])
+		}
+		if sums[e.CustomerID] == nil {
+			sums[e.CustomerID] = new(big.Rat)
+		}
+		sums[e.CustomerID].Add(sums[e.CustomerID], p.Mul(p, big.NewRat(int64(e.Quantity), 1)))
+	}
+	out := make(map[int64]string, len(sums))
+	for cid, r := range sums {
+		out[cid] = r.FloatString(2)
+	}
+	return out
+}
+
+func TestCAMatchesSQLSum(t *testing.T) {
+	prices := map[int]string{1: "0.10", 2: "0.07", 3: "19.99", 4: "4.33", 5: "1234.56"}
+	priceMap := make(map[int]Money, len(prices))
+	for id, p := range prices {
+		priceMap[id] = mustParseMoney(p)
+	}
+
+	// 300k events spread over 7 customers, enough for float64 sums to drift
+	events := make([]EventRow, 0, 300000)
+	for i := 0; i < 300000; i++ {
+		events = append(events, EventRow{
+			EventDataID: int64(i + 1),
+			ContentID:   1 + i%4 + (i%1000)/999, // mostly cheap contents, a few expensive ones
+			CustomerID:  int64(i % 7),
+			Quantity:    1 + i%3,
+		})
+	}
+
+	want := sqlSum(prices, events)
+	all := make([]EventRow, len(events))
+	copy(all, events)
+	for i := range all {
+		all[i].CustomerID = 0
+	}
+	check := func(t *testing.T, priceMap map[int]Money) {
+		got := computeCA(events, priceMap)
+		if len(got) != len(want) {
+			t.Fatalf("expected %d customers, got %d", len(want), len(got))
+		}
+		var total Money
+		for cid, w := range want {
+			if got[cid].String() != w {
+				t.Errorf("customer %d: CA %s, SQL SUM %s", cid, got[cid], w)
+			}
+			total += got[cid]
+		}
+		// the grand total, as SUM over the whole table, is exact as well
+		if w := sqlSum(prices, all)[0]; total.String() != w {
+			t.Errorf("grand total: %s, SQL SUM %s", total, w)
+		}
+	}
+
+	t.Run("text", func(t *testing.T) { check(t, priceMap) })
+
+	// the same prices read from a Parquet DECIMAL(18,4) column
+	t.Run("parquet decimal", func(t *testing.T) {
+		dir := t.TempDir()
+		var ids, contents, units, currencies, inserted []interface{}
+		for id := 1; id <= len(prices); id++ {
+			ids = append(ids, int64(id))
+			contents = append(contents, int64(id))
+			units = append(units, int64(priceMap[id])*100)
+			currencies = append(currencies, "EUR")
+			inserted = append(inserted, mustParseDate("2020-01-01").UnixMicro())
+		}
+		write := func() {
+			writeTestParquet(t, filepath.Join(dir, "ContentPrice.parquet"), pqUncompressed, []pqTestColumn{
+				{name: "ContentPriceID", physical: pqInt64, converted: -1, values: ids},
+				{name: "ContentID", physical: pqInt32, converted: -1, values: contents},
+				{name: "Price", physical: pqInt64, converted: 5, scale: 4, values: units},
+				{name: "Currency", physical: pqByteArray, converted: 0, values: currencies},
+				{name: "InsertDate", physical: pqInt64, converted: 10, values: inserted},
+			})
+		}
+		write()
+		src, err := newFileSource(sourceParquet, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := src.ContentPrices(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, buildPriceMap(rows))
+
+		// a sub-cent digit is rejected, not rounded
+		units[0] = units[0].(int64) + 1
+		write()
+		if _, err := src.ContentPrices(context.Background()); err == nil || !strings.Contains(err.Error(), "0.1001") {
+			t.Errorf("sub-cent price: got error %v, want an error naming 0.1001", err)
+		}
+	})
+}
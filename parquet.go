@@ -0,0 +1,924 @@
+// parquet.go
+//
+// Minimal Parquet reader for flat table dumps, limited on purpose to what the
+// CustomerEventData, ContentPrice and CustomerData extracts need:
+//   - required or optional columns of a flat schema (no nested or repeated ones)
+//   - data pages v1 and v2 and dictionary pages; index pages are skipped
+//   - PLAIN, PLAIN_DICTIONARY and RLE_DICTIONARY encodings, RLE levels
+//   - UNCOMPRESSED, SNAPPY, GZIP and ZSTD codecs
+//   - timestamps, dates, decimals and strings as logical types
+// Anything else (DELTA_* or BYTE_STREAM_SPLIT encodings, LZ4 or BROTLI codecs,
+// ...) is rejected with an error naming it and the supported set, instead of
+// being decoded wrongly.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// -------------------- Thrift compact protocol --------------------
+
+// Parquet metadata is serialized with the Thrift compact protocol. We decode it
+// generically into field id -> value maps and pick the fields we need.
+type tstruct map[int16]interface{}
+
+type thriftReader struct {
+	buf   []byte
+	pos   int
+	depth int // nesting of the struct being read
+}
+
+var errThriftEOF = errors.New("parquet: unexpected end of thrift data")
+
+// maxThriftDepth bounds the nesting of thrift structs; Parquet metadata
+// nests a handful of levels
+const maxThriftDepth = 64
+
+func (r *thriftReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errThriftEOF
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errThriftEOF
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *thriftReader) varint() (int64, error) {
+	u, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	return int64(u>>1) ^ -int64(u&1), nil // zigzag
+}
+
+func (r *thriftReader) binary() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)-r.pos) < n {
+		return nil, errThriftEOF
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *thriftReader) readStruct() (tstruct, error) {
+	if r.depth >= maxThriftDepth {
+		return nil, errors.New("parquet: thrift structs nested too deep")
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+	st := tstruct{}
+	var lastID int16
+	for {
+		h, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if h == 0 { // stop
+			return st, nil
+		}
+		typ := h & 0x0f
+		if delta := int16(h >> 4); delta != 0 {
+			lastID += delta
+		} else {
+			id, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			lastID = int16(id)
+		}
+		var v interface{}
+		switch typ {
+		case 1:
+			v = true
+		case 2:
+			v = false
+		default:
+			if v, err = r.readValue(typ); err != nil {
+				return nil, err
+			}
+		}
+		st[lastID] = v
+	}
+}
+
+func (r *thriftReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case 1, 2: // bool inside a list: one byte
+		b, err := r.byte()
+		return b == 1, err
+	case 3:
+		b, err := r.byte()
+		return int64(int8(b)), err
+	case 4, 5, 6:
+		return r.varint()
+	case 7:
+		if len(r.buf)-r.pos < 8 {
+			return nil, errThriftEOF
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.buf[r.pos:]))
+		r.pos += 8
+		return v, nil
+	case 8:
+		return r.binary()
+	case 9, 10:
+		h, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(h >> 4)
+		if size == 15 {
+			if size, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		// every element takes at least one byte
+		if size > uint64(len(r.buf)-r.pos) {
+			return nil, errThriftEOF
+		}
+		elemType := h & 0x0f
+		out := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			v, err := r.readValue(elemType)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case 11:
+		size, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		if size > uint64(len(r.buf)-r.pos) {
+			return nil, errThriftEOF
+		}
+		kv, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < size; i++ {
+			if _, err := r.readValue(kv >> 4); err != nil {
+				return nil, err
+			}
+			if _, err := r.readValue(kv & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil // maps are not used by the reader
+	case 12:
+		return r.readStruct()
+	}
+	return nil, fmt.Errorf("parquet: unknown thrift type %d", typ)
+}
+
+func (st tstruct) int(id int16) int64 {
+	v, _ := st[id].(int64)
+	return v
+}
+
+func (st tstruct) has(id int16) bool {
+	_, ok := st[id]
+	return ok
+}
+
+func (st tstruct) str(id int16) string {
+	v, _ := st[id].([]byte)
+	return string(v)
+}
+
+func (st tstruct) bool(id int16, def bool) bool {
+	v, ok := st[id].(bool)
+	if !ok {
+		return def
+	}
+	return v
+}
+
+func (st tstruct) sub(id int16) tstruct {
+	v, _ := st[id].(tstruct)
+	return v
+}
+
+func (st tstruct) list(id int16) []interface{} {
+	v, _ := st[id].([]interface{})
+	return v
+}
+
+// -------------------- Schema --------------------
+
+// parquet physical types
+const (
+	pqBoolean = iota
+	pqInt32
+	pqInt64
+	pqInt96
+	pqFloat
+	pqDouble
+	pqByteArray
+	pqFixedLenByteArray
+)
+
+// leaf column of a flat schema, with the logical type resolved
+type parquetColumn struct {
+	name     string
+	physical int64
+	typeLen  int
+	optional bool
+	date     bool
+	timeUnit time.Duration // >0 for timestamps stored as INT64
+	utc      bool
+	decimal  bool
+	scale    int
+}
+
+func parseParquetSchema(elems []interface{}) ([]parquetColumn, error) {
+	if len(elems) == 0 {
+		return nil, errors.New("parquet: empty schema")
+	}
+	var cols []parquetColumn
+	for _, e := range elems[1:] { // elems[0] is the root
+		se, _ := e.(tstruct)
+		if se.int(5) > 0 {
+			return nil, fmt.Errorf("parquet: nested column %q not supported", se.str(4))
+		}
+		if se.int(3) == 2 {
+			return nil, fmt.Errorf("parquet: repeated column %q not supported", se.str(4))
+		}
+		c := parquetColumn{
+			name:     se.str(4),
+			physical: se.int(1),
+			typeLen:  int(se.int(2)),
+			optional: se.int(3) == 1,
+		}
+		if c.physical == pqFixedLenByteArray && (c.typeLen <= 0 || c.typeLen > math.MaxInt32) {
+			return nil, fmt.Errorf("parquet: invalid length %d of column %q", c.typeLen, c.name)
+		}
+		switch se.int(6) { // converted type
+		case 5:
+			c.decimal, c.scale = true, int(se.int(7))
+		case 6:
+			c.date = true
+		case 9:
+			c.timeUnit, c.utc = time.Millisecond, true
+		case 10:
+			c.timeUnit, c.utc = time.Microsecond, true
+		}
+		if lt := se.sub(10); lt != nil { // logical type takes precedence
+			switch {
+			case lt.has(5):
+				c.decimal, c.scale = true, int(lt.sub(5).int(1))
+			case lt.has(6):
+				c.date = true
+			case lt.has(8):
+				ts := lt.sub(8)
+				c.utc = ts.bool(1, true)
+				switch unit := ts.sub(2); {
+				case unit.has(1):
+					c.timeUnit = time.Millisecond
+				case unit.has(2):
+					c.timeUnit = time.Microsecond
+				case unit.has(3):
+					c.timeUnit = time.Nanosecond
+				}
+			}
+		}
+		if c.decimal && c.scale < 0 {
+			return nil, fmt.Errorf("parquet: invalid scale %d of decimal column %q", c.scale, c.name)
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+// -------------------- File reader --------------------
+
+// parquetReader iterates the rows of a flat Parquet file, one row group in memory at a time.
+// Values are int64, float64, bool, string, time.Time or nil (null).
+type parquetReader struct {
+	f         *os.File
+	size      int64 // of the file, bounding the column chunks
+	cols      []parquetColumn
+	rowGroups []tstruct
+	rg        int             // next row group to decode
+	values    [][]interface{} // current row group, per column
+	row       int
+	nRows     int
+}
+
+func openParquet(path string) (*parquetReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newParquetReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func newParquetReader(f *os.File) (*parquetReader, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	if size < 12 {
+		return nil, errors.New("parquet: file too small")
+	}
+	tail := make([]byte, 8)
+	if _, err := f.ReadAt(tail, size-8); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != "PAR1" {
+		return nil, errors.New("parquet: missing magic number")
+	}
+	footerLen := int64(binary.LittleEndian.Uint32(tail))
+	if footerLen <= 0 || footerLen > size-12 {
+		return nil, errors.New("parquet: invalid footer length")
+	}
+	footer := make([]byte, footerLen)
+	if _, err := f.ReadAt(footer, size-8-footerLen); err != nil {
+		return nil, err
+	}
+	meta, err := (&thriftReader{buf: footer}).readStruct()
+	if err != nil {
+		return nil, err
+	}
+	cols, err := parseParquetSchema(meta.list(2))
+	if err != nil {
+		return nil, err
+	}
+	r := &parquetReader{f: f, size: size, cols: cols}
+	for _, v := range meta.list(4) {
+		rg, ok := v.(tstruct)
+		if !ok {
+			return nil, errors.New("parquet: invalid row group metadata")
+		}
+		r.rowGroups = append(r.rowGroups, rg)
+	}
+	return r, nil
+}
+
+func (r *parquetReader) Columns() []string {
+	out := make([]string, len(r.cols))
+	for i, c := range r.cols {
+		out[i] = c.name
+	}
+	return out
+}
+
+func (r *parquetReader) Next() ([]interface{}, error) {
+	for r.row >= r.nRows {
+		if r.rg >= len(r.rowGroups) {
+			return nil, io.EOF
+		}
+		if err := r.loadRowGroup(r.rowGroups[r.rg]); err != nil {
+			return nil, err
+		}
+		r.rg++
+	}
+	out := make([]interface{}, len(r.cols))
+	for i := range r.cols {
+		out[i] = r.values[i][r.row]
+	}
+	r.row++
+	return out, nil
+}
+
+func (r *parquetReader) Close() error {
+	return r.f.Close()
+}
+
+func (r *parquetReader) loadRowGroup(rg tstruct) error {
+	chunks := rg.list(1)
+	if len(chunks) != len(r.cols) {
+		return fmt.Errorf("parquet: row group has %d columns, schema has %d", len(chunks), len(r.cols))
+	}
+	nRows := rg.int(3)
+	if nRows < 0 || nRows > math.MaxInt32 {
+		return fmt.Errorf("parquet: invalid row count %d", nRows)
+	}
+	r.nRows = int(nRows)
+	r.row = 0
+	r.values = make([][]interface{}, len(r.cols))
+	for i, v := range chunks {
+		ch, ok := v.(tstruct)
+		if !ok || ch.sub(3) == nil {
+			return fmt.Errorf("parquet: invalid metadata of column %s", r.cols[i].name)
+		}
+		vals, err := r.readColumnChunk(r.cols[i], ch.sub(3), r.nRows)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", r.cols[i].name, err)
+		}
+		if len(vals) != r.nRows {
+			return fmt.Errorf("column %s: got %d values, expected %d", r.cols[i].name, len(vals), r.nRows)
+		}
+		r.values[i] = vals
+	}
+	return nil
+}
+
+// parquet page types
+const (
+	pqDataPage       = 0
+	pqIndexPage      = 1
+	pqDictionaryPage = 2
+	pqDataPageV2     = 3
+)
+
+// readColumnChunk decodes the total values of a column chunk; every offset,
+// size and count read from the file is checked before use
+func (r *parquetReader) readColumnChunk(c parquetColumn, md tstruct, total int) ([]interface{}, error) {
+	start := md.int(9)
+	if md.has(11) && md.int(11) > 0 && md.int(11) < start {
+		start = md.int(11)
+	}
+	length := md.int(7)
+	if start < 0 || length < 0 || start > r.size || length > r.size-start {
+		return nil, fmt.Errorf("parquet: column chunk [%d, +%d) outside the file of %d bytes", start, length, r.size)
+	}
+	if n := md.int(5); n != int64(total) {
+		return nil, fmt.Errorf("parquet: column chunk has %d values, row group %d rows", n, total)
+	}
+	buf := make([]byte, length)
+	if _, err := r.f.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+	codec := md.int(4)
+	if !pqSupportedCodecs[codec] {
+		return nil, fmt.Errorf("parquet: unsupported compression codec %s (supported: UNCOMPRESSED, SNAPPY, GZIP, ZSTD)", pqCodecName(codec))
+	}
+
+	var dict []interface{}
+	out := make([]interface{}, 0, total)
+	tr := &thriftReader{buf: buf}
+	for len(out) < total {
+		ph, err := tr.readStruct()
+		if err != nil {
+			return nil, err
+		}
+		size := ph.int(3)
+		if size < 0 || size > int64(len(buf)-tr.pos) {
+			return nil, errors.New("parquet: truncated page")
+		}
+		page := buf[tr.pos : tr.pos+int(size)]
+		tr.pos += int(size)
+		uncompressed := ph.int(2)
+		if uncompressed < 0 || uncompressed > maxPageSize {
+			return nil, fmt.Errorf("parquet: invalid page size %d", uncompressed)
+		}
+		// values of the data page, at most those still expected
+		valueCount := func(n int64) (int, error) {
+			if n < 0 || n > int64(total-len(out)) {
+				return 0, fmt.Errorf("parquet: page of %d values, %d expected", n, total-len(out))
+			}
+			return int(n), nil
+		}
+
+		switch ph.int(1) {
+		case pqIndexPage:
+		case pqDictionaryPage:
+			if enc := ph.sub(7).int(2); enc != pqPlain && enc != pqPlainDict {
+				return nil, fmt.Errorf("parquet: unsupported dictionary encoding %s (supported: PLAIN, PLAIN_DICTIONARY)", pqEncodingName(enc))
+			}
+			data, err := decompress(codec, page, int(uncompressed))
+			if err != nil {
+				return nil, err
+			}
+			n := ph.sub(7).int(1)
+			if n < 0 || n > int64(len(data))*8 {
+				return nil, fmt.Errorf("parquet: dictionary of %d values in %d bytes", n, len(data))
+			}
+			if dict, _, err = decodePlain(c, data, int(n)); err != nil {
+				return nil, err
+			}
+		case pqDataPage:
+			data, err := decompress(codec, page, int(uncompressed))
+			if err != nil {
+				return nil, err
+			}
+			h := ph.sub(5)
+			n, err := valueCount(h.int(1))
+			if err != nil {
+				return nil, err
+			}
+			var defs []int
+			if c.optional {
+				if enc := h.int(3); enc != pqRLE {
+					return nil, fmt.Errorf("parquet: unsupported definition level encoding %s (supported: RLE)", pqEncodingName(enc))
+				}
+				if len(data) < 4 {
+					return nil, errors.New("parquet: truncated definition levels")
+				}
+				l := int(binary.LittleEndian.Uint32(data))
+				if 4+l > len(data) {
+					return nil, errors.New("parquet: truncated definition levels")
+				}
+				if defs, err = decodeRLE(data[4:4+l], 1, n); err != nil {
+					return nil, err
+				}
+				data = data[4+l:]
+			}
+			vals, err := decodePage(c, h.int(2), data, n, defs, dict)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, vals...)
+		case pqDataPageV2:
+			h := ph.sub(8)
+			n, err := valueCount(h.int(1))
+			if err != nil {
+				return nil, err
+			}
+			defLen, repLen := h.int(5), h.int(6)
+			if defLen < 0 || repLen < 0 || defLen+repLen > int64(len(page)) || defLen+repLen > uncompressed {
+				return nil, errors.New("parquet: truncated levels")
+			}
+			var defs []int
+			if c.optional {
+				if defs, err = decodeRLE(page[repLen:repLen+defLen], 1, n); err != nil {
+					return nil, err
+				}
+			}
+			data := page[repLen+defLen:]
+			if h.bool(7, true) {
+				if data, err = decompress(codec, data, int(uncompressed-defLen-repLen)); err != nil {
+					return nil, err
+				}
+			}
+			vals, err := decodePage(c, h.int(4), data, n, defs, dict)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, vals...)
+		default:
+			return nil, fmt.Errorf("parquet: unsupported page type %d", ph.int(1))
+		}
+	}
+	return out, nil
+}
+
+// parquet codecs
+const (
+	pqUncompressed = 0
+	pqSnappy       = 1
+	pqGzip         = 2
+	pqZstd         = 6
+)
+
+var pqSupportedCodecs = map[int64]bool{pqUncompressed: true, pqSnappy: true, pqGzip: true, pqZstd: true}
+
+var pqCodecNames = []string{"UNCOMPRESSED", "SNAPPY", "GZIP", "LZO", "BROTLI", "LZ4", "ZSTD", "LZ4_RAW"}
+
+func pqCodecName(codec int64) string {
+	if codec >= 0 && codec < int64(len(pqCodecNames)) {
+		return pqCodecNames[codec]
+	}
+	return fmt.Sprintf("%d", codec)
+}
+
+// maxPageSize bounds the uncompressed size of a page read from a file
+const maxPageSize = 1 << 30
+
+// decompress decodes a page of size bytes once uncompressed; a page that does
+// not decode to exactly size bytes is an error
+func decompress(codec int64, data []byte, size int) ([]byte, error) {
+	if size < 0 || size > maxPageSize {
+		return nil, fmt.Errorf("parquet: invalid page size %d", size)
+	}
+	var out []byte
+	switch codec {
+	case pqUncompressed:
+		out = data
+	case pqSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, fmt.Errorf("parquet: snappy page of %d bytes, %d expected", n, size)
+		}
+		if out, err = snappy.Decode(make([]byte, size), data); err != nil {
+			return nil, err
+		}
+	case pqGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		// one byte more than expected reveals an oversized page
+		if out, err = io.ReadAll(io.LimitReader(zr, int64(size)+1)); err != nil {
+			return nil, err
+		}
+	case pqZstd:
+		// the window declared by a frame may exceed the page, so the output is
+		// bounded by reading rather than with a decoder memory limit
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		if out, err = io.ReadAll(io.LimitReader(zr, int64(size)+1)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("parquet: unsupported compression codec %s", pqCodecName(codec))
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("parquet: page of %d bytes once uncompressed, %d expected", len(out), size)
+	}
+	return out, nil
+}
+
+// parquet encodings
+const (
+	pqPlain         = 0
+	pqPlainDict     = 2
+	pqRLE           = 3
+	pqRLEDictionary = 8
+)
+
+var pqEncodingNames = []string{"PLAIN", "GROUP_VAR_INT", "PLAIN_DICTIONARY", "RLE", "BIT_PACKED",
+	"DELTA_BINARY_PACKED", "DELTA_LENGTH_BYTE_ARRAY", "DELTA_BYTE_ARRAY", "RLE_DICTIONARY", "BYTE_STREAM_SPLIT"}
+
+func pqEncodingName(enc int64) string {
+	if enc >= 0 && enc < int64(len(pqEncodingNames)) {
+		return pqEncodingNames[enc]
+	}
+	return fmt.Sprintf("%d", enc)
+}
+
+// definition level of a non-null value in a flat optional column
+const pqDefined = 1
+
+// decodePage decodes n values of a data page; defs marks nulls for optional columns
+func decodePage(c parquetColumn, encoding int64, data []byte, n int, defs []int, dict []interface{}) ([]interface{}, error) {
+	nonNull := n
+	if defs != nil {
+		nonNull = 0
+		for _, d := range defs {
+			if d == pqDefined {
+				nonNull++
+			}
+		}
+	}
+
+	var vals []interface{}
+	switch encoding {
+	case pqPlain:
+		var err error
+		if vals, _, err = decodePlain(c, data, nonNull); err != nil {
+			return nil, err
+		}
+	case pqPlainDict, pqRLEDictionary:
+		if dict == nil {
+			return nil, errors.New("parquet: dictionary page missing")
+		}
+		if len(data) == 0 {
+			if nonNull > 0 {
+				return nil, errors.New("parquet: empty dictionary indices")
+			}
+			break
+		}
+		bw := int(data[0])
+		if bw > 32 {
+			return nil, fmt.Errorf("parquet: invalid bit width %d", bw)
+		}
+		idx, err := decodeRLE(data[1:], bw, nonNull)
+		if err != nil {
+			return nil, err
+		}
+		vals = make([]interface{}, nonNull)
+		for i, k := range idx {
+			if k < 0 || k >= len(dict) {
+				return nil, fmt.Errorf("parquet: dictionary index %d out of range", k)
+			}
+			vals[i] = dict[k]
+		}
+	default:
+		return nil, fmt.Errorf("parquet: unsupported encoding %s (supported: PLAIN, PLAIN_DICTIONARY, RLE_DICTIONARY)", pqEncodingName(encoding))
+	}
+
+	if defs == nil {
+		return vals, nil
+	}
+	out := make([]interface{}, n)
+	j := 0
+	for i, d := range defs {
+		if d == pqDefined {
+			out[i] = vals[j]
+			j++
+		}
+	}
+	return out, nil
+}
+
+// decodeRLE decodes n values of the RLE / bit-packed hybrid encoding
+func decodeRLE(data []byte, bitWidth, n int) ([]int, error) {
+	if bitWidth < 0 || bitWidth > 32 || n < 0 {
+		return nil, fmt.Errorf("parquet: invalid RLE bit width %d or count %d", bitWidth, n)
+	}
+	out := make([]int, 0, n)
+	byteWidth := (bitWidth + 7) / 8
+	pos := 0
+	for len(out) < n {
+		h, k := binary.Uvarint(data[pos:])
+		if k <= 0 {
+			return nil, errors.New("parquet: truncated RLE data")
+		}
+		pos += k
+		// a run never holds more values than remain, nor a bit-packed run
+		// more bytes than the data
+		if h>>1 > uint64(n) && h>>1 > uint64(len(data)) {
+			return nil, errors.New("parquet: invalid RLE run length")
+		}
+		if h&1 == 0 { // RLE run
+			count := int(h >> 1)
+			if pos+byteWidth > len(data) {
+				return nil, errors.New("parquet: truncated RLE run")
+			}
+			v := 0
+			for i := 0; i < byteWidth; i++ {
+				v |= int(data[pos+i]) << (8 * i)
+			}
+			pos += byteWidth
+			for i := 0; i < count && len(out) < n; i++ {
+				out = append(out, v)
+			}
+			continue
+		}
+		// bit-packed run, groups of 8 values, LSB first
+		count := int(h>>1) * 8
+		nbytes := int(h>>1) * bitWidth
+		if pos+nbytes > len(data) {
+			return nil, errors.New("parquet: truncated bit-packed run")
+		}
+		packed := data[pos : pos+nbytes]
+		pos += nbytes
+		for i := 0; i < count && len(out) < n; i++ {
+			v := 0
+			for b := 0; b < bitWidth; b++ {
+				bit := i*bitWidth + b
+				if packed[bit/8]&(1<<(bit%8)) != 0 {
+					v |= 1 << b
+				}
+			}
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+// decodePlain decodes n PLAIN values and returns the number of bytes consumed
+func decodePlain(c parquetColumn, data []byte, n int) ([]interface{}, int, error) {
+	// every value takes at least one bit
+	if n < 0 || n > len(data)*8 {
+		return nil, 0, fmt.Errorf("parquet: %d plain values in %d bytes", n, len(data))
+	}
+	out := make([]interface{}, n)
+	pos := 0
+	need := func(k int) error {
+		if pos+k > len(data) {
+			return errors.New("parquet: truncated plain values")
+		}
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		switch c.physical {
+		case pqBoolean:
+			if i/8 >= len(data) {
+				return nil, 0, errors.New("parquet: truncated plain values")
+			}
+			out[i] = data[i/8]&(1<<(i%8)) != 0
+		case pqInt32:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			out[i] = c.convertInt(int64(int32(binary.LittleEndian.Uint32(data[pos:]))))
+			pos += 4
+		case pqInt64:
+			if err := need(8); err != nil {
+				return nil, 0, err
+			}
+			out[i] = c.convertInt(int64(binary.LittleEndian.Uint64(data[pos:])))
+			pos += 8
+		case pqInt96:
+			if err := need(12); err != nil {
+				return nil, 0, err
+			}
+			nanos := int64(binary.LittleEndian.Uint64(data[pos:]))
+			julian := int64(binary.LittleEndian.Uint32(data[pos+8:]))
+			out[i] = time.Unix((julian-2440588)*86400, nanos).UTC()
+			pos += 12
+		case pqFloat:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			out[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+			pos += 4
+		case pqDouble:
+			if err := need(8); err != nil {
+				return nil, 0, err
+			}
+			out[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[pos:]))
+			pos += 8
+		case pqByteArray:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			l := int(binary.LittleEndian.Uint32(data[pos:]))
+			pos += 4
+			if err := need(l); err != nil {
+				return nil, 0, err
+			}
+			out[i] = c.convertBytes(data[pos : pos+l])
+			pos += l
+		case pqFixedLenByteArray:
+			if err := need(c.typeLen); err != nil {
+				return nil, 0, err
+			}
+			out[i] = c.convertBytes(data[pos : pos+c.typeLen])
+			pos += c.typeLen
+		default:
+			return nil, 0, fmt.Errorf("parquet: unsupported physical type %d", c.physical)
+		}
+	}
+	if c.physical == pqBoolean {
+		pos = (n + 7) / 8
+	}
+	return out, pos, nil
+}
+
+// parquetDecimal is the exact value unscaled × 10^-scale of a DECIMAL column;
+// amounts are converted to Money without going through a float
+type parquetDecimal struct {
+	unscaled *big.Int
+	scale    int
+}
+
+func (d parquetDecimal) String() string {
+	return decimalString(d.unscaled, d.scale)
+}
+
+func (c parquetColumn) convertInt(v int64) interface{} {
+	switch {
+	case c.date:
+		return time.Unix(v*86400, 0).UTC()
+	case c.timeUnit > 0:
+		t := time.Unix(0, 0).Add(time.Duration(v) * c.timeUnit)
+		if c.utc {
+			return t.UTC()
+		}
+		// timestamps not adjusted to UTC are wall-clock times
+		u := t.UTC()
+		return time.Date(u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second(), u.Nanosecond(), time.Local)
+	case c.decimal:
+		return parquetDecimal{big.NewInt(v), c.scale}
+	}
+	return v
+}
+
+func (c parquetColumn) convertBytes(b []byte) interface{} {
+	if c.decimal {
+		// big-endian two's complement unscaled value
+		v := new(big.Int).SetBytes(b)
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+		}
+		return parquetDecimal{v, c.scale}
+	}
+	return string(b)
+}
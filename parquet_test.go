@@ -0,0 +1,451 @@
+// parquet_test.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// -------------------- Test writer --------------------
+
+// Minimal Parquet writer used to build fixtures: one row group, data pages v1,
+// PLAIN or dictionary encoding, optional columns, uncompressed or snappy.
+
+type tfield struct {
+	id int16
+	v  interface{} // int32, int64, bool, string, []tfield, tlist
+}
+
+type tlist struct {
+	elem  byte
+	items []interface{}
+}
+
+func thriftType(v interface{}) byte {
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return 1
+		}
+		return 2
+	case int32:
+		return 5
+	case int64:
+		return 6
+	case string:
+		return 8
+	case tlist:
+		return 9
+	case []tfield:
+		return 12
+	}
+	panic("unsupported thrift value")
+}
+
+func writeVarint(b *bytes.Buffer, v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64((v<<1)^(v>>63)))
+	b.Write(tmp[:n])
+}
+
+func writeThriftValue(b *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case int32:
+		writeVarint(b, int64(x))
+	case int64:
+		writeVarint(b, x)
+	case string:
+		var tmp [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(tmp[:], uint64(len(x)))
+		b.Write(tmp[:n])
+		b.WriteString(x)
+	case tlist:
+		b.WriteByte(byte(len(x.items))<<4 | x.elem)
+		for _, it := range x.items {
+			writeThriftValue(b, it)
+		}
+	case []tfield:
+		writeThriftStruct(b, x)
+	}
+}
+
+func writeThriftStruct(b *bytes.Buffer, fields []tfield) {
+	var last int16
+	for _, f := range fields {
+		typ := thriftType(f.v)
+		if d := f.id - last; d > 0 && d <= 15 {
+			b.WriteByte(byte(d)<<4 | typ)
+		} else {
+			b.WriteByte(typ)
+			writeVarint(b, int64(f.id))
+		}
+		last = f.id
+		if _, isBool := f.v.(bool); !isBool {
+			writeThriftValue(b, f.v)
+		}
+	}
+	b.WriteByte(0)
+}
+
+type pqTestColumn struct {
+	name      string
+	physical  int32
+	converted int32 // -1 for none
+	scale     int32 // DECIMAL columns (converted 5)
+	optional  bool
+	dict      bool
+	encoding  int32         // when non-zero, declared instead of the actual encoding
+	values    []interface{} // int64, float64, string or nil
+}
+
+func plainEncode(physical int32, vals []interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range vals {
+		switch physical {
+		case pqInt32:
+			binary.Write(&b, binary.LittleEndian, int32(v.(int64)))
+		case pqInt64:
+			binary.Write(&b, binary.LittleEndian, v.(int64))
+		case pqDouble:
+			binary.Write(&b, binary.LittleEndian, math.Float64bits(v.(float64)))
+		case pqByteArray:
+			binary.Write(&b, binary.LittleEndian, uint32(len(v.(string))))
+			b.WriteString(v.(string))
+		}
+	}
+	return b.Bytes()
+}
+
+// rleRuns encodes values as RLE runs of length 1
+func rleRuns(vals []int, byteWidth int) []byte {
+	var b bytes.Buffer
+	for _, v := range vals {
+		b.WriteByte(2) // header: run of 1
+		for i := 0; i < byteWidth; i++ {
+			b.WriteByte(byte(v >> (8 * i)))
+		}
+	}
+	return b.Bytes()
+}
+
+func writeTestParquet(t *testing.T, path string, codec int32, cols []pqTestColumn) {
+	t.Helper()
+	compress := func(data []byte) []byte {
+		switch codec {
+		case pqSnappy:
+			return snappy.Encode(nil, data)
+		case pqGzip:
+			var b bytes.Buffer
+			zw := gzip.NewWriter(&b)
+			zw.Write(data)
+			zw.Close()
+			return b.Bytes()
+		case pqZstd:
+			zw, _ := zstd.NewWriter(nil)
+			defer zw.Close()
+			return zw.EncodeAll(data, nil)
+		}
+		return data
+	}
+	page := func(b *bytes.Buffer, header []tfield, data []byte) {
+		comp := compress(data)
+		h := append([]tfield{
+			{1, header[0].v}, {2, int32(len(data))}, {3, int32(len(comp))},
+		}, header[1:]...)
+		writeThriftStruct(b, h)
+		b.Write(comp)
+	}
+
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+	nRows := len(cols[0].values)
+	schema := []interface{}{[]tfield{{4, "schema"}, {5, int32(len(cols))}}}
+	var chunks []interface{}
+	for _, c := range cols {
+		se := []tfield{{1, c.physical}, {3, int32(0)}, {4, c.name}}
+		if c.optional {
+			se[1].v = int32(1)
+		}
+		if c.converted >= 0 {
+			se = append(se, tfield{6, c.converted})
+		}
+		if c.converted == 5 {
+			se = append(se, tfield{7, c.scale}, tfield{8, int32(18)})
+		}
+		schema = append(schema, se)
+
+		var nonNull []interface{}
+		var defs []int
+		for _, v := range c.values {
+			if v == nil {
+				defs = append(defs, 0)
+				continue
+			}
+			defs = append(defs, 1)
+			nonNull = append(nonNull, v)
+		}
+
+		start := int64(file.Len())
+		var dictOffset int64 = -1
+		var values []byte
+		encoding := int32(pqPlain)
+		if c.dict {
+			var dict []interface{}
+			pos := map[interface{}]int{}
+			var idx []int
+			for _, v := range nonNull {
+				k, ok := pos[v]
+				if !ok {
+					k = len(dict)
+					pos[v] = k
+					dict = append(dict, v)
+				}
+				idx = append(idx, k)
+			}
+			dictOffset = start
+			page(&file, []tfield{{1, int32(pqDictionaryPage)}, {7, []tfield{{1, int32(len(dict))}, {2, int32(pqPlain)}}}}, plainEncode(c.physical, dict))
+			values = append([]byte{8}, rleRuns(idx, 1)...) // bit width 8
+			encoding = pqRLEDictionary
+		} else {
+			values = plainEncode(c.physical, nonNull)
+		}
+		if c.encoding != 0 {
+			encoding = c.encoding
+		}
+
+		dataOffset := int64(file.Len())
+		var data []byte
+		if c.optional {
+			levels := rleRuns(defs, 1)
+			data = binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+			data = append(data, levels...)
+		}
+		data = append(data, values...)
+		page(&file, []tfield{{1, int32(pqDataPage)}, {5, []tfield{{1, int32(nRows)}, {2, encoding}, {3, int32(3)}, {4, int32(3)}}}}, data)
+
+		size := int64(file.Len()) - start
+		md := []tfield{
+			{1, c.physical},
+			{2, tlist{5, []interface{}{int32(pqPlain)}}},
+			{3, tlist{8, []interface{}{c.name}}},
+			{4, codec},
+			{5, int64(nRows)},
+			{6, size},
+			{7, size},
+			{9, dataOffset},
+		}
+		if dictOffset >= 0 {
+			md = append(md, tfield{11, dictOffset})
+		}
+		chunks = append(chunks, []tfield{{2, start}, {3, md}})
+	}
+
+	var footer bytes.Buffer
+	writeThriftStruct(&footer, []tfield{
+		{1, int32(1)},
+		{2, tlist{12, schema}},
+		{3, int64(nRows)},
+		{4, tlist{12, []interface{}{[]tfield{{1, tlist{12, chunks}}, {2, int64(0)}, {3, int64(nRows)}}}}},
+	})
+	file.Write(footer.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(footer.Len()))
+	file.WriteString("PAR1")
+
+	if err := os.WriteFile(path, file.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// -------------------- Tests pour decodeRLE --------------------
+
+func TestDecodeRLE(t *testing.T) {
+	t.Run("rle run", func(t *testing.T) {
+		// header 0b1000 = run of 4, value 1 on one byte
+		got, err := decodeRLE([]byte{0x08, 0x01}, 1, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range got {
+			if v != 1 {
+				t.Errorf("value %d: got %d, want 1", i, v)
+			}
+		}
+	})
+
+	t.Run("bit-packed run", func(t *testing.T) {
+		// header 0b11 = 1 group of 8 values, bit width 3: values 0..7
+		got, err := decodeRLE([]byte{0x03, 0x88, 0xc6, 0xfa}, 3, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range got {
+			if v != i {
+				t.Errorf("value %d: got %d, want %d", i, v, i)
+			}
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		if _, err := decodeRLE([]byte{0x08}, 1, 4); err == nil {
+			t.Error("expected error for truncated run")
+		}
+	})
+}
+
+// -------------------- Tests pour parquetReader --------------------
+
+func TestParquetReader(t *testing.T) {
+	ts := func(s string) int64 { return mustParseDate(s).UnixMicro() }
+	cols := []pqTestColumn{
+		{name: "CustomerID", physical: pqInt64, converted: -1, values: []interface{}{int64(100), int64(101), int64(102)}},
+		{name: "ContentID", physical: pqInt32, converted: -1, values: []interface{}{int64(10), int64(11), int64(10)}},
+		{name: "EventDate", physical: pqInt64, converted: 10, values: []interface{}{ts("2020-04-01"), ts("2020-05-01"), ts("2020-06-01")}},
+		{name: "Price", physical: pqDouble, converted: -1, values: []interface{}{9.99, 5.0, 9.99}},
+		{name: "Email", physical: pqByteArray, converted: 0, optional: true, dict: true, values: []interface{}{"a@test.com", nil, "a@test.com"}},
+	}
+
+	for _, codec := range []int32{pqUncompressed, pqSnappy, pqGzip, pqZstd} {
+		path := filepath.Join(t.TempDir(), "test.parquet")
+		writeTestParquet(t, path, codec, cols)
+
+		r, err := openParquet(path)
+		if err != nil {
+			t.Fatalf("codec %d: open: %v", codec, err)
+		}
+		var rows [][]interface{}
+		for {
+			row, err := r.Next()
+			if err != nil {
+				break
+			}
+			rows = append(rows, row)
+		}
+		r.Close()
+
+		if len(rows) != 3 {
+			t.Fatalf("codec %d: expected 3 rows, got %d", codec, len(rows))
+		}
+		if rows[1][0] != int64(101) || rows[1][1] != int64(11) {
+			t.Errorf("codec %d: row 1 ids: got %v %v", codec, rows[1][0], rows[1][1])
+		}
+		if d, _ := rows[2][2].(time.Time); !d.Equal(mustParseDate("2020-06-01")) {
+			t.Errorf("codec %d: row 2 EventDate: got %v", codec, rows[2][2])
+		}
+		if rows[0][3] != 9.99 {
+			t.Errorf("codec %d: row 0 Price: got %v", codec, rows[0][3])
+		}
+		if rows[0][4] != "a@test.com" || rows[1][4] != nil || rows[2][4] != "a@test.com" {
+			t.Errorf("codec %d: Email column: got %v %v %v", codec, rows[0][4], rows[1][4], rows[2][4])
+		}
+	}
+}
+
+func TestParquetReaderInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.parquet")
+	if err := os.WriteFile(path, []byte("not a parquet file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openParquet(path); err == nil {
+		t.Error("expected error for invalid parquet file")
+	}
+}
+
+func TestParquetReaderUnsupported(t *testing.T) {
+	ids := []interface{}{int64(100), int64(101)}
+	tests := []struct {
+		name  string
+		codec int32
+		col   pqTestColumn
+		want  string
+	}{
+		{"lz4 codec", 5, pqTestColumn{physical: pqInt64, converted: -1, values: ids}, "unsupported compression codec LZ4"},
+		{"brotli codec", 4, pqTestColumn{physical: pqInt64, converted: -1, values: ids}, "unsupported compression codec BROTLI"},
+		{"delta encoding", pqUncompressed, pqTestColumn{physical: pqInt64, converted: -1, encoding: 5, values: ids}, "unsupported encoding DELTA_BINARY_PACKED"},
+		{"byte stream split", pqSnappy, pqTestColumn{physical: pqDouble, converted: -1, encoding: 9, values: []interface{}{1.5, 2.5}}, "unsupported encoding BYTE_STREAM_SPLIT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "unsupported.parquet")
+			tt.col.name = "CustomerID"
+			writeTestParquet(t, path, tt.codec, []pqTestColumn{tt.col})
+			_, err := readAllParquet(t, path)
+			// the error names the column, what is not supported and what is
+			if err == nil || !strings.Contains(err.Error(), "column CustomerID") || !strings.Contains(err.Error(), tt.want) ||
+				!strings.Contains(err.Error(), "supported: ") {
+				t.Errorf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// readAllParquet reads every row of path, turning a panic into a test failure
+func readAllParquet(t *testing.T, path string) (n int, err error) {
+	t.Helper()
+	defer func() {
+		if p := recover(); p != nil {
+			t.Fatalf("panic reading %s: %v", path, p)
+		}
+	}()
+	r, err := openParquet(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	for {
+		if _, err := r.Next(); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func TestParquetReaderCorruptFile(t *testing.T) {
+	cols := []pqTestColumn{
+		{name: "CustomerID", physical: pqInt64, converted: -1, values: []interface{}{int64(100), int64(101), int64(102)}},
+		{name: "Code", physical: pqByteArray, converted: 0, optional: true, dict: true, values: []interface{}{"a", nil, "b"}},
+	}
+	dir := t.TempDir()
+	for _, codec := range []int32{pqUncompressed, pqSnappy, pqGzip, pqZstd} {
+		path := filepath.Join(dir, "valid.parquet")
+		writeTestParquet(t, path, codec, cols)
+		valid, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// corrupted bytes anywhere, including sizes, counts and offsets of
+		// the metadata, give an error or wrong values but never a panic
+		r := rand.New(rand.NewSource(int64(codec)))
+		bad := filepath.Join(dir, "bad.parquet")
+		for i := 0; i < 3000; i++ {
+			data := append([]byte(nil), valid...)
+			for k := 0; k < 1+r.Intn(3); k++ {
+				data[4+r.Intn(len(data)-12)] = byte(r.Intn(256))
+			}
+			if err := os.WriteFile(bad, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			readAllParquet(t, bad)
+		}
+
+		// every truncation of the file
+		for n := 0; n < len(valid); n++ {
+			data := append(valid[:n:n], []byte("PAR1")...)
+			if err := os.WriteFile(bad, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			readAllParquet(t, bad)
+		}
+	}
+}
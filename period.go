@@ -0,0 +1,119 @@
+// period.go
+//
+// EventDate filter of a run: -since (inclusive) and -until (exclusive), or a
+// relative -window such as 90d anchored on -ref-date.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// period is the EventDate range of a run: Since inclusive, Until exclusive.
+// A zero Until means no upper bound.
+type period struct {
+	Since  time.Time
+	Until  time.Time
+	Window string // relative window the period was built from, if any
+
+	// InsertedAfter restricts the events to those after the watermark of
+	// -incremental (see incremental.go); zero loads every event
+	InsertedAfter watermark
+}
+
+func (p period) contains(t time.Time) bool {
+	return !t.Before(p.Since) && (p.Until.IsZero() || t.Before(p.Until))
+}
+
+func (p period) String() string {
+	if p.Until.IsZero() {
+		return fmt.Sprintf("[%s, -)", p.Since.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("[%s, %s)", p.Since.Format("2006-01-02"), p.Until.Format("2006-01-02"))
+}
+
+// tableSuffix identifies the period in export table names; empty for the
+// historical open-ended -since run so existing table names are unchanged
+func (p period) tableSuffix() string {
+	if p.Until.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("_%s_%s", p.Since.Format("20060102"), p.Until.Format("20060102"))
+}
+
+// parseWindow reads a relative window: a positive count followed by
+// d (days), w (weeks), m (months) or y (years), e.g. 90d, 12w, 6m, 1y
+func parseWindow(s string) (n int, unit byte, err error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if len(s) < 2 {
+		return 0, 0, fmt.Errorf("invalid window %q (expected e.g. 90d, 12w, 6m, 1y)", s)
+	}
+	unit = s[len(s)-1]
+	n, err = strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 || strings.IndexByte("dwmy", unit) < 0 {
+		return 0, 0, fmt.Errorf("invalid window %q (expected e.g. 90d, 12w, 6m, 1y)", s)
+	}
+	return n, unit, nil
+}
+
+// windowStart returns ref minus the window
+func windowStart(ref time.Time, n int, unit byte) time.Time {
+	switch unit {
+	case 'w':
+		return ref.AddDate(0, 0, -7*n)
+	case 'm':
+		return ref.AddDate(0, -n, 0)
+	case 'y':
+		return ref.AddDate(-n, 0, 0)
+	}
+	return ref.AddDate(0, 0, -n)
+}
+
+// periodOptions are the raw flag values; *Set tell whether the flag was given
+type periodOptions struct {
+	Since, Until, Window, RefDate string
+	SinceSet, UntilSet, RefSet    bool
+}
+
+// resolvePeriod validates the time filter flags together. With -window, the
+// period is [ref-window, ref) where ref is -ref-date (default today), and
+// -since / -until must not be given.
+func resolvePeriod(o periodOptions, today time.Time) (period, error) {
+	if o.Window == "" {
+		if o.RefSet {
+			return period{}, fmt.Errorf("-ref-date is only used with -window")
+		}
+		since, err := time.Parse("2006-01-02", o.Since)
+		if err != nil {
+			return period{}, fmt.Errorf("invalid -since %q: %w", o.Since, err)
+		}
+		p := period{Since: since}
+		if o.Until != "" {
+			if p.Until, err = time.Parse("2006-01-02", o.Until); err != nil {
+				return period{}, fmt.Errorf("invalid -until %q: %w", o.Until, err)
+			}
+			if !p.Until.After(p.Since) {
+				return period{}, fmt.Errorf("-until %s must be after -since %s", o.Until, o.Since)
+			}
+		}
+		return p, nil
+	}
+
+	if o.SinceSet || o.UntilSet {
+		return period{}, fmt.Errorf("-window cannot be combined with -since or -until")
+	}
+	n, unit, err := parseWindow(o.Window)
+	if err != nil {
+		return period{}, err
+	}
+	ref := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	if o.RefDate != "" {
+		if ref, err = time.Parse("2006-01-02", o.RefDate); err != nil {
+			return period{}, fmt.Errorf("invalid -ref-date %q: %w", o.RefDate, err)
+		}
+	}
+	return period{Since: windowStart(ref, n, unit), Until: ref, Window: o.Window}, nil
+}
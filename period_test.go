@@ -0,0 +1,125 @@
+// period_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// -------------------- Tests pour parseWindow --------------------
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		in      string
+		n       int
+		unit    byte
+		wantErr bool
+	}{
+		{"90d", 90, 'd', false},
+		{"12W", 12, 'w', false},
+		{"6m", 6, 'm', false},
+		{"1y", 1, 'y', false},
+		{"0d", 0, 0, true},
+		{"-3d", 0, 0, true},
+		{"90", 0, 0, true},
+		{"d", 0, 0, true},
+		{"3h", 0, 0, true},
+	}
+	for _, tt := range tests {
+		n, unit, err := parseWindow(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if n != tt.n || unit != tt.unit {
+			t.Errorf("%q: got %d%c, want %d%c", tt.in, n, unit, tt.n, tt.unit)
+		}
+	}
+}
+
+// -------------------- Tests pour resolvePeriod --------------------
+
+func TestResolvePeriod(t *testing.T) {
+	today := time.Date(2021, 3, 31, 15, 4, 5, 0, time.UTC)
+
+	t.Run("since only", func(t *testing.T) {
+		p, err := resolvePeriod(periodOptions{Since: "2020-04-01"}, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Since.Equal(mustParseDate("2020-04-01")) || !p.Until.IsZero() {
+			t.Errorf("unexpected period %s", p)
+		}
+		if p.tableSuffix() != "" {
+			t.Errorf("open-ended period should keep legacy table name, got suffix %q", p.tableSuffix())
+		}
+	})
+
+	t.Run("since and until", func(t *testing.T) {
+		p, err := resolvePeriod(periodOptions{Since: "2020-04-01", Until: "2020-07-01", UntilSet: true}, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Until.Equal(mustParseDate("2020-07-01")) {
+			t.Errorf("unexpected period %s", p)
+		}
+		if p.tableSuffix() != "_20200401_20200701" {
+			t.Errorf("unexpected table suffix %q", p.tableSuffix())
+		}
+	})
+
+	t.Run("window anchored on today", func(t *testing.T) {
+		p, err := resolvePeriod(periodOptions{Since: "2020-04-01", Window: "90d"}, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Since.Equal(mustParseDate("2020-12-31")) || !p.Until.Equal(mustParseDate("2021-03-31")) {
+			t.Errorf("unexpected period %s", p)
+		}
+	})
+
+	t.Run("window anchored on ref date", func(t *testing.T) {
+		p, err := resolvePeriod(periodOptions{Window: "6m", RefDate: "2020-07-01", RefSet: true}, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Since.Equal(mustParseDate("2020-01-01")) || !p.Until.Equal(mustParseDate("2020-07-01")) || p.Window != "6m" {
+			t.Errorf("unexpected period %s (window %q)", p, p.Window)
+		}
+	})
+
+	errCases := map[string]periodOptions{
+		"until before since":   {Since: "2020-04-01", Until: "2020-04-01", UntilSet: true},
+		"invalid since":        {Since: "2020/04/01"},
+		"invalid until":        {Since: "2020-04-01", Until: "tomorrow", UntilSet: true},
+		"window with since":    {Since: "2020-04-01", SinceSet: true, Window: "90d"},
+		"window with until":    {Since: "2020-04-01", Until: "2020-07-01", UntilSet: true, Window: "90d"},
+		"ref date sans window": {Since: "2020-04-01", RefDate: "2020-07-01", RefSet: true},
+		"invalid window":       {Window: "90"},
+		"invalid ref date":     {Window: "90d", RefDate: "x", RefSet: true},
+	}
+	for name, o := range errCases {
+		if _, err := resolvePeriod(o, today); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// -------------------- Tests pour period.contains --------------------
+
+func TestPeriodContains(t *testing.T) {
+	p := period{Since: mustParseDate("2020-04-01"), Until: mustParseDate("2020-05-01")}
+	if !p.contains(mustParseDate("2020-04-01")) {
+		t.Error("since should be inclusive")
+	}
+	if p.contains(mustParseDate("2020-05-01")) {
+		t.Error("until should be exclusive")
+	}
+	if p.contains(mustParseDate("2020-03-31")) {
+		t.Error("date before since should be excluded")
+	}
+	open := period{Since: mustParseDate("2020-04-01")}
+	if !open.contains(mustParseDate("2030-01-01")) {
+		t.Error("open-ended period should have no upper bound")
+	}
+}
@@ -0,0 +1,230 @@
+// products.go
+//
+// Per-content breakdown (-products): net revenue and units of every ContentID,
+// over all customers and per customer quantile, with the share of the
+// quantile's revenue and the lift against the overall share, so the products
+// over-represented in the top quantile stand out.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// quantileAll is the QuantileIndex of the breakdown over all customers
+const quantileAll = -1
+
+// contentTotals accumulates the valued events of one customer on one content
+type contentTotals struct {
+	Revenue   Money
+	Units     int
+	Purchased bool // at least one purchase, refunds alone do not make a buyer
+}
+
+// productTracker records contentTotals per customer in the same pass as the
+// CA; they are grouped by quantile once the customers are ranked
+type productTracker struct {
+	byCustomer map[int64]map[int]*contentTotals
+}
+
+func newProductTracker() *productTracker {
+	return &productTracker{byCustomer: make(map[int64]map[int]*contentTotals)}
+}
+
+func (t *productTracker) get(customerID int64, contentID int) *contentTotals {
+	m := t.byCustomer[customerID]
+	if m == nil {
+		m = make(map[int]*contentTotals)
+		t.byCustomer[customerID] = m
+	}
+	c := m[contentID]
+	if c == nil {
+		c = &contentTotals{}
+		m[contentID] = c
+	}
+	return c
+}
+
+func (t *productTracker) purchase(customerID int64, contentID, units int, amount Money) {
+	c := t.get(customerID, contentID)
+	c.Revenue += amount
+	c.Units += units
+	c.Purchased = true
+}
+
+func (t *productTracker) refund(customerID int64, contentID, units int, amount Money) {
+	c := t.get(customerID, contentID)
+	c.Revenue -= amount
+	c.Units -= units
+}
+
+// ProductStats is the revenue of a content within a quantile (or quantileAll)
+type ProductStats struct {
+	Quantile  int
+	ContentID int
+	Revenue   Money
+	Units     int
+	Buyers    int             // customers of the quantile who purchased the content
+	Share     sql.NullFloat64 // Revenue / revenue of the quantile, NULL unless that revenue is positive
+	Lift      sql.NullFloat64 // Share / share of the content over all customers, NULL unless that share is positive
+	Rank      int             // 1 = highest revenue in the quantile
+}
+
+// breakdown groups the contents by quantile of the ranked customers; the
+// result starts with quantileAll, then every quantile, each ordered by rank
+func (t *productTracker) breakdown(ranked []RankedCustomer) []ProductStats {
+	type key struct{ quantile, content int }
+	stats := map[key]*ProductStats{}
+	totals := map[int]Money{}
+	add := func(q, content int, c *contentTotals) {
+		k := key{q, content}
+		s := stats[k]
+		if s == nil {
+			s = &ProductStats{Quantile: q, ContentID: content}
+			stats[k] = s
+		}
+		s.Revenue += c.Revenue
+		s.Units += c.Units
+		if c.Purchased {
+			s.Buyers++
+		}
+		totals[q] += c.Revenue
+	}
+	for _, r := range ranked {
+		for content, c := range t.byCustomer[r.CustomerID] {
+			add(quantileAll, content, c)
+			add(r.Quantile, content, c)
+		}
+	}
+
+	out := make([]ProductStats, 0, len(stats))
+	for _, s := range stats {
+		// refunds can bring the revenue of a quantile to zero or below,
+		// where a share means nothing
+		if total := totals[s.Quantile]; total > 0 {
+			s.Share = sql.NullFloat64{Float64: s.Revenue.Float64() / total.Float64(), Valid: true}
+		}
+		out = append(out, *s)
+	}
+	overall := map[int]sql.NullFloat64{}
+	for _, s := range out {
+		if s.Quantile == quantileAll {
+			overall[s.ContentID] = s.Share
+		}
+	}
+	for i := range out {
+		if o := overall[out[i].ContentID]; out[i].Share.Valid && o.Valid && o.Float64 > 0 {
+			out[i].Lift = sql.NullFloat64{Float64: out[i].Share.Float64 / o.Float64, Valid: true}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Quantile != out[j].Quantile {
+			return out[i].Quantile < out[j].Quantile
+		}
+		if out[i].Revenue != out[j].Revenue {
+			return out[i].Revenue > out[j].Revenue
+		}
+		return out[i].ContentID < out[j].ContentID
+	})
+	for i := range out {
+		if i > 0 && out[i].Quantile == out[i-1].Quantile {
+			out[i].Rank = out[i-1].Rank + 1
+		} else {
+			out[i].Rank = 1
+		}
+	}
+	return out
+}
+
+// logTopProducts logs the first n contents of the top quantile
+func logTopProducts(products []ProductStats, n int) {
+	log.Info("========== TOP QUANTILE PRODUCTS ==========")
+	for _, p := range products {
+		if p.Quantile != 0 || p.Rank > n {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"rank":       p.Rank,
+			"content_id": p.ContentID,
+			"revenue":    p.Revenue.String(),
+			"units":      p.Units,
+			"buyers":     p.Buyers,
+			"share":      formatRatio(p.Share, 100, "%.2f%%"),
+			"lift":       formatRatio(p.Lift, 1, "%.2f"),
+		}).Info("top quantile product")
+	}
+	log.Info("===========================================")
+}
+
+// runProducts logs the top products and exports the breakdown to
+// test_products_YYYYMMDD[_<since>_<until>]
+func runProducts(db *sql.DB, p period, run *runRecord, products []ProductStats) error {
+	logTopProducts(products, 10)
+	tableName := fmt.Sprintf("test_products_%s%s", time.Now().Format("20060102"), p.tableSuffix())
+	if db == nil {
+		log.WithField("table", tableName).Warn("no database configured; product export skipped")
+		return nil
+	}
+	err := replaceTable(db, tableName, func(staging string) error {
+		if err := ensureProductTable(db, staging); err != nil {
+			return err
+		}
+		if len(products) == 0 {
+			return nil
+		}
+		log.WithFields(log.Fields{"stage": "EXPORT", "table": staging, "count": len(products)}).Info("exporting product breakdown (batch)")
+		columns := []string{"QuantileIndex", "ContentID", "Revenue", "Units", "Buyers", "RevenueShare", "Lift", "ProductRank", "RunID"}
+		return insertRows(db, staging, columns, len(products), func(i int) []interface{} {
+			s := products[i]
+			return []interface{}{s.Quantile, s.ContentID, s.Revenue, s.Units, s.Buyers,
+				decimalArg(s.Share, 20, 6), decimalArg(s.Lift, 20, 4), s.Rank, run.ID}
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export products: %w", err)
+	}
+	run.ProductTable = tableName
+	return nil
+}
+
+func ensureProductTable(db *sql.DB, tableName string) error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	QuantileIndex INT NOT NULL,
+	ContentID INT NOT NULL,
+	Revenue DECIMAL(18,2) NOT NULL,
+	Units INT NOT NULL,
+	Buyers INT NOT NULL,
+	RevenueShare DECIMAL(20,6) NULL,
+	Lift DECIMAL(20,4) NULL,
+	ProductRank INT NOT NULL,
+	RunID BIGINT NOT NULL,
+	PRIMARY KEY (QuantileIndex, ContentID)
+) ENGINE=InnoDB;`, tableName)
+	_, err := db.Exec(q)
+	return err
+}
+
+// formatRatio formats v*factor for the logs, n/a when v is NULL
+func formatRatio(v sql.NullFloat64, factor float64, format string) string {
+	if !v.Valid {
+		return "n/a"
+	}
+	return fmt.Sprintf(format, v.Float64*factor)
+}
+
+// decimalArg is the value of v for a DECIMAL(precision, scale) column: NULL
+// when v is NULL or too large for the column
+func decimalArg(v sql.NullFloat64, precision, scale int) interface{} {
+	if !v.Valid || math.Abs(v.Float64) >= math.Pow10(precision-scale) {
+		return nil
+	}
+	return strconv.FormatFloat(v.Float64, 'f', scale, 64)
+}
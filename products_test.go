@@ -0,0 +1,106 @@
+// products_test.go
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// -------------------- Tests pour la ventilation par produit --------------------
+
+func TestProductBreakdown(t *testing.T) {
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7}}
+	agg := newCAAggregator(map[int]Money{10: mustParseMoney("100.00"), 11: mustParseMoney("10.00")}).
+		withEventTypes(et).withProducts()
+	for _, e := range []EventRow{
+		{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 2},
+		{ContentID: 11, CustomerID: 100, EventTypeID: 6, Quantity: 1},
+		{ContentID: 11, CustomerID: 101, EventTypeID: 6, Quantity: 5},
+		{ContentID: 11, CustomerID: 101, EventTypeID: 7, Quantity: 1},
+		{ContentID: 10, CustomerID: 102, EventTypeID: 7, Quantity: 1}, // refund of an earlier purchase
+		{ContentID: 11, CustomerID: 102, EventTypeID: 6, Quantity: 20},
+	} {
+		agg.add(e)
+	}
+	agg.result()
+
+	// CA: 100 = 210.00, 102 = 100.00, 101 = 40.00; three buckets of one customer
+	spec := bucketSpec{Method: methodEqualCount, Quantile: 1.0 / 3, Ties: tiesSplit}
+	ranked := rankCustomers(agg.customers(nil, metricCA), spec)
+	got := agg.products.breakdown(ranked)
+
+	want := []ProductStats{
+		{Quantile: quantileAll, ContentID: 11, Revenue: 25000, Units: 25, Buyers: 3, Rank: 1},
+		{Quantile: quantileAll, ContentID: 10, Revenue: 10000, Units: 1, Buyers: 1, Rank: 2},
+		{Quantile: 0, ContentID: 10, Revenue: 20000, Units: 2, Buyers: 1, Rank: 1},
+		{Quantile: 0, ContentID: 11, Revenue: 1000, Units: 1, Buyers: 1, Rank: 2},
+		{Quantile: 1, ContentID: 11, Revenue: 20000, Units: 20, Buyers: 1, Rank: 1},
+		{Quantile: 1, ContentID: 10, Revenue: -10000, Units: -1, Buyers: 0, Rank: 2},
+		{Quantile: 2, ContentID: 11, Revenue: 4000, Units: 4, Buyers: 1, Rank: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d rows, got %d: %+v", len(want), len(got), got)
+	}
+	for i, w := range want {
+		g := got[i]
+		g.Share, g.Lift = sql.NullFloat64{}, sql.NullFloat64{}
+		if g != w {
+			t.Errorf("row %d: got %+v, want %+v", i, got[i], w)
+		}
+	}
+
+	// content 10 is 20000/21000 of the top quantile and 10000/35000 overall
+	top := got[2]
+	if !floatEqual(top.Share.Float64, 20000.0/21000, 1e-9) || !floatEqual(top.Lift.Float64, (20000.0/21000)/(10000.0/35000), 1e-9) {
+		t.Errorf("top quantile content 10: share %v, lift %v", top.Share, top.Lift)
+	}
+}
+
+func TestProductBreakdownRefundHeavy(t *testing.T) {
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7}}
+	agg := newCAAggregator(map[int]Money{10: mustParseMoney("100.00"), 11: mustParseMoney("0.01"), 12: mustParseMoney("99.99")}).
+		withEventTypes(et).withProducts()
+	for _, e := range []EventRow{
+		{ContentID: 10, CustomerID: 100, EventTypeID: 6, Quantity: 2},
+		// net 0.01: the share of content 10 in its quantile is 10000
+		{ContentID: 10, CustomerID: 101, EventTypeID: 6, Quantity: 1},
+		{ContentID: 12, CustomerID: 101, EventTypeID: 7, Quantity: 1},
+		// net -99.80: no share in its quantile
+		{ContentID: 10, CustomerID: 102, EventTypeID: 7, Quantity: 1},
+		{ContentID: 11, CustomerID: 102, EventTypeID: 6, Quantity: 20},
+	} {
+		agg.add(e)
+	}
+	agg.result()
+
+	spec := bucketSpec{Method: methodEqualCount, Quantile: 1.0 / 3, Ties: tiesSplit}
+	ranked := rankCustomers(agg.customers(nil, metricCA), spec)
+	checked := 0
+	for _, p := range agg.products.breakdown(ranked) {
+		share, lift := decimalArg(p.Share, 20, 6), decimalArg(p.Lift, 20, 4)
+		switch {
+		case p.Quantile == 1 && p.ContentID == 10:
+			checked++
+			if share != "10000.000000" {
+				t.Errorf("quantile 1 content 10: share %v, want 10000.000000", share)
+			}
+		case p.Quantile == 2:
+			checked++
+			if share != nil || lift != nil {
+				t.Errorf("quantile 2 content %d: share %v, lift %v, want NULL", p.ContentID, share, lift)
+			}
+		case p.ContentID == 12:
+			// negative share over all customers: no lift
+			if lift != nil {
+				t.Errorf("quantile %d content 12: lift %v, want NULL", p.Quantile, lift)
+			}
+		}
+	}
+	if checked != 3 {
+		t.Errorf("checked %d rows, want 3", checked)
+	}
+
+	if v := decimalArg(sql.NullFloat64{Float64: 1e15, Valid: true}, 20, 6); v != nil {
+		t.Errorf("decimalArg out of range: got %v, want NULL", v)
+	}
+}
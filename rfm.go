@@ -0,0 +1,316 @@
+// rfm.go
+//
+// RFM segmentation (-mode=rfm): recency (last purchase), frequency (purchase
+// count) and monetary value (CA) are each scored 1-5 by cutting the customers
+// into quintiles with the quantile engine, then a rule table maps the three
+// scores to a named segment.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rfmScores       = 5       // quintiles: 5 is the best score
+	rfmOtherSegment = "Other" // customers matched by no rule
+)
+
+// rfmScore holds the recency, frequency and monetary scores, 1 to rfmScores
+type rfmScore struct {
+	R, F, M int
+}
+
+func (s rfmScore) String() string {
+	return fmt.Sprintf("%d%d%d", s.R, s.F, s.M)
+}
+
+// RFMCustomer is a customer with its scores and segment
+type RFMCustomer struct {
+	CustomerCA
+	rfmScore
+	Segment string
+}
+
+// rfmRule assigns Segment to customers whose scores fall in the three
+// inclusive ranges; the first matching rule wins
+type rfmRule struct {
+	Segment string
+	R, F, M [2]int
+}
+
+func (r rfmRule) match(s rfmScore) bool {
+	in := func(v int, rg [2]int) bool { return v >= rg[0] && v <= rg[1] }
+	return in(s.R, r.R) && in(s.F, r.F) && in(s.M, r.M)
+}
+
+// defaultRFMRules covers every score combination
+var defaultRFMRules = []rfmRule{
+	{"Champions", [2]int{4, 5}, [2]int{4, 5}, [2]int{1, 5}},
+	{"Loyal Customers", [2]int{3, 5}, [2]int{3, 5}, [2]int{1, 5}},
+	{"New Customers", [2]int{5, 5}, [2]int{1, 1}, [2]int{1, 5}},
+	{"Potential Loyalists", [2]int{3, 5}, [2]int{1, 2}, [2]int{1, 5}},
+	{"Can't Lose Them", [2]int{1, 1}, [2]int{4, 5}, [2]int{4, 5}},
+	{"At Risk", [2]int{1, 2}, [2]int{3, 5}, [2]int{1, 5}},
+	{"Lost", [2]int{1, 1}, [2]int{1, 2}, [2]int{1, 2}},
+	{"Hibernating", [2]int{1, 2}, [2]int{1, 2}, [2]int{1, 5}},
+}
+
+// segmentOf returns the segment of the first rule matching s
+func segmentOf(rules []rfmRule, s rfmScore) string {
+	for _, r := range rules {
+		if r.match(s) {
+			return r.Segment
+		}
+	}
+	return rfmOtherSegment
+}
+
+func loadRFMRules(path string) ([]rfmRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out, err := parseRFMRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
+
+// parseRFMRules reads a CSV rule table with header segment,r,f,m; a score is
+// a range such as 4-5, a single score such as 5, or * for any score
+func parseRFMRules(r io.Reader) ([]rfmRule, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	idx := make([]int, 4)
+	for i, name := range []string{"segment", "r", "f", "m"} {
+		var ok bool
+		if idx[i], ok = col[name]; !ok {
+			return nil, fmt.Errorf("header must contain segment, r, f and m columns, got %v", header)
+		}
+	}
+
+	var out []rfmRule
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range idx {
+			if i >= len(rec) {
+				return nil, fmt.Errorf("line %d: missing columns", line)
+			}
+		}
+		rule := rfmRule{Segment: strings.TrimSpace(rec[idx[0]])}
+		if rule.Segment == "" {
+			return nil, fmt.Errorf("line %d: empty segment", line)
+		}
+		for i, rg := range []*[2]int{&rule.R, &rule.F, &rule.M} {
+			if *rg, err = parseScoreRange(rec[idx[i+1]]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		out = append(out, rule)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	return out, nil
+}
+
+func parseScoreRange(s string) ([2]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return [2]int{1, rfmScores}, nil
+	}
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	a, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	b, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || a < 1 || b > rfmScores || a > b {
+		return [2]int{}, fmt.Errorf("invalid score range %q (expected 1-%d, a single score or *)", s, rfmScores)
+	}
+	return [2]int{a, b}, nil
+}
+
+// scoreDimension scores every customer on metric: the customers are sorted by
+// the metric and cut into rfmScores equal-count buckets, bucket 0 scoring
+// rfmScores. Equal values always share a score (tiesKeepHigher), so a
+// dimension with many ties may leave some scores unused.
+func scoreDimension(customers []CustomerCA, metric string) map[int64]int {
+	sorted := append([]CustomerCA(nil), customers...)
+	sortCustomers(sorted, metric)
+	spec := bucketSpec{Method: methodEqualCount, Quantile: 1.0 / rfmScores, Ties: tiesKeepHigher, RankBy: metric}
+	ends := spec.bounds(sorted)
+	scores := make(map[int64]int, len(sorted))
+	q := 0
+	for i, c := range sorted {
+		for i >= ends[q] {
+			q++
+		}
+		scores[c.CustomerID] = rfmScores - q
+	}
+	return scores
+}
+
+// scoreRFM scores and segments the customers, keeping their order
+func scoreRFM(customers []CustomerCA, rules []rfmRule) []RFMCustomer {
+	if len(customers) == 0 {
+		return nil
+	}
+	r := scoreDimension(customers, metricRecency)
+	f := scoreDimension(customers, metricPurchases)
+	m := scoreDimension(customers, metricCA)
+	out := make([]RFMCustomer, len(customers))
+	for i, c := range customers {
+		s := rfmScore{R: r[c.CustomerID], F: f[c.CustomerID], M: m[c.CustomerID]}
+		out[i] = RFMCustomer{CustomerCA: c, rfmScore: s, Segment: segmentOf(rules, s)}
+	}
+	return out
+}
+
+// rfmSegmentStats summarizes a segment for the log
+type rfmSegmentStats struct {
+	Segment      string
+	NbClients    int
+	TotalCA      Money
+	RevenueShare float64
+}
+
+// rfmSummary returns the segments by decreasing number of customers
+func rfmSummary(customers []RFMCustomer) []rfmSegmentStats {
+	bySeg := map[string]*rfmSegmentStats{}
+	var grandTotal Money
+	for _, c := range customers {
+		s, ok := bySeg[c.Segment]
+		if !ok {
+			s = &rfmSegmentStats{Segment: c.Segment}
+			bySeg[c.Segment] = s
+		}
+		s.NbClients++
+		s.TotalCA += c.CA
+		grandTotal += c.CA
+	}
+	out := make([]rfmSegmentStats, 0, len(bySeg))
+	for _, s := range bySeg {
+		if grandTotal != 0 {
+			s.RevenueShare = s.TotalCA.Float64() / grandTotal.Float64()
+		}
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].NbClients != out[j].NbClients {
+			return out[i].NbClients > out[j].NbClients
+		}
+		return out[i].Segment < out[j].Segment
+	})
+	return out
+}
+
+// recencyDays is the number of days between the last purchase and ref, nil
+// without purchase
+func recencyDays(last, ref time.Time) interface{} {
+	if last.IsZero() {
+		return nil
+	}
+	return dayNumber(ref) - dayNumber(last)
+}
+
+// runRFM scores the customers, logs the segments and exports every customer
+// to test_rfm_YYYYMMDD[_<since>_<until>]; recency is measured at ref
+func runRFM(db *sql.DB, p period, run *runRecord, customers []CustomerCA, rules []rfmRule, ref time.Time) error {
+	scored := scoreRFM(customers, rules)
+	if len(scored) == 0 {
+		log.Warn("no RFM segments (no customers)")
+	} else {
+		log.Info("========== RFM SEGMENTS ==========")
+		for _, s := range rfmSummary(scored) {
+			log.WithFields(log.Fields{
+				"segment":       s.Segment,
+				"nb_clients":    s.NbClients,
+				"total_ca":      s.TotalCA.String(),
+				"revenue_share": fmt.Sprintf("%.2f%%", s.RevenueShare*100),
+			}).Info("segment summary")
+		}
+		log.Info("==================================")
+	}
+
+	tableName := fmt.Sprintf("test_rfm_%s%s", time.Now().Format("20060102"), p.tableSuffix())
+	if db == nil {
+		log.WithField("table", tableName).Warn("no database configured; export skipped")
+		return nil
+	}
+	err := replaceTable(db, tableName, func(staging string) error {
+		if err := ensureRFMTable(db, staging); err != nil {
+			return err
+		}
+		return exportRFM(db, staging, scored, ref, run.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export RFM segments: %w", err)
+	}
+	run.ExportTable = tableName
+	return nil
+}
+
+func ensureRFMTable(db *sql.DB, tableName string) error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	CustomerID BIGINT NOT NULL PRIMARY KEY,
+	Email VARCHAR(255),
+	LastPurchase DATE NULL,
+	RecencyDays INT NULL,
+	Frequency INT NOT NULL,
+	Monetary DECIMAL(18,2) NOT NULL,
+	R TINYINT NOT NULL,
+	F TINYINT NOT NULL,
+	M TINYINT NOT NULL,
+	RFMScore CHAR(3) NOT NULL,
+	Segment VARCHAR(64) NOT NULL,
+	RunID BIGINT NOT NULL
+) ENGINE=InnoDB;`, tableName)
+	_, err := db.Exec(q)
+	return err
+}
+
+func exportRFM(db *sql.DB, tableName string, customers []RFMCustomer, ref time.Time, runID int64) error {
+	if len(customers) == 0 {
+		log.Info("no customers to export")
+		return nil
+	}
+	log.WithFields(log.Fields{"stage": "EXPORT", "table": tableName, "count": len(customers)}).Info("exporting RFM segments (batch)")
+	columns := []string{"CustomerID", "Email", "LastPurchase", "RecencyDays", "Frequency", "Monetary",
+		"R", "F", "M", "RFMScore", "Segment", "RunID"}
+	return insertRows(db, tableName, columns, len(customers), func(i int) []interface{} {
+		c := customers[i]
+		return []interface{}{c.CustomerID, c.Email, sqlDate(c.LastPurchase), recencyDays(c.LastPurchase, ref), c.Purchases, c.CA,
+			c.R, c.F, c.M, c.rfmScore.String(), c.Segment, runID}
+	})
+}
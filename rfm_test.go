@@ -0,0 +1,126 @@
+// rfm_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// -------------------- Tests pour parseRFMRules --------------------
+
+func TestParseRFMRules(t *testing.T) {
+	t.Run("ranges, single scores and wildcards", func(t *testing.T) {
+		in := "segment,r,f,m\nVIP, 5 ,4-5,*\nRest,*,*,*\n"
+		rules, err := parseRFMRules(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(rules) != 2 || rules[0].Segment != "VIP" || rules[0].R != [2]int{5, 5} || rules[0].F != [2]int{4, 5} || rules[0].M != [2]int{1, 5} {
+			t.Errorf("unexpected rules %+v", rules)
+		}
+	})
+
+	errCases := map[string]string{
+		"missing column":  "segment,r,f\nVIP,5,5\n",
+		"score too high":  "segment,r,f,m\nVIP,6,*,*\n",
+		"reversed range":  "segment,r,f,m\nVIP,5-4,*,*\n",
+		"empty segment":   "segment,r,f,m\n,5,*,*\n",
+		"no rules at all": "segment,r,f,m\n",
+	}
+	for name, in := range errCases {
+		if _, err := parseRFMRules(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// -------------------- Tests pour les segments --------------------
+
+func TestSegmentOf(t *testing.T) {
+	t.Run("default rules cover every score", func(t *testing.T) {
+		for r := 1; r <= rfmScores; r++ {
+			for f := 1; f <= rfmScores; f++ {
+				for m := 1; m <= rfmScores; m++ {
+					if seg := segmentOf(defaultRFMRules, rfmScore{r, f, m}); seg == rfmOtherSegment {
+						t.Errorf("score %d%d%d matches no default rule", r, f, m)
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("first matching rule wins", func(t *testing.T) {
+		tests := map[rfmScore]string{
+			{5, 5, 5}: "Champions",
+			{5, 1, 3}: "New Customers",
+			{1, 5, 5}: "Can't Lose Them",
+			{1, 5, 1}: "At Risk",
+			{1, 1, 1}: "Lost",
+		}
+		for s, want := range tests {
+			if got := segmentOf(defaultRFMRules, s); got != want {
+				t.Errorf("score %s: got %s, want %s", s, got, want)
+			}
+		}
+		if got := segmentOf([]rfmRule{{"VIP", [2]int{5, 5}, [2]int{5, 5}, [2]int{5, 5}}}, rfmScore{4, 5, 5}); got != rfmOtherSegment {
+			t.Errorf("got %s, want %s", got, rfmOtherSegment)
+		}
+	})
+}
+
+// -------------------- Tests pour scoreRFM --------------------
+
+func TestScoreRFM(t *testing.T) {
+	day := func(d int) time.Time { return mustParseDate("2020-05-01").AddDate(0, 0, d) }
+	// 10 customers: 100 bought most recently, most often and most; 109 the opposite
+	var customers []CustomerCA
+	for i := 0; i < 10; i++ {
+		customers = append(customers, CustomerCA{
+			CustomerID: int64(100 + i),
+			CA:         Money(1000 - 100*i),
+			Metrics:    Metrics{Purchases: 10 - i, LastPurchase: day(30 - 3*i)},
+		})
+	}
+	customers[9].Purchases = customers[8].Purchases // tie on frequency
+
+	scored := scoreRFM(customers, defaultRFMRules)
+	if len(scored) != 10 || scored[0].CustomerID != 100 {
+		t.Fatalf("expected the 10 customers in input order, got %d", len(scored))
+	}
+	if s := scored[0].rfmScore; s != (rfmScore{5, 5, 5}) || scored[0].Segment != "Champions" {
+		t.Errorf("customer 100: got %s %s, want 555 Champions", s, scored[0].Segment)
+	}
+	if s := scored[5].rfmScore; s != (rfmScore{3, 3, 3}) {
+		t.Errorf("customer 105: got %s, want 333", s)
+	}
+	if scored[8].F != scored[9].F || scored[9].F != 1 {
+		t.Errorf("tied customers must share the frequency score, got %d and %d", scored[8].F, scored[9].F)
+	}
+	if s := scored[9].rfmScore; s.R != 1 || s.M != 1 || scored[9].Segment != "Lost" {
+		t.Errorf("customer 109: got %s %s, want 111 Lost", s, scored[9].Segment)
+	}
+
+	t.Run("customer without purchase has the lowest recency", func(t *testing.T) {
+		cs := []CustomerCA{
+			{CustomerID: 1, CA: -500}, // refunds only
+			{CustomerID: 2, CA: 100, Metrics: Metrics{Purchases: 1, LastPurchase: day(0)}},
+		}
+		got := scoreRFM(cs, defaultRFMRules)
+		if got[0].R >= got[1].R {
+			t.Errorf("expected customer 1 scored below customer 2 on recency, got %d >= %d", got[0].R, got[1].R)
+		}
+		if recencyDays(time.Time{}, day(10)) != nil || recencyDays(day(3), day(10)) != int64(7) {
+			t.Error("unexpected recency days")
+		}
+	})
+
+	summary := rfmSummary(scored)
+	n := 0
+	for _, s := range summary {
+		n += s.NbClients
+	}
+	if n != 10 || summary[0].NbClients < summary[len(summary)-1].NbClients {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
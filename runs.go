@@ -0,0 +1,274 @@
+// runs.go
+//
+// Run metadata: every execution is recorded in the quantile_runs table with its
+// parameters, input row counts, skipped events, per-bucket thresholds, export
+// table and status, and export rows carry the RunID that produced them.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const runsTable = "quantile_runs"
+
+// run statuses
+const (
+	runRunning = "running"
+	runSuccess = "success"
+	runFailed  = "failed"
+)
+
+type runRecord struct {
+	ID         int64
+	Mode       string // quantile, rfm or diff
+	Quantile   float64
+	Since      time.Time
+	Until      time.Time // zero when open-ended
+	WindowSpec string    // relative window (-window), e.g. 90d
+	Pricing    string
+	Currency   string
+	Source     string
+	ExportMode string
+	TiePolicy  string
+	Buckets    string    // quantile method and its parameters, e.g. cuts:0.01,0.05,0.2
+	RankBy     string    // metric ordering the customers
+	Purchase   string    // purchase EventTypeIDs, comma-separated
+	Refund     string    // refund EventTypeIDs, comma-separated
+	SnapshotAt time.Time // zero when the source has no snapshot
+	Watermark  time.Time // InsertDate watermark of -incremental after the run, zero otherwise
+
+	NbEvents    int
+	NbPrices    int
+	NbEmails    int
+	NbCustomers int
+
+	SkippedMissingPrice    int
+	SkippedPredatingPrice  int
+	SkippedUnknownCurrency int
+	NbRefunds              int
+	Refunded               Money
+	Thresholds             []QuantileThreshold
+	Concentration          *concentrationReport // nil without positive CA
+	ExportTable            string
+	CohortTable            string // empty without -cohorts
+	ProductTable           string // empty without -products
+	StartedAt, FinishedAt  time.Time
+	Status                 string
+	Error                  string
+}
+
+// QuantileThreshold is the per-bucket summary stored as JSON in the run row
+type QuantileThreshold struct {
+	Quantile  int     `json:"quantile"`
+	MinCA     Money   `json:"min_ca"`
+	MaxCA     Money   `json:"max_ca"`
+	NbClients int     `json:"nb_clients"`
+	TotalCA   Money   `json:"total_ca"`
+	MeanCA    float64 `json:"mean_ca"`
+	MedianCA  float64 `json:"median_ca"`
+	Share     float64 `json:"revenue_share"`
+}
+
+func quantileThresholds(qStats map[int]QuantileStats) []QuantileThreshold {
+	out := make([]QuantileThreshold, 0, len(qStats))
+	for i := 0; i < len(qStats); i++ {
+		s := qStats[i]
+		out = append(out, QuantileThreshold{
+			Quantile: i, MinCA: s.MinCA, MaxCA: s.MaxCA, NbClients: s.NbClients,
+			TotalCA: s.TotalCA, MeanCA: s.MeanCA, MedianCA: s.MedianCA, Share: s.RevenueShare,
+		})
+	}
+	return out
+}
+
+func ensureRunsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + runsTable + ` (
+	RunID BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	Mode VARCHAR(16) NOT NULL,
+	Quantile DECIMAL(9,6) NOT NULL,
+	Since DATE NOT NULL,
+	Until DATE NULL,
+	WindowSpec VARCHAR(16) NULL,
+	Pricing VARCHAR(32) NOT NULL,
+	Currency VARCHAR(8) NOT NULL,
+	Source VARCHAR(255) NOT NULL,
+	ExportMode VARCHAR(16) NOT NULL,
+	TiePolicy VARCHAR(16) NOT NULL,
+	Buckets VARCHAR(255) NOT NULL,
+	RankBy VARCHAR(32) NOT NULL,
+	PurchaseTypes VARCHAR(255) NOT NULL,
+	RefundTypes VARCHAR(255) NOT NULL,
+	SnapshotAt DATETIME(6) NULL,
+	Watermark DATETIME(6) NULL,
+	NbEvents BIGINT NOT NULL DEFAULT 0,
+	NbPrices BIGINT NOT NULL DEFAULT 0,
+	NbEmails BIGINT NOT NULL DEFAULT 0,
+	NbCustomers BIGINT NOT NULL DEFAULT 0,
+	SkippedMissingPrice BIGINT NOT NULL DEFAULT 0,
+	SkippedPredatingPrice BIGINT NOT NULL DEFAULT 0,
+	SkippedUnknownCurrency BIGINT NOT NULL DEFAULT 0,
+	NbRefunds BIGINT NOT NULL DEFAULT 0,
+	Refunded DECIMAL(18,2) NOT NULL DEFAULT 0,
+	QuantileThresholds TEXT NULL,
+	Concentration TEXT NULL,
+	ExportTable VARCHAR(64) NULL,
+	CohortTable VARCHAR(64) NULL,
+	ProductTable VARCHAR(64) NULL,
+	StartedAt DATETIME(6) NOT NULL,
+	FinishedAt DATETIME(6) NULL,
+	Status VARCHAR(16) NOT NULL,
+	Error TEXT NULL
+) ENGINE=InnoDB;`)
+	if err != nil {
+		return err
+	}
+	return migrateRunsTable(db)
+}
+
+// columnMigration adds a column to tables created before it existed;
+// Definition gives old rows a value through its DEFAULT
+type columnMigration struct {
+	Version    int
+	Column     string
+	Definition string
+}
+
+// runsMigrations lists the columns added to quantile_runs after its first
+// version, in order; a new column is appended here as well as to CREATE TABLE
+var runsMigrations = []columnMigration{
+	{2, "Until", "DATE NULL"},
+	{2, "WindowSpec", "VARCHAR(16) NULL"},
+	{3, "TiePolicy", "VARCHAR(16) NOT NULL DEFAULT 'split'"},
+	{4, "Buckets", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{5, "PurchaseTypes", "VARCHAR(255) NOT NULL DEFAULT '6'"},
+	{5, "RefundTypes", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{5, "NbRefunds", "BIGINT NOT NULL DEFAULT 0"},
+	{5, "Refunded", "DECIMAL(18,2) NOT NULL DEFAULT 0"},
+	{6, "RankBy", "VARCHAR(32) NOT NULL DEFAULT 'ca'"},
+	{7, "Mode", "VARCHAR(16) NOT NULL DEFAULT 'quantile'"},
+	{8, "CohortTable", "VARCHAR(64) NULL"},
+	{9, "ProductTable", "VARCHAR(64) NULL"},
+	{10, "Concentration", "TEXT NULL"},
+	{11, "Watermark", "DATETIME(6) NULL"},
+}
+
+// migrateRunsTable adds the columns missing from an existing quantile_runs
+func migrateRunsTable(db *sql.DB) error {
+	return migrateTable(db, runsTable, runsMigrations)
+}
+
+// migrateTable adds the columns of migrations missing from table
+func migrateTable(db *sql.DB, table string, migrations []columnMigration) error {
+	rows, err := db.Query(`SELECT COLUMN_NAME FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range pendingMigrations(migrations, existing) {
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN `%s` %s", table, m.Column, m.Definition)); err != nil {
+			return fmt.Errorf("migrating %s to version %d (%s): %w", table, m.Version, m.Column, err)
+		}
+		log.WithFields(log.Fields{"table": table, "version": m.Version, "column": m.Column}).Info("table migrated")
+	}
+	return nil
+}
+
+// pendingMigrations returns the migrations whose column is not in existing
+// (lower-cased column names)
+func pendingMigrations(migrations []columnMigration, existing map[string]bool) []columnMigration {
+	var out []columnMigration
+	for _, m := range migrations {
+		if !existing[strings.ToLower(m.Column)] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// startRun inserts the run row with status running and sets r.ID
+func startRun(db *sql.DB, r *runRecord) error {
+	if err := ensureRunsTable(db); err != nil {
+		return err
+	}
+	r.Status = runRunning
+	var until, window interface{}
+	if !r.Until.IsZero() {
+		until = r.Until.Format("2006-01-02")
+	}
+	if r.WindowSpec != "" {
+		window = r.WindowSpec
+	}
+	res, err := db.Exec(`INSERT INTO `+runsTable+` (Mode, Quantile, Since, Until, WindowSpec, Pricing, Currency, Source, ExportMode, TiePolicy, Buckets, RankBy, PurchaseTypes, RefundTypes, StartedAt, Status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Mode, r.Quantile, r.Since.Format("2006-01-02"), until, window, r.Pricing, r.Currency, r.Source, r.ExportMode, r.TiePolicy, r.Buckets, r.RankBy, r.Purchase, r.Refund, r.StartedAt, r.Status)
+	if err != nil {
+		return err
+	}
+	if r.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"run_id": r.ID, "table": runsTable}).Info("run recorded")
+	return nil
+}
+
+// finishRun stores the counters, thresholds and final status of the run
+func finishRun(db *sql.DB, r *runRecord) error {
+	thresholds, err := json.Marshal(r.Thresholds)
+	if err != nil {
+		return err
+	}
+	var conc interface{}
+	if r.Concentration != nil {
+		b, err := json.Marshal(r.Concentration)
+		if err != nil {
+			return err
+		}
+		conc = string(b)
+	}
+	var snapshotAt, watermark, exportTable, cohortTable, productTable, errMsg interface{}
+	if !r.SnapshotAt.IsZero() {
+		snapshotAt = r.SnapshotAt
+	}
+	if !r.Watermark.IsZero() {
+		watermark = r.Watermark
+	}
+	if r.ExportTable != "" {
+		exportTable = r.ExportTable
+	}
+	if r.CohortTable != "" {
+		cohortTable = r.CohortTable
+	}
+	if r.ProductTable != "" {
+		productTable = r.ProductTable
+	}
+	if r.Error != "" {
+		errMsg = r.Error
+	}
+	_, err = db.Exec(`UPDATE `+runsTable+` SET SnapshotAt = ?, Watermark = ?, NbEvents = ?, NbPrices = ?, NbEmails = ?, NbCustomers = ?,
+		SkippedMissingPrice = ?, SkippedPredatingPrice = ?, SkippedUnknownCurrency = ?, NbRefunds = ?, Refunded = ?,
+		QuantileThresholds = ?, Concentration = ?, ExportTable = ?, CohortTable = ?, ProductTable = ?, FinishedAt = ?, Status = ?, Error = ?
+		WHERE RunID = ?`,
+		snapshotAt, watermark, r.NbEvents, r.NbPrices, r.NbEmails, r.NbCustomers,
+		r.SkippedMissingPrice, r.SkippedPredatingPrice, r.SkippedUnknownCurrency, r.NbRefunds, r.Refunded, string(thresholds), conc,
+		exportTable, cohortTable, productTable, r.FinishedAt, r.Status, errMsg, r.ID)
+	return err
+}
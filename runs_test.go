@@ -0,0 +1,59 @@
+// runs_test.go
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// -------------------- Tests pour quantileThresholds --------------------
+
+func TestQuantileThresholds(t *testing.T) {
+	qStats := map[int]QuantileStats{
+		0: {MinCA: 8000, MaxCA: 10000, NbClients: 3, TotalCA: 27000, MeanCA: 90.0, MedianCA: 90.0, RevenueShare: 0.5},
+		1: {MinCA: 1000, MaxCA: 7000, NbClients: 7},
+	}
+	got := quantileThresholds(qStats)
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 thresholds, got %d", len(got))
+	}
+	if got[0].Quantile != 0 || got[1].Quantile != 1 {
+		t.Errorf("thresholds not ordered by quantile: %+v", got)
+	}
+	if got[1].MinCA != mustParseMoney("10.00") || got[1].NbClients != 7 {
+		t.Errorf("quantile 1: unexpected threshold %+v", got[1])
+	}
+
+	b, err := json.Marshal(got[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"quantile":0,"min_ca":80.00,"max_ca":100.00,"nb_clients":3,"total_ca":270.00,"mean_ca":90,"median_ca":90,"revenue_share":0.5}]`
+	if string(b) != want {
+		t.Errorf("json: got %s, want %s", b, want)
+	}
+}
+
+// -------------------- Tests pour pendingMigrations --------------------
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []columnMigration{
+		{Version: 2, Column: "Until", Definition: "DATE NULL"},
+		{Version: 3, Column: "TiePolicy", Definition: "VARCHAR(16) NOT NULL DEFAULT 'split'"},
+	}
+
+	// table of the first version: every column is added, in order
+	got := pendingMigrations(migrations, map[string]bool{"runid": true, "quantile": true})
+	if len(got) != 2 || got[0].Column != "Until" || got[1].Column != "TiePolicy" {
+		t.Errorf("first version: got %+v", got)
+	}
+	// column names from information_schema are compared case-insensitively
+	got = pendingMigrations(migrations, map[string]bool{"runid": true, "until": true})
+	if len(got) != 1 || got[0].Version != 3 {
+		t.Errorf("partly migrated: got %+v", got)
+	}
+	if got := pendingMigrations(migrations, map[string]bool{"until": true, "tiepolicy": true}); len(got) != 0 {
+		t.Errorf("up to date: got %+v", got)
+	}
+}
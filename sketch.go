@@ -0,0 +1,301 @@
+// sketch.go
+//
+// Approximate quantiles (-sketch): instead of materialising and sorting every
+// customer, a first pass feeds the -rank-by values into a KLL sketch holding
+// a few thousand items, the bucket thresholds are read from the sketch, and a
+// second pass assigns every customer to its bucket by value, keeping only the
+// top bucket in memory. The thresholds are approximate, the selection against
+// them is exact.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSketchK = 2000 // -sketch-k
+	minSketchK     = 8
+	medianSketchK  = 200 // per-bucket CA sketches of the approximate medians
+)
+
+// kllSketch is a KLL quantile sketch (Karnin, Lang, Liberty 2016) of int64
+// values. Level h holds items of weight 2^h; when a level is full, it is
+// sorted and every other item, starting at a random offset, is promoted to
+// the next level. Level capacities shrink by 2/3 going down from the top
+// level, so the sketch holds about 3k items whatever the number of values.
+//
+// Error bound: the rank of a value read from the sketch is off by at most
+// ε·n, ε = sketchErrorFactor/k, i.e. 0.15% of the customers with the default
+// k = 2000. The worst error measured over 200 ranks of a million values is
+// about 2.5/k, and sketch_test.go checks 3/k. The offsets come from a fixed
+// seed, so a run on the same data always gives the same thresholds.
+type kllSketch struct {
+	k      int
+	n      int64
+	levels [][]int64
+	rng    *rand.Rand
+}
+
+func newKLLSketch(k int) *kllSketch {
+	if k < minSketchK {
+		k = minSketchK
+	}
+	return &kllSketch{k: k, levels: make([][]int64, 1), rng: rand.New(rand.NewSource(1))}
+}
+
+// capacity of level h, at least 2
+func (s *kllSketch) capacity(h int) int {
+	depth := len(s.levels) - 1 - h
+	c := int(math.Ceil(float64(s.k) * math.Pow(2.0/3.0, float64(depth))))
+	if c < 2 {
+		c = 2
+	}
+	return c
+}
+
+func (s *kllSketch) add(v int64) {
+	s.levels[0] = append(s.levels[0], v)
+	s.n++
+	if len(s.levels[0]) >= s.capacity(0) {
+		s.compress()
+	}
+}
+
+// compress halves every full level into the one above it
+func (s *kllSketch) compress() {
+	for h := 0; h < len(s.levels); h++ {
+		items := s.levels[h]
+		if len(items) < s.capacity(h) {
+			continue
+		}
+		if h+1 == len(s.levels) {
+			s.levels = append(s.levels, nil)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i] < items[j] })
+		// an odd item out stays at this level
+		var odd []int64
+		if len(items)%2 == 1 {
+			odd = []int64{items[len(items)-1]}
+			items = items[:len(items)-1]
+		}
+		for i := s.rng.Intn(2); i < len(items); i += 2 {
+			s.levels[h+1] = append(s.levels[h+1], items[i])
+		}
+		s.levels[h] = append(items[:0], odd...)
+	}
+}
+
+// retained is the number of items held by the sketch
+func (s *kllSketch) retained() int {
+	r := 0
+	for _, l := range s.levels {
+		r += len(l)
+	}
+	return r
+}
+
+// values returns, for every rank r in [1, n] counted from the smallest value,
+// the smallest retained value whose cumulative weight reaches r
+func (s *kllSketch) values(ranks []int64) []int64 {
+	type item struct{ v, w int64 }
+	items := make([]item, 0, s.retained())
+	for h, l := range s.levels {
+		for _, v := range l {
+			items = append(items, item{v, 1 << h})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].v < items[j].v })
+	cum := make([]int64, len(items))
+	var total int64
+	for i, it := range items {
+		total += it.w
+		cum[i] = total
+	}
+	out := make([]int64, len(ranks))
+	if len(items) == 0 {
+		return out
+	}
+	for i, r := range ranks {
+		j := sort.Search(len(cum), func(j int) bool { return cum[j] >= r })
+		if j == len(cum) {
+			j--
+		}
+		out[i] = items[j].v
+	}
+	return out
+}
+
+// sketchErrorFactor bounds the normalized rank error of the sketch: ε = 3/k
+const sketchErrorFactor = 3.0
+
+// sketchInfo describes the sketch behind approximate bounds, for the log
+type sketchInfo struct {
+	K          int
+	Retained   int     // items held by the sketch
+	N          int     // customers
+	RankError  int     // ε·n: a threshold may sit this many customers off its exact position
+	Thresholds []int64 // bucket i holds the -rank-by values >= Thresholds[i] not in a previous bucket
+}
+
+// sketchThresholds returns the -rank-by value starting each bucket but the
+// last, read from the sketch at the nominal ends of the method; a bucket
+// ending past the last customer takes every remaining value
+func (b bucketSpec) sketchThresholds(s *kllSketch) []int64 {
+	n := int(s.n)
+	var ends []int
+	switch b.Method {
+	case methodThresholds:
+		return b.Thresholds
+	case methodCuts:
+		ends = cutEnds(n, b.Cuts)
+	default:
+		ends = equalCountEnds(n, b.Quantile)
+	}
+	ends = ends[:len(ends)-1]
+	// the customer ending a bucket at position e from the top has rank n-e+1
+	// from the bottom
+	ranks := make([]int64, len(ends))
+	for i, e := range ends {
+		if e > n {
+			e = n
+		}
+		ranks[i] = int64(n - e + 1)
+	}
+	out := s.values(ranks)
+	for i, e := range ends {
+		if e >= n {
+			out[i] = math.MinInt64
+		}
+	}
+	return out
+}
+
+// bucketAcc summarizes a bucket in one pass: Welford's running variance and a
+// small sketch of the CA for the median
+type bucketAcc struct {
+	s        QuantileStats
+	mean, m2 float64
+	median   *kllSketch
+}
+
+func (b *bucketAcc) add(c CustomerCA, v int64) {
+	if b.s.NbClients == 0 {
+		b.s.MinCA, b.s.MaxCA, b.s.MinValue, b.s.MaxValue = c.CA, c.CA, v, v
+		b.median = newKLLSketch(medianSketchK)
+	}
+	if c.CA < b.s.MinCA {
+		b.s.MinCA = c.CA
+	}
+	if c.CA > b.s.MaxCA {
+		b.s.MaxCA = c.CA
+	}
+	if v < b.s.MinValue {
+		b.s.MinValue = v
+	}
+	if v > b.s.MaxValue {
+		b.s.MaxValue = v
+	}
+	b.s.NbClients++
+	b.s.TotalCA += c.CA
+	x := c.CA.Float64()
+	d := x - b.mean
+	b.mean += d / float64(b.s.NbClients)
+	b.m2 += d * (x - b.mean)
+	b.median.add(int64(c.CA))
+}
+
+func (b *bucketAcc) stats(grandTotal Money) QuantileStats {
+	s := b.s
+	k := int64(s.NbClients)
+	if k == 0 {
+		return QuantileStats{}
+	}
+	s.MeanCA = s.TotalCA.Float64() / float64(k)
+	s.StdDevCA = math.Sqrt(b.m2 / float64(k))
+	m := b.median.values([]int64{(k + 1) / 2, k/2 + 1})
+	s.MedianCA = (Money(m[0]) + Money(m[1])).Float64() / 2
+	if grandTotal != 0 {
+		s.RevenueShare = float64(s.TotalCA) / float64(grandTotal)
+	}
+	return s
+}
+
+// sketchQuantiles is computeQuantiles in bounded memory. each must yield the
+// same customers on both of its calls. Customers are assigned to buckets by
+// value, so equal values always share a bucket whatever the tie policy. The
+// top bucket is returned sorted with exact statistics; the other buckets have
+// exact counts, totals, extrema and deviations, and a median read from a
+// per-bucket sketch.
+func sketchQuantiles(each func(fn func(CustomerCA)), spec bucketSpec) (map[int]QuantileStats, []CustomerCA, sketchInfo) {
+	sk := newKLLSketch(spec.Sketch)
+	each(func(c CustomerCA) { sk.add(c.key(spec.RankBy)) })
+	info := sketchInfo{K: sk.k, Retained: sk.retained(), N: int(sk.n)}
+	if sk.n == 0 {
+		return nil, nil, info
+	}
+	th := spec.sketchThresholds(sk)
+	info.Thresholds = th
+	info.RankError = int(math.Ceil(sketchErrorFactor / float64(sk.k) * float64(sk.n)))
+
+	// thresholds are non-increasing: the bucket is the first one whose
+	// threshold the value reaches
+	acc := make([]bucketAcc, len(th)+1)
+	var top []CustomerCA
+	var grandTotal Money
+	each(func(c CustomerCA) {
+		v := c.key(spec.RankBy)
+		q := sort.Search(len(th), func(i int) bool { return v >= th[i] })
+		grandTotal += c.CA
+		if q == 0 {
+			top = append(top, c)
+			return
+		}
+		acc[q].add(c, v)
+	})
+
+	sortCustomers(top, spec.RankBy)
+	qstats := make(map[int]QuantileStats, len(acc))
+	for i := range acc {
+		if i == 0 && len(top) > 0 {
+			qstats[i] = bucketStats(top, grandTotal, spec.RankBy)
+			continue
+		}
+		qstats[i] = acc[i].stats(grandTotal)
+	}
+	return qstats, top, info
+}
+
+// rankTop ranks the top bucket of sketchQuantiles among n customers: every
+// customer ranked above one of the bucket is in it, so the ranks are exact
+func rankTop(top []CustomerCA, n int) []RankedCustomer {
+	out := make([]RankedCustomer, len(top))
+	for i, c := range top {
+		out[i] = RankedCustomer{
+			CustomerCA: c,
+			Rank:       i + 1,
+			Quantile:   0,
+			Percentile: float64(i+1) / float64(n) * 100,
+		}
+	}
+	return out
+}
+
+// logSketch logs the sketch, its error bound and the top threshold
+func logSketch(info sketchInfo, spec bucketSpec) {
+	fields := log.Fields{
+		"sketch_k":     info.K,
+		"sketch_items": info.Retained,
+		"nb_clients":   info.N,
+		"rank_error":   fmt.Sprintf("±%d customers (%.2f%%)", info.RankError, sketchErrorFactor/float64(info.K)*100),
+	}
+	if len(info.Thresholds) > 0 && info.Thresholds[0] != math.MinInt64 {
+		fields["top_threshold"] = formatMetric(spec.RankBy, info.Thresholds[0])
+	}
+	log.WithFields(fields).Info("approximate quantile thresholds (sketch)")
+}
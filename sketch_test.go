@@ -0,0 +1,186 @@
+// sketch_test.go
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// randomCustomers returns n customers with exponentially distributed CA,
+// unsorted, with many ties below 1.00
+func randomCustomers(n int, seed int64) []CustomerCA {
+	r := rand.New(rand.NewSource(seed))
+	out := make([]CustomerCA, n)
+	for i := range out {
+		out[i] = CustomerCA{CustomerID: int64(i + 1), CA: Money(r.ExpFloat64() * 5000)}
+	}
+	return out
+}
+
+func eachOf(customers []CustomerCA) func(fn func(CustomerCA)) {
+	return func(fn func(CustomerCA)) {
+		for _, c := range customers {
+			fn(c)
+		}
+	}
+}
+
+// -------------------- Tests pour kllSketch --------------------
+
+func TestKLLSketch(t *testing.T) {
+	t.Run("exact below capacity", func(t *testing.T) {
+		s := newKLLSketch(200)
+		for _, v := range []int64{5, 1, 4, 2, 3} {
+			s.add(v)
+		}
+		got := s.values([]int64{1, 3, 5})
+		if got[0] != 1 || got[1] != 3 || got[2] != 5 {
+			t.Errorf("got %v, want [1 3 5]", got)
+		}
+	})
+
+	t.Run("rank error within the documented bound", func(t *testing.T) {
+		const n, k = 200000, 200
+		r := rand.New(rand.NewSource(7))
+		vals := make([]int64, n)
+		s := newKLLSketch(k)
+		for i := range vals {
+			vals[i] = int64(r.ExpFloat64() * 10000)
+			s.add(vals[i])
+		}
+		if s.retained() > 4*k {
+			t.Errorf("sketch holds %d items, want at most %d", s.retained(), 4*k)
+		}
+		sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+
+		var ranks []int64
+		for q := 1; q < 100; q++ {
+			ranks = append(ranks, int64(n*q/100))
+		}
+		maxErr := int64(sketchErrorFactor / k * n)
+		for i, v := range s.values(ranks) {
+			// ranks of the values equal to v are [lo, hi]
+			lo := int64(sort.Search(n, func(j int) bool { return vals[j] >= v })) + 1
+			hi := int64(sort.Search(n, func(j int) bool { return vals[j] > v }))
+			if ranks[i] < lo-maxErr || ranks[i] > hi+maxErr {
+				t.Errorf("rank %d: value %d has ranks [%d, %d], beyond ±%d", ranks[i], v, lo, hi, maxErr)
+			}
+		}
+	})
+
+	t.Run("same data gives the same thresholds", func(t *testing.T) {
+		a, b := newKLLSketch(50), newKLLSketch(50)
+		for i := 0; i < 10000; i++ {
+			a.add(int64(i * 7 % 1000))
+			b.add(int64(i * 7 % 1000))
+		}
+		ra, rb := a.values([]int64{100, 5000, 9900}), b.values([]int64{100, 5000, 9900})
+		for i := range ra {
+			if ra[i] != rb[i] {
+				t.Fatalf("got %v and %v", ra, rb)
+			}
+		}
+	})
+}
+
+// -------------------- Tests pour sketchQuantiles --------------------
+
+func TestSketchQuantiles(t *testing.T) {
+	t.Run("matches the exact keep-higher buckets below the sketch capacity", func(t *testing.T) {
+		customers := randomCustomers(500, 1)
+		spec := bucketSpec{Method: methodEqualCount, Quantile: 0.1, Ties: tiesKeepHigher, RankBy: metricCA, Sketch: 2000}
+		got, top, _ := sketchQuantiles(eachOf(customers), spec)
+
+		sorted := append([]CustomerCA(nil), customers...)
+		sortCustomers(sorted, metricCA)
+		want, wantTop := computeQuantiles(sorted, spec)
+		if len(got) != len(want) || len(top) != len(wantTop) {
+			t.Fatalf("got %d buckets and top %d, want %d and %d", len(got), len(top), len(want), len(wantTop))
+		}
+		for i := range want {
+			g, w := got[i], want[i]
+			if g.NbClients != w.NbClients || g.TotalCA != w.TotalCA || g.MinCA != w.MinCA || g.MaxCA != w.MaxCA ||
+				!floatEqual(g.MedianCA, w.MedianCA, 1e-9) || !floatEqual(g.StdDevCA, w.StdDevCA, 1e-6) {
+				t.Errorf("bucket %d: got %+v, want %+v", i, g, w)
+			}
+		}
+		for i := range top {
+			if top[i].CustomerID != wantTop[i].CustomerID {
+				t.Fatalf("top %d: got customer %d, want %d", i, top[i].CustomerID, wantTop[i].CustomerID)
+			}
+		}
+	})
+
+	t.Run("thresholds close to the exact ones on a large base", func(t *testing.T) {
+		const n = 100000
+		customers := randomCustomers(n, 2)
+		spec := bucketSpec{Method: methodCuts, Cuts: []float64{0.01, 0.025, 0.2}, Ties: tiesKeepHigher, RankBy: metricCA, Sketch: 500}
+		qStats, top, info := sketchQuantiles(eachOf(customers), spec)
+
+		sorted := append([]CustomerCA(nil), customers...)
+		sortCustomers(sorted, metricCA)
+		for i, end := range cutEnds(n, spec.Cuts)[:3] {
+			// customers at or above the sketch threshold vs the nominal end
+			at := sort.Search(n, func(j int) bool { return int64(sorted[j].CA) < info.Thresholds[i] })
+			if d := at - end; d < -info.RankError || d > info.RankError {
+				t.Errorf("cut %d: threshold %s selects %d customers, want %d ±%d", i, Money(info.Thresholds[i]), at, end, info.RankError)
+			}
+		}
+
+		// the top quantile is exactly the customers reaching the threshold
+		if len(top) != qStats[0].NbClients {
+			t.Fatalf("top holds %d customers, stats %d", len(top), qStats[0].NbClients)
+		}
+		for i, c := range top {
+			if c.CustomerID != sorted[i].CustomerID {
+				t.Fatalf("top %d: got customer %d, want %d", i, c.CustomerID, sorted[i].CustomerID)
+			}
+		}
+		if int64(sorted[len(top)].CA) >= info.Thresholds[0] {
+			t.Error("a customer reaching the threshold was left out of the top quantile")
+		}
+
+		total, count := Money(0), 0
+		for i := 0; i < len(qStats); i++ {
+			total += qStats[i].TotalCA
+			count += qStats[i].NbClients
+		}
+		var want Money
+		for _, c := range customers {
+			want += c.CA
+		}
+		if count != n || total != want {
+			t.Errorf("buckets hold %d customers and %s, want %d and %s", count, total, n, want)
+		}
+	})
+
+	t.Run("thresholds method is exact", func(t *testing.T) {
+		customers := sortedCA(100, 60, 50, 50, 10, 5)
+		spec := bucketSpec{Method: methodThresholds, Thresholds: []int64{5000, 1000}, RankBy: metricCA, Sketch: 8}
+		qStats, top, _ := sketchQuantiles(eachOf(customers), spec)
+		if len(top) != 4 || qStats[1].NbClients != 1 || qStats[2].NbClients != 1 {
+			t.Errorf("got top %d and buckets %+v", len(top), qStats)
+		}
+	})
+
+	t.Run("no customers", func(t *testing.T) {
+		qStats, top, _ := sketchQuantiles(eachOf(nil), bucketSpec{Method: methodEqualCount, Quantile: 0.5, Sketch: 100})
+		if qStats != nil || top != nil {
+			t.Errorf("got %v, %v", qStats, top)
+		}
+	})
+}
+
+// -------------------- Tests pour rankTop --------------------
+
+func TestRankTop(t *testing.T) {
+	ranked := rankTop(sortedCA(30, 20), 8)
+	if len(ranked) != 2 || ranked[1].Rank != 2 || ranked[1].Quantile != 0 || !floatEqual(ranked[1].Percentile, 25, 1e-9) {
+		t.Errorf("unexpected ranking %+v", ranked)
+	}
+	spec := bucketSpec{Method: methodEqualCount, Quantile: 0.025, Sketch: 2000}
+	if got := spec.String(); got != "equal-count:0.025 sketch:2000" {
+		t.Errorf("String: got %q", got)
+	}
+}
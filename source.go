@@ -0,0 +1,508 @@
+// source.go
+//
+// Data sources for the LOAD phase. The pipeline reads CustomerEventData,
+// ContentPrice and CustomerData through the Source interface, either from the
+// live MySQL database or from CSV / Parquet dumps of the three tables, so the
+// quantile analysis can be rerun offline on an extract.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Source provides the three inputs of the pipeline
+type Source interface {
+	// StreamEvents calls fn with chunks of at most chunkSize events with an
+	// EventTypeID in types and an EventDate in the period; the slice is reused
+	// between calls. Every method stops early with ctx.Err() once ctx is
+	// canceled, so the loaders can run concurrently.
+	StreamEvents(ctx context.Context, p period, types []int, chunkSize int, fn func([]EventRow) error) error
+	ContentPrices(ctx context.Context) ([]ContentPriceRow, error)
+	// CustomerEmails returns CustomerData rows of channel type 1 (email)
+	CustomerEmails(ctx context.Context) ([]CustomerDataRow, error)
+	Close() error
+}
+
+// source kinds accepted by -source
+const (
+	sourceMySQL   = "mysql"
+	sourceCSV     = "csv"
+	sourceParquet = "parquet"
+)
+
+// parseSource splits a -source value: "mysql", "csv:DIR" or "parquet:DIR"
+func parseSource(v string) (kind, dir string, err error) {
+	kind, dir, _ = strings.Cut(v, ":")
+	switch kind {
+	case sourceMySQL:
+		if dir != "" {
+			return "", "", fmt.Errorf("invalid source %q: mysql takes no directory", v)
+		}
+	case sourceCSV, sourceParquet:
+		if dir == "" {
+			return "", "", fmt.Errorf("invalid source %q: expected %s:DIR", v, kind)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid source %q (expected mysql, csv:DIR or parquet:DIR)", v)
+	}
+	return kind, dir, nil
+}
+
+// -------------------- MySQL --------------------
+
+// mysqlSource runs every query inside a consistent snapshot. By default all
+// loaders share one snapshot, so the tables are read in the same state but
+// the loaders take turns on its connection; with parallel, each loader opens
+// its own snapshot and queries concurrently, the snapshots being only a few
+// milliseconds apart.
+type mysqlSource struct {
+	db       *sql.DB
+	parallel bool
+	mu       sync.Mutex // held by the loader using the shared snapshot
+	snap     *snapshot  // shared snapshot, nil when parallel
+	at       time.Time  // earliest snapshot
+}
+
+func newMySQLSource(ctx context.Context, db *sql.DB, parallel bool) (*mysqlSource, error) {
+	s := &mysqlSource{db: db, parallel: parallel}
+	if parallel {
+		return s, nil
+	}
+	snap, err := beginSnapshot(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	s.snap, s.at = snap, snap.At
+	return s, nil
+}
+
+// with runs fn inside a snapshot: the shared one, or with parallel a new one
+// ended when fn returns
+func (s *mysqlSource) with(ctx context.Context, fn func(q queryer) error) error {
+	if !s.parallel {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(s.snap)
+	}
+	snap, err := beginSnapshot(ctx, s.db)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.at.IsZero() || snap.At.Before(s.at) {
+		s.at = snap.At
+	}
+	s.mu.Unlock()
+	err = fn(snap)
+	if cerr := snap.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SnapshotAt is the server time of the (earliest) snapshot, zero before any load
+func (s *mysqlSource) SnapshotAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.at
+}
+
+func (s *mysqlSource) StreamEvents(ctx context.Context, p period, types []int, chunkSize int, fn func([]EventRow) error) error {
+	return s.with(ctx, func(q queryer) error {
+		return streamEvents(ctx, q, p, types, chunkSize, fn)
+	})
+}
+
+func (s *mysqlSource) ContentPrices(ctx context.Context) (out []ContentPriceRow, err error) {
+	err = s.with(ctx, func(q queryer) error {
+		out, err = loadContentPrices(ctx, q)
+		return err
+	})
+	return out, err
+}
+
+func (s *mysqlSource) CustomerEmails(ctx context.Context) (out []CustomerDataRow, err error) {
+	err = s.with(ctx, func(q queryer) error {
+		out, err = loadCustomerEmails(ctx, q)
+		return err
+	})
+	return out, err
+}
+
+// ExchangeRates reads -rates-table in the same snapshot as the other tables
+func (s *mysqlSource) ExchangeRates(ctx context.Context, tableName string) (out []ExchangeRateRow, err error) {
+	err = s.with(ctx, func(q queryer) error {
+		out, err = loadExchangeRates(ctx, q, tableName)
+		return err
+	})
+	return out, err
+}
+
+func (s *mysqlSource) Close() error {
+	if s.snap == nil {
+		return nil
+	}
+	return s.snap.Close()
+}
+
+// -------------------- CSV / Parquet dumps --------------------
+
+// fileSource reads <Table>.csv or <Table>.parquet files from a directory.
+// CSV files need a header line with the table column names; empty, NULL and \N
+// fields are read as NULL. Filters applied by the SQL queries are applied in memory.
+type fileSource struct {
+	dir    string
+	format string
+}
+
+func newFileSource(format, dir string) (*fileSource, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &fileSource{dir: dir, format: format}, nil
+}
+
+// rowReader iterates the rows of a dump file; values are read by column name
+type rowReader interface {
+	Columns() []string
+	Next() ([]interface{}, error) // io.EOF after the last row
+	Close() error
+}
+
+func (s *fileSource) open(table string) (rowReader, string, error) {
+	path := filepath.Join(s.dir, table+"."+s.format)
+	if s.format == sourceParquet {
+		r, err := openParquet(path)
+		return r, path, err
+	}
+	r, err := openCSV(path)
+	return r, path, err
+}
+
+func (s *fileSource) StreamEvents(ctx context.Context, p period, types []int, chunkSize int, fn func([]EventRow) error) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	log.WithFields(log.Fields{"stage": "LOAD", "table": "CustomerEventData", "source": s.format, "chunk_size": chunkSize}).Info("loading events")
+	total, chunks := 0, 0
+	wanted := make(map[int]bool, len(types))
+	for _, t := range types {
+		wanted[t] = true
+	}
+	chunk := make([]EventRow, 0, chunkSize)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		total += len(chunk)
+		chunks++
+		err := fn(chunk)
+		chunk = chunk[:0]
+		return err
+	}
+	err := s.scan(ctx, "CustomerEventData", func(r *fileRow) error {
+		e := EventRow{
+			EventDataID: r.int64("EventDataID"),
+			EventID:     r.int64("EventID"),
+			ContentID:   int(r.int64("ContentID")),
+			CustomerID:  r.int64("CustomerID"),
+			EventTypeID: int(r.int64("EventTypeID")),
+			EventDate:   r.time("EventDate"),
+			Quantity:    int(r.int64("Quantity")),
+			InsertDate:  r.time("InsertDate"),
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if !wanted[e.EventTypeID] || !p.contains(e.EventDate) {
+			return nil
+		}
+		if !p.InsertedAfter.IsZero() && !p.InsertedAfter.precedes(e) {
+			return nil
+		}
+		chunk = append(chunk, e)
+		if len(chunk) == chunkSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"loaded_events": total, "chunks": chunks}).Info("events loaded")
+	return nil
+}
+
+func (s *fileSource) ContentPrices(ctx context.Context) ([]ContentPriceRow, error) {
+	log.WithFields(log.Fields{"stage": "LOAD", "source": s.format}).Info("loading content prices")
+	var out []ContentPriceRow
+	err := s.scan(ctx, "ContentPrice", func(r *fileRow) error {
+		p := ContentPriceRow{
+			ContentPriceID: r.int64("ContentPriceID"),
+			ContentID:      int(r.int64("ContentID")),
+			Price:          r.money("Price"),
+			Currency:       r.string("Currency"),
+			InsertDate:     r.time("InsertDate"),
+		}
+		if r.err != nil {
+			return r.err
+		}
+		out = append(out, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("loaded_prices", len(out)).Info("content prices loaded")
+	return out, nil
+}
+
+func (s *fileSource) CustomerEmails(ctx context.Context) ([]CustomerDataRow, error) {
+	log.WithFields(log.Fields{"stage": "LOAD", "source": s.format}).Info("loading customer emails (CustomerData channel=1)")
+	var out []CustomerDataRow
+	err := s.scan(ctx, "CustomerData", func(r *fileRow) error {
+		c := CustomerDataRow{
+			CustomerChannelID: r.int64("CustomerChannelID"),
+			CustomerID:        r.int64("CustomerID"),
+			ChannelTypeID:     int(r.int64("ChannelTypeID")),
+			ChannelValue:      r.string("ChannelValue"),
+			InsertDate:        r.time("InsertDate"),
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if c.ChannelTypeID == 1 {
+			out = append(out, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("loaded_emails", len(out)).Info("customer emails loaded")
+	return out, nil
+}
+
+func (s *fileSource) Close() error {
+	return nil
+}
+
+// scan calls fn for every row of a table dump, with errors located by file and row;
+// it stops with ctx.Err() once ctx is canceled
+func (s *fileSource) scan(ctx context.Context, table string, fn func(*fileRow) error) error {
+	rr, path, err := s.open(table)
+	if err != nil {
+		return err
+	}
+	defer rr.Close()
+
+	row := &fileRow{idx: make(map[string]int)}
+	for i, c := range rr.Columns() {
+		row.idx[strings.ToLower(strings.TrimSpace(c))] = i
+	}
+	for n := 1; ; n++ {
+		if n%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		vals, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		row.vals, row.err = vals, nil
+		if err := fn(row); err != nil {
+			return fmt.Errorf("%s: row %d: %w", path, n, err)
+		}
+	}
+}
+
+// fileRow converts the values of a dump row by column name. The first conversion
+// error is kept in err, so a row can be decoded field by field and checked once.
+type fileRow struct {
+	idx  map[string]int
+	vals []interface{}
+	err  error
+}
+
+func (r *fileRow) value(col string) interface{} {
+	i, ok := r.idx[strings.ToLower(col)]
+	if !ok {
+		r.fail(fmt.Errorf("missing column %s", col))
+		return nil
+	}
+	if i >= len(r.vals) {
+		return nil
+	}
+	return r.vals[i]
+}
+
+func (r *fileRow) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *fileRow) int64(col string) int64 {
+	switch v := r.value(col).(type) {
+	case nil:
+		return 0
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case parquetDecimal:
+		if v.scale != 0 || !v.unscaled.IsInt64() {
+			r.fail(fmt.Errorf("column %s: invalid integer %s", col, v))
+		}
+		return v.unscaled.Int64()
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			r.fail(fmt.Errorf("column %s: invalid integer %q", col, v))
+		}
+		return n
+	default:
+		r.fail(fmt.Errorf("column %s: unexpected type %T", col, v))
+		return 0
+	}
+}
+
+// money reads an amount exactly from text and decimals; binary floats are
+// rounded to the cent
+func (r *fileRow) money(col string) Money {
+	switch v := r.value(col).(type) {
+	case nil:
+		return 0
+	case string:
+		m, err := parseMoney(v)
+		if err != nil {
+			r.fail(fmt.Errorf("column %s: %w", col, err))
+		}
+		return m
+	case parquetDecimal:
+		m, err := moneyFromDecimal(v.unscaled, v.scale)
+		if err != nil {
+			r.fail(fmt.Errorf("column %s: %w", col, err))
+		}
+		return m
+	case float64:
+		return moneyFromFloat(v)
+	case int64:
+		return Money(v * centsPerUnit)
+	default:
+		r.fail(fmt.Errorf("column %s: unexpected type %T", col, v))
+		return 0
+	}
+}
+
+func (r *fileRow) string(col string) string {
+	switch v := r.value(col).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// accepted date layouts for text dumps (MySQL export formats first)
+var dumpTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	time.RFC3339Nano,
+	"2006-01-02",
+}
+
+func (r *fileRow) time(col string) time.Time {
+	switch v := r.value(col).(type) {
+	case nil:
+		return time.Time{}
+	case time.Time:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		for _, layout := range dumpTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t
+			}
+		}
+		r.fail(fmt.Errorf("column %s: invalid date %q", col, v))
+		return time.Time{}
+	default:
+		r.fail(fmt.Errorf("column %s: unexpected type %T", col, v))
+		return time.Time{}
+	}
+}
+
+// -------------------- CSV reader --------------------
+
+type csvReader struct {
+	f      *os.File
+	r      *csv.Reader
+	header []string
+}
+
+func openCSV(path string) (*csvReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: reading header: %w", path, err)
+	}
+	return &csvReader{f: f, r: r, header: append([]string(nil), header...)}, nil
+}
+
+func (c *csvReader) Columns() []string {
+	return c.header
+}
+
+func (c *csvReader) Next() ([]interface{}, error) {
+	rec, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]interface{}, len(rec))
+	for i, v := range rec {
+		if v == "" || v == "NULL" || v == `\N` {
+			continue // NULL
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (c *csvReader) Close() error {
+	return c.f.Close()
+}
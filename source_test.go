@@ -0,0 +1,207 @@
+// source_test.go
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// -------------------- Tests pour parseSource --------------------
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantKind string
+		wantDir  string
+		wantErr  bool
+	}{
+		{"mysql", sourceMySQL, "", false},
+		{"csv:/data/extract", sourceCSV, "/data/extract", false},
+		{"parquet:dump", sourceParquet, "dump", false},
+		{"csv", "", "", true},
+		{"mysql:foo", "", "", true},
+		{"json:dir", "", "", true},
+	}
+	for _, tt := range tests {
+		kind, dir, err := parseSource(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if kind != tt.wantKind || dir != tt.wantDir {
+			t.Errorf("%q: got %s/%s, want %s/%s", tt.in, kind, dir, tt.wantKind, tt.wantDir)
+		}
+	}
+}
+
+// -------------------- Tests pour fileSource (CSV) --------------------
+
+func TestCSVSource(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "CustomerEventData.csv", `EventDataID,EventID,ContentID,CustomerID,EventTypeID,EventDate,Quantity,InsertDate
+1,1,10,100,6,2020-04-02 10:00:00,2,2020-04-02 10:00:00
+2,2,11,100,6,2020-03-01 10:00:00,1,2020-03-01 10:00:00
+3,3,11,101,5,2020-05-01 10:00:00,1,2020-05-01 10:00:00
+4,4,11,101,6,2020-05-01 10:00:00,3,2020-05-01 10:00:00
+5,5,10,102,6,2020-06-01,1,\N
+`)
+	writeTestFile(t, dir, "ContentPrice.csv", `ContentPriceID,ContentID,Price,Currency,InsertDate
+1,10,9.99,EUR,2020-01-01 00:00:00
+2,11,5.00,EUR,2020-01-01 00:00:00
+`)
+	writeTestFile(t, dir, "CustomerData.csv", `CustomerChannelID,CustomerID,ChannelTypeID,ChannelValue,InsertDate
+1,100,1,a@test.com,2020-01-01 00:00:00
+2,100,2,0600000000,2020-01-01 00:00:00
+3,101,1,b@test.com,2020-01-01 00:00:00
+`)
+
+	src, err := newFileSource(sourceCSV, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("events filtered and chunked", func(t *testing.T) {
+		var ids []int64
+		chunks := 0
+		err := src.StreamEvents(context.Background(), period{Since: mustParseDate("2020-04-01")}, []int{6}, 2, func(chunk []EventRow) error {
+			chunks++
+			for _, e := range chunk {
+				ids = append(ids, e.EventDataID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []int64{1, 4, 5}
+		if len(ids) != len(want) {
+			t.Fatalf("expected events %v, got %v", want, ids)
+		}
+		for i := range want {
+			if ids[i] != want[i] {
+				t.Errorf("event %d: got EventDataID %d, want %d", i, ids[i], want[i])
+			}
+		}
+		if chunks != 2 {
+			t.Errorf("expected 2 chunks, got %d", chunks)
+		}
+	})
+
+	t.Run("events of several types", func(t *testing.T) {
+		var ids []int64
+		err := src.StreamEvents(context.Background(), period{Since: mustParseDate("2020-04-01")}, []int{5, 6}, 10, func(chunk []EventRow) error {
+			for _, e := range chunk {
+				ids = append(ids, e.EventDataID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 4 || ids[1] != 3 {
+			t.Errorf("expected events [1 3 4 5], got %v", ids)
+		}
+	})
+
+	t.Run("prices", func(t *testing.T) {
+		prices, err := src.ContentPrices(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := buildPriceMap(prices)
+		if m[10] != mustParseMoney("9.99") || m[11] != mustParseMoney("5.00") {
+			t.Errorf("unexpected prices %v", m)
+		}
+	})
+
+	t.Run("emails keep channel type 1 only", func(t *testing.T) {
+		emails, err := src.CustomerEmails(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(emails) != 2 {
+			t.Fatalf("expected 2 emails, got %d", len(emails))
+		}
+		if buildEmailMap(emails)[100] != "a@test.com" {
+			t.Errorf("customer 100: expected a@test.com, got %s", buildEmailMap(emails)[100])
+		}
+	})
+}
+
+func TestCSVSourceErrors(t *testing.T) {
+	t.Run("invalid value", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTestFile(t, dir, "ContentPrice.csv", "ContentPriceID,ContentID,Price,Currency,InsertDate\n1,10,abc,EUR,2020-01-01\n")
+		src, _ := newFileSource(sourceCSV, dir)
+		if _, err := src.ContentPrices(context.Background()); err == nil {
+			t.Error("expected error for invalid price")
+		}
+	})
+
+	t.Run("missing column", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTestFile(t, dir, "ContentPrice.csv", "ContentPriceID,ContentID,Currency,InsertDate\n1,10,EUR,2020-01-01\n")
+		src, _ := newFileSource(sourceCSV, dir)
+		if _, err := src.ContentPrices(context.Background()); err == nil {
+			t.Error("expected error for missing Price column")
+		}
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		if _, err := newFileSource(sourceCSV, filepath.Join(t.TempDir(), "nope")); err == nil {
+			t.Error("expected error for missing directory")
+		}
+	})
+}
+
+// -------------------- Tests pour fileSource (Parquet) --------------------
+
+func TestParquetSourceEvents(t *testing.T) {
+	dir := t.TempDir()
+	ts := func(s string) int64 { return mustParseDate(s).UnixMicro() }
+	i64 := func(vs ...int64) []interface{} {
+		out := make([]interface{}, len(vs))
+		for i, v := range vs {
+			out[i] = v
+		}
+		return out
+	}
+	writeTestParquet(t, filepath.Join(dir, "CustomerEventData.parquet"), pqSnappy, []pqTestColumn{
+		{name: "EventDataID", physical: pqInt64, converted: -1, values: i64(1, 2, 3)},
+		{name: "EventID", physical: pqInt64, converted: -1, values: i64(1, 2, 3)},
+		{name: "ContentID", physical: pqInt32, converted: -1, values: i64(10, 10, 11)},
+		{name: "CustomerID", physical: pqInt64, converted: -1, values: i64(100, 100, 101)},
+		{name: "EventTypeID", physical: pqInt32, converted: -1, dict: true, values: i64(6, 6, 6)},
+		{name: "EventDate", physical: pqInt64, converted: 10, values: i64(ts("2020-01-01"), ts("2020-05-01"), ts("2020-06-01"))},
+		{name: "Quantity", physical: pqInt32, converted: -1, values: i64(1, 2, 3)},
+		{name: "InsertDate", physical: pqInt64, converted: 10, optional: true, values: []interface{}{nil, ts("2020-05-01"), nil}},
+	})
+
+	src, err := newFileSource(sourceParquet, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []EventRow
+	err = src.StreamEvents(context.Background(), period{Since: mustParseDate("2020-04-01"), Until: mustParseDate("2020-06-01")}, []int{6}, 10, func(chunk []EventRow) error {
+		events = append(events, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event in [2020-04-01, 2020-06-01), got %d", len(events))
+	}
+	if events[0].EventDataID != 2 || events[0].Quantity != 2 || events[0].CustomerID != 100 {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
@@ -0,0 +1,731 @@
+// spill.go
+//
+// Spill to disk (-memory-limit): when the per-customer state of the CA
+// aggregation outgrows the limit, it is written to a temporary file sorted by
+// CustomerID and the aggregation starts over empty. Once the events are
+// consumed, the partial files are merged per customer and the customers are
+// sorted by an external merge sort: runs that fit the limit are sorted in
+// memory and written out, then merged while streaming. The sorted customers
+// are read twice, once for the quantile statistics and once for the export.
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// estimated heap bytes, compared with -memory-limit
+const (
+	customerStateBytes  = 256 // CA and metrics map entries and set headers of a customer
+	setEntryBytes       = 24  // distinct product or active day of a customer
+	sortedCustomerBytes = 160 // CustomerCA held in a sort run
+	minMemoryLimit      = 1 << 20
+)
+
+// maximum number of spill files open in a k-way merge; beyond, files are
+// merged in several passes
+const maxMergeFiles = 64
+
+// parseByteSize parses -memory-limit: a number of bytes with an optional
+// KB, MB, GB or TB suffix (powers of 1024); "" and 0 disable the limit
+func parseByteSize(s string) (int64, error) {
+	u := strings.ToUpper(strings.TrimSpace(s))
+	if u == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for _, suf := range []struct {
+		name string
+		mult int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(u, suf.name) {
+			u, mult = strings.TrimSpace(strings.TrimSuffix(u, suf.name)), suf.mult
+			break
+		}
+	}
+	v, err := strconv.ParseInt(u, 10, 64)
+	if err != nil || v < 0 || v > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 512MB or 2GB)", s)
+	}
+	return v * mult, nil
+}
+
+// -------------------- Spill files --------------------
+
+// spillRecord is a customer in a spill file. Partial aggregates carry the
+// distinct products and days needed to merge the counts, and customers whose
+// events could not be valued yet (noCA); sorted runs do not.
+type spillRecord struct {
+	CustomerCA
+	noCA     bool
+	products []int
+	days     []int64
+}
+
+// flags of a spill record
+const (
+	recordHasLast = 1 << iota // LastPurchase follows
+	recordNoCA                // metrics only, no valued event
+	recordLastUTC             // LastPurchase in UTC (file sources) rather than Local (MySQL)
+)
+
+func writeRecord(w *bufio.Writer, r *spillRecord) error {
+	buf := make([]byte, 0, 64)
+	buf = binary.AppendVarint(buf, r.CustomerID)
+	buf = binary.AppendVarint(buf, int64(r.CA))
+	for _, v := range []int{r.Purchases, r.Products, r.Quantity, r.ActiveDays} {
+		buf = binary.AppendVarint(buf, int64(v))
+	}
+	var flags byte
+	if !r.LastPurchase.IsZero() {
+		flags |= recordHasLast
+		if r.LastPurchase.Location() == time.UTC {
+			flags |= recordLastUTC
+		}
+	}
+	if r.noCA {
+		flags |= recordNoCA
+	}
+	buf = append(buf, flags)
+	if !r.LastPurchase.IsZero() {
+		buf = binary.AppendVarint(buf, r.LastPurchase.UnixNano())
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(r.products)))
+	for _, v := range r.products {
+		buf = binary.AppendVarint(buf, int64(v))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(r.days)))
+	for _, v := range r.days {
+		buf = binary.AppendVarint(buf, v)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRecord reads the next record; io.EOF means the file is exhausted
+func readRecord(r *bufio.Reader) (spillRecord, error) {
+	var rec spillRecord
+	cid, err := binary.ReadVarint(r)
+	if err != nil {
+		return rec, err // io.EOF between records
+	}
+	vals := make([]int64, 5)
+	for i := range vals {
+		if vals[i], err = binary.ReadVarint(r); err != nil {
+			return rec, unexpectedEOF(err)
+		}
+	}
+	rec.CustomerID, rec.CA = cid, Money(vals[0])
+	rec.Purchases, rec.Products, rec.Quantity, rec.ActiveDays = int(vals[1]), int(vals[2]), int(vals[3]), int(vals[4])
+	flags, err := r.ReadByte()
+	if err != nil {
+		return rec, unexpectedEOF(err)
+	}
+	rec.noCA = flags&recordNoCA != 0
+	if flags&recordHasLast != 0 {
+		ns, err := binary.ReadVarint(r)
+		if err != nil {
+			return rec, unexpectedEOF(err)
+		}
+		rec.LastPurchase = time.Unix(0, ns)
+		if flags&recordLastUTC != 0 {
+			rec.LastPurchase = rec.LastPurchase.UTC()
+		}
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return rec, unexpectedEOF(err)
+	}
+	for ; n > 0; n-- {
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return rec, unexpectedEOF(err)
+		}
+		rec.products = append(rec.products, int(v))
+	}
+	if n, err = binary.ReadUvarint(r); err != nil {
+		return rec, unexpectedEOF(err)
+	}
+	for ; n > 0; n-- {
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return rec, unexpectedEOF(err)
+		}
+		rec.days = append(rec.days, v)
+	}
+	return rec, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writeRecords writes a spill file, fn writing every record
+func writeRecords(path string, fn func(w *bufio.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<16)
+	if err := fn(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// -------------------- K-way merge --------------------
+
+type recordFile struct {
+	path string
+	f    *os.File
+	r    *bufio.Reader
+	cur  spillRecord
+}
+
+// mergeReader streams the records of several sorted files in less order
+type mergeReader struct {
+	files []*recordFile
+	less  func(a, b *spillRecord) bool
+}
+
+func (m *mergeReader) Len() int           { return len(m.files) }
+func (m *mergeReader) Less(i, j int) bool { return m.less(&m.files[i].cur, &m.files[j].cur) }
+func (m *mergeReader) Swap(i, j int)      { m.files[i], m.files[j] = m.files[j], m.files[i] }
+func (m *mergeReader) Push(x interface{}) { m.files = append(m.files, x.(*recordFile)) }
+func (m *mergeReader) Pop() interface{} {
+	last := m.files[len(m.files)-1]
+	m.files = m.files[:len(m.files)-1]
+	return last
+}
+
+func openMerge(paths []string, less func(a, b *spillRecord) bool) (*mergeReader, error) {
+	m := &mergeReader{less: less}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		rf := &recordFile{path: p, f: f, r: bufio.NewReaderSize(f, 1<<16)}
+		if rf.cur, err = readRecord(rf.r); err == io.EOF {
+			f.Close()
+			continue
+		} else if err != nil {
+			f.Close()
+			m.Close()
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		m.files = append(m.files, rf)
+	}
+	heap.Init(m)
+	return m, nil
+}
+
+// next returns the smallest record left; ok is false once every file is exhausted
+func (m *mergeReader) next() (rec spillRecord, ok bool, err error) {
+	if len(m.files) == 0 {
+		return rec, false, nil
+	}
+	top := m.files[0]
+	rec = top.cur
+	cur, rerr := readRecord(top.r)
+	switch {
+	case rerr == io.EOF:
+		heap.Pop(m)
+		top.f.Close()
+	case rerr != nil:
+		return rec, false, fmt.Errorf("%s: %w", top.path, rerr)
+	default:
+		top.cur = cur
+		heap.Fix(m, 0)
+	}
+	return rec, true, nil
+}
+
+func (m *mergeReader) Close() {
+	for _, rf := range m.files {
+		rf.f.Close()
+	}
+	m.files = nil
+}
+
+// byCustomerID orders the partial aggregates
+func byCustomerID(a, b *spillRecord) bool { return a.CustomerID < b.CustomerID }
+
+// byRank orders the sorted runs like sortCustomers
+func byRank(rankBy string) func(a, b *spillRecord) bool {
+	return func(a, b *spillRecord) bool {
+		ka, kb := a.key(rankBy), b.key(rankBy)
+		if ka != kb {
+			return ka > kb
+		}
+		return a.CustomerID < b.CustomerID
+	}
+}
+
+// mergeFiles merges the sorted files paths into the sorted file out, records
+// kept as they are
+func mergeFiles(out string, paths []string, less func(a, b *spillRecord) bool) error {
+	m, err := openMerge(paths, less)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return writeRecords(out, func(w *bufio.Writer) error {
+		for {
+			rec, ok, err := m.next()
+			if !ok || err != nil {
+				return err
+			}
+			if err := writeRecord(w, &rec); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// -------------------- Spiller --------------------
+
+// spiller owns the temporary files of a run
+type spiller struct {
+	dir    string
+	limit  int64
+	parts  []string // partial aggregates, each sorted by CustomerID
+	runs   []string // customers sorted by -rank-by
+	fanIn  int      // files merged at once, see reduceFanIn
+	merged int      // intermediate merge files written
+	n      int      // customers after the merge
+	total  Money    // their CA
+}
+
+func newSpiller(limit int64) (*spiller, error) {
+	dir, err := os.MkdirTemp("", "quantile-spill-")
+	if err != nil {
+		return nil, err
+	}
+	return &spiller{dir: dir, limit: limit, fanIn: maxMergeFiles}, nil
+}
+
+// Close removes the temporary files
+func (s *spiller) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+func (s *spiller) path(kind string, i int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%05d.bin", kind, i))
+}
+
+// reduceFanIn merges the sorted files paths in passes of at most s.fanIn
+// files, so that no merge keeps more files open, and returns the at most
+// s.fanIn files left; merged files are removed
+func (s *spiller) reduceFanIn(paths []string, less func(a, b *spillRecord) bool) ([]string, error) {
+	for pass := 1; len(paths) > s.fanIn; pass++ {
+		var next []string
+		for start := 0; start < len(paths); start += s.fanIn {
+			group := paths[start:min(start+s.fanIn, len(paths))]
+			if len(group) == 1 {
+				next = append(next, group[0])
+				continue
+			}
+			out := s.path("merge", s.merged)
+			s.merged++
+			if err := mergeFiles(out, group, less); err != nil {
+				return nil, fmt.Errorf("failed to merge spill files: %w", err)
+			}
+			for _, p := range group {
+				os.Remove(p)
+			}
+			next = append(next, out)
+		}
+		log.WithFields(log.Fields{"stage": "COMPUTE", "pass": pass, "files_in": len(paths), "files_out": len(next)}).Info("spill files merged")
+		paths = next
+	}
+	return paths, nil
+}
+
+// spillPartial writes the CA and metrics of every customer, sorted by CustomerID
+func (s *spiller) spillPartial(ca map[int64]Money, t *metricsTracker) error {
+	// customers with metrics but no valued event yet may get a CA from a
+	// later partial file
+	ids := make([]int64, 0, len(t.counts))
+	for cid := range t.counts {
+		ids = append(ids, cid)
+	}
+	for cid := range ca {
+		if _, ok := t.counts[cid]; !ok {
+			ids = append(ids, cid)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	path := s.path("partial", len(s.parts))
+	err := writeRecords(path, func(w *bufio.Writer) error {
+		for _, cid := range ids {
+			amount, valued := ca[cid]
+			rec := spillRecord{CustomerCA: CustomerCA{CustomerID: cid, CA: amount}, noCA: !valued}
+			if m, ok := t.counts[cid]; ok {
+				rec.Metrics = *m
+			}
+			for p := range t.products[cid] {
+				rec.products = append(rec.products, p)
+			}
+			for d := range t.days[cid] {
+				rec.days = append(rec.days, d)
+			}
+			if err := writeRecord(w, &rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to spill partial aggregates: %w", err)
+	}
+	s.parts = append(s.parts, path)
+	log.WithFields(log.Fields{"stage": "COMPUTE", "file": path, "customers": len(ids), "estimated_bytes": t.size}).Info("aggregation state spilled to disk")
+	return nil
+}
+
+// sortRuns merges the partial aggregates per customer and writes runs of at
+// most limit bytes of customers, each sorted by rankBy
+func (s *spiller) sortRuns(rankBy string) error {
+	nParts := len(s.parts)
+	var err error
+	if s.parts, err = s.reduceFanIn(s.parts, byCustomerID); err != nil {
+		return err
+	}
+	parts, err := openMerge(s.parts, byCustomerID)
+	if err != nil {
+		return err
+	}
+	defer parts.Close()
+
+	runSize := int(s.limit / sortedCustomerBytes)
+	buf := make([]CustomerCA, 0, runSize)
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		sortCustomers(buf, rankBy)
+		path := s.path("run", len(s.runs))
+		err := writeRecords(path, func(w *bufio.Writer) error {
+			for i := range buf {
+				if err := writeRecord(w, &spillRecord{CustomerCA: buf[i]}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write sort run: %w", err)
+		}
+		s.runs = append(s.runs, path)
+		buf = buf[:0]
+		return nil
+	}
+
+	var cur *spillRecord
+	var products map[int]struct{}
+	var days map[int64]struct{}
+	emit := func() error {
+		if cur.noCA {
+			return nil // no event of the customer could be valued
+		}
+		s.n++
+		s.total += cur.CA
+		buf = append(buf, cur.CustomerCA)
+		if len(buf) >= runSize {
+			return flush()
+		}
+		return nil
+	}
+	for {
+		rec, ok, err := parts.next()
+		if err != nil {
+			return err
+		}
+		if cur != nil && (!ok || rec.CustomerID != cur.CustomerID) {
+			if err := emit(); err != nil {
+				return err
+			}
+			cur = nil
+		}
+		if !ok {
+			break
+		}
+		if cur == nil {
+			rec := rec
+			cur = &rec
+			products = make(map[int]struct{}, len(rec.products))
+			days = make(map[int64]struct{}, len(rec.days))
+			for _, p := range rec.products {
+				products[p] = struct{}{}
+			}
+			for _, d := range rec.days {
+				days[d] = struct{}{}
+			}
+			continue
+		}
+		// same customer in a later partial file
+		cur.CA += rec.CA
+		cur.noCA = cur.noCA && rec.noCA
+		cur.Purchases += rec.Purchases
+		cur.Quantity += rec.Quantity
+		if rec.LastPurchase.After(cur.LastPurchase) {
+			cur.LastPurchase = rec.LastPurchase
+		}
+		for _, p := range rec.products {
+			products[p] = struct{}{}
+		}
+		for _, d := range rec.days {
+			days[d] = struct{}{}
+		}
+		cur.Products, cur.ActiveDays = len(products), len(days)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"stage": "COMPUTE", "customers": s.n, "partial_files": nParts, "sort_runs": len(s.runs)}).Info("spilled aggregates merged and sorted")
+	return nil
+}
+
+// customerStream reads the customers in rank order, with their email
+type customerStream struct {
+	m      *mergeReader
+	emails map[int64]string
+}
+
+func (s *spiller) open(rankBy string, emailMap map[int64]string) (*customerStream, error) {
+	less := byRank(rankBy)
+	var err error
+	if s.runs, err = s.reduceFanIn(s.runs, less); err != nil {
+		return nil, err
+	}
+	m, err := openMerge(s.runs, less)
+	if err != nil {
+		return nil, err
+	}
+	return &customerStream{m: m, emails: emailMap}, nil
+}
+
+func (cs *customerStream) next() (CustomerCA, bool, error) {
+	rec, ok, err := cs.m.next()
+	if !ok || err != nil {
+		return CustomerCA{}, ok, err
+	}
+	rec.Email = cs.emails[rec.CustomerID]
+	return rec.CustomerCA, true, nil
+}
+
+func (cs *customerStream) Close() {
+	cs.m.Close()
+}
+
+// -------------------- Streamed quantiles --------------------
+
+// bucketCursor assigns buckets to customers streamed in rank order, with the
+// same cuts as bucketSpec.bounds on the whole sorted slice: nominal ends are
+// known upfront (equal-count, cuts) or found on the way (revenue,
+// thresholds), then made non-decreasing and, with tiesKeepHigher, pushed past
+// the customers tied with the last one of the bucket.
+type bucketCursor struct {
+	spec    bucketSpec
+	n       int
+	total   Money
+	count   int   // buckets
+	nominal []int // nominal end of every bucket, n until found
+	found   int   // revenue and thresholds: buckets whose nominal end is known
+	i       int   // position of the next customer
+	cum     Money // CA of the customers before i
+	q       int   // current bucket
+	floor   int   // end of the previous bucket
+	ext     int   // end of the current bucket pushed past ties, 0 if not
+	lastKey int64
+}
+
+func newBucketCursor(spec bucketSpec, n int, total Money) *bucketCursor {
+	b := &bucketCursor{spec: spec, n: n, total: total}
+	switch spec.Method {
+	case methodEqualCount:
+		b.nominal = equalCountEnds(n, spec.Quantile)
+	case methodCuts:
+		b.nominal = cutEnds(n, spec.Cuts)
+	case methodRevenue:
+		qCount, _ := quantileBuckets(n, spec.Quantile)
+		b.nominal = make([]int, qCount)
+	case methodThresholds:
+		b.nominal = make([]int, len(spec.Thresholds)+1)
+	}
+	if spec.Method == methodRevenue || spec.Method == methodThresholds {
+		for i := range b.nominal {
+			b.nominal[i] = n
+		}
+	}
+	b.count = len(b.nominal)
+	return b
+}
+
+// next returns the bucket of the next customer
+func (b *bucketCursor) next(c CustomerCA) int {
+	i, k := b.i, c.key(b.spec.RankBy)
+	switch b.spec.Method {
+	case methodRevenue:
+		// revenueBounds: smallest j with cum(sorted[:j]) * count >= total * (bucket+1)
+		for b.found < b.count && b.cum*Money(b.count) >= b.total*Money(b.found+1) {
+			b.nominal[b.found] = i
+			b.found++
+		}
+	case methodThresholds:
+		for b.found < len(b.spec.Thresholds) && k < b.spec.Thresholds[b.found] {
+			b.nominal[b.found] = i
+			b.found++
+		}
+	}
+	for b.q < b.count-1 {
+		end := b.nominal[b.q]
+		if end > b.n {
+			end = b.n
+		}
+		if end < b.floor {
+			end = b.floor
+		}
+		if b.ext > end {
+			end = b.ext
+		}
+		if i < end {
+			break
+		}
+		if b.spec.Ties == tiesKeepHigher && i > 0 && k == b.lastKey {
+			b.ext = i + 1
+			break
+		}
+		b.q, b.floor, b.ext = b.q+1, end, 0
+	}
+	b.i++
+	b.cum += c.CA
+	b.lastKey = k
+	return b.q
+}
+
+// streamQuantiles is computeQuantiles over customers read in rank order: the
+// statistics are exact but the median, read from a per-bucket sketch
+func streamQuantiles(next func() (CustomerCA, bool, error), spec bucketSpec, n int, total Money) (map[int]QuantileStats, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	cur := newBucketCursor(spec, n, total)
+	acc := make([]bucketAcc, cur.count)
+	for {
+		c, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		acc[cur.next(c)].add(c, c.key(spec.RankBy))
+	}
+	qstats := make(map[int]QuantileStats, len(acc))
+	for i := range acc {
+		qstats[i] = acc[i].stats(total)
+	}
+	return qstats, nil
+}
+
+// -------------------- Pipeline --------------------
+
+// runSpilled is the end of runPipeline once the aggregation spilled: the
+// customers are merged and sorted on disk, then streamed twice
+func runSpilled(db *sql.DB, p period, run *runRecord, agg *caAggregator, emailMap map[int64]string) error {
+	s := agg.spill
+	if err := agg.flushSpill(); err != nil {
+		return err
+	}
+	agg.ca, agg.metrics = nil, nil
+	if err := s.sortRuns(rankBy); err != nil {
+		return fmt.Errorf("failed to sort spilled customers: %w", err)
+	}
+	log.WithField("customers_with_ca", s.n).Info("computed CA per customer")
+	run.NbCustomers = s.n
+
+	stream, err := s.open(rankBy, emailMap)
+	if err != nil {
+		return err
+	}
+	qStats, err := streamQuantiles(stream.next, buckets, s.n, s.total)
+	stream.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read sorted customers: %w", err)
+	}
+	topSize := 0
+	if qStats != nil {
+		topSize = qStats[0].NbClients
+	}
+	logQuantiles(qStats, buckets, topSize)
+	run.Thresholds = quantileThresholds(qStats)
+	log.Info("revenue concentration skipped with -memory-limit")
+
+	// EXPORT: the customers are read again, ranked on the fly
+	count := s.n
+	if exportStr == exportTop {
+		count = topSize
+	}
+	tableName := fmt.Sprintf("test_export_%s%s", time.Now().Format("20060102"), p.tableSuffix())
+	if db == nil {
+		log.WithField("table", tableName).Warn("no database configured; export skipped")
+		return nil
+	}
+	err = replaceTable(db, tableName, func(staging string) error {
+		if err := ensureExportTable(db, staging); err != nil {
+			return err
+		}
+		stream, err := s.open(rankBy, emailMap)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		cur := newBucketCursor(buckets, s.n, s.total)
+		rank := 0
+		return exportCustomerStream(db, staging, count, func() (RankedCustomer, error) {
+			c, ok, err := stream.next()
+			if err == nil && !ok {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return RankedCustomer{}, err
+			}
+			rank++
+			return RankedCustomer{
+				CustomerCA: c,
+				Rank:       rank,
+				Quantile:   cur.next(c),
+				Percentile: float64(rank) / float64(s.n) * 100,
+			}, nil
+		}, run.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export customers: %w", err)
+	}
+	run.ExportTable = tableName
+	return nil
+}
@@ -0,0 +1,370 @@
+// spill_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// -------------------- Tests pour parseByteSize --------------------
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"4096", 4096},
+		{"512MB", 512 << 20},
+		{"2 gb", 2 << 30},
+		{"64KB", 64 << 10},
+		{"100B", 100},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"abc", "-1MB", "1.5GB", "99999999999TB"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+// -------------------- Tests pour writeRecord / readRecord --------------------
+
+func TestSpillRecordRoundTrip(t *testing.T) {
+	recs := []spillRecord{
+		{
+			CustomerCA: CustomerCA{CustomerID: 42, CA: -1250, Metrics: Metrics{Purchases: 3, Products: 2, Quantity: -1, ActiveDays: 2,
+				LastPurchase: time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC)}},
+			products: []int{10, 11},
+			days:     []int64{18000, 18001},
+		},
+		{CustomerCA: CustomerCA{CustomerID: 1 << 40, CA: 99}},
+		{CustomerCA: CustomerCA{CustomerID: 7, Metrics: Metrics{Purchases: 1}}, noCA: true},
+	}
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	for i := range recs {
+		if err := writeRecord(w, &recs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	data := b.Bytes()
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	for i, want := range recs {
+		got, err := readRecord(r)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if got.CustomerCA != want.CustomerCA || got.noCA != want.noCA || len(got.products) != len(want.products) || len(got.days) != len(want.days) {
+			t.Errorf("record %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := readRecord(r); err != io.EOF {
+		t.Errorf("expected io.EOF after the last record, got %v", err)
+	}
+
+	if _, err := readRecord(bufio.NewReader(bytes.NewReader(data[:5]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated file: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestSpillRecordLocalTime(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.FixedZone("UTC+2", 2*3600)
+
+	// dates from MySQL (Local) and from file sources (UTC) come back
+	// identical, location included, so that spilled customers compare equal
+	// to in-memory ones
+	for _, last := range []time.Time{
+		time.Date(2021, 3, 4, 0, 30, 0, 0, time.Local),
+		time.Date(2021, 3, 4, 0, 30, 0, 0, time.UTC),
+	} {
+		rec := spillRecord{CustomerCA: CustomerCA{CustomerID: 1, Metrics: Metrics{Purchases: 1, LastPurchase: last}}}
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		if err := writeRecord(w, &rec); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		got, err := readRecord(bufio.NewReader(&b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.LastPurchase != last || got.CustomerCA != rec.CustomerCA {
+			t.Errorf("got %v (%s), want %v (%s)", got.LastPurchase, got.LastPurchase.Location(), last, last.Location())
+		}
+	}
+}
+
+// -------------------- Tests pour bucketCursor --------------------
+
+func TestBucketCursorMatchesBounds(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	customers := make([]CustomerCA, 300)
+	for i := range customers {
+		// few distinct values so that ties straddle the cuts, some negative CA
+		customers[i] = CustomerCA{CustomerID: int64(i + 1), CA: Money(r.Intn(40)-5) * centsPerUnit,
+			Metrics: Metrics{Purchases: r.Intn(6)}}
+	}
+	specs := []bucketSpec{
+		{Method: methodEqualCount, Quantile: 0.1},
+		{Method: methodEqualCount, Quantile: 0.025},
+		{Method: methodRevenue, Quantile: 0.2},
+		{Method: methodCuts, Cuts: []float64{0.01, 0.05, 0.5}},
+		{Method: methodThresholds, Thresholds: []int64{3000, 1000, 0}},
+		{Method: methodEqualCount, Quantile: 0.25, RankBy: metricPurchases},
+	}
+	for _, spec := range specs {
+		for _, ties := range []string{tiesSplit, tiesKeepHigher} {
+			spec.Ties = ties
+			sorted := append([]CustomerCA(nil), customers...)
+			sortCustomers(sorted, spec.RankBy)
+			var total Money
+			for _, c := range sorted {
+				total += c.CA
+			}
+			cur := newBucketCursor(spec, len(sorted), total)
+			for i, want := range rankCustomers(sorted, spec) {
+				if got := cur.next(sorted[i]); got != want.Quantile {
+					t.Errorf("%s %s: customer %d in bucket %d, want %d", spec, ties, i, got, want.Quantile)
+					break
+				}
+			}
+		}
+	}
+}
+
+// -------------------- Tests pour spiller --------------------
+
+func TestSpillerMatchesInMemory(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	prices := map[int]Money{1: 500, 2: 1200, 3: 99}
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7}}
+	var events []EventRow
+	for i := 0; i < 3000; i++ {
+		typ := 6
+		if r.Intn(10) == 0 {
+			typ = 7
+		}
+		events = append(events, EventRow{
+			EventDataID: int64(i + 1),
+			CustomerID:  int64(r.Intn(400)),
+			ContentID:   1 + r.Intn(4), // content 4 has no price
+			EventTypeID: typ,
+			Quantity:    1 + r.Intn(3),
+			EventDate:   mustParseDate("2021-01-01").Add(time.Duration(r.Intn(90*24)) * time.Hour),
+		})
+	}
+
+	mem := newCAAggregator(prices).withEventTypes(et)
+	sp, err := newSpiller(4096) // a few customers per partial file
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	disk := newCAAggregator(prices).withEventTypes(et).withSpill(sp)
+	for i, e := range events {
+		mem.add(e)
+		disk.add(e)
+		if i%100 == 99 {
+			if err := disk.maybeSpill(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(sp.parts) < 2 {
+		t.Fatalf("expected several partial files, got %d", len(sp.parts))
+	}
+	if err := sp.spillPartial(disk.ca, disk.metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rankBy := range []string{metricCA, metricActiveDays} {
+		sp.runs, sp.n, sp.total = nil, 0, 0
+		if err := sp.sortRuns(rankBy); err != nil {
+			t.Fatal(err)
+		}
+		if len(sp.runs) < 2 {
+			t.Fatalf("expected several sort runs, got %d", len(sp.runs))
+		}
+		emails := map[int64]string{7: "a@x.com"}
+		want := mem.customers(emails, rankBy)
+		stream, err := sp.open(rankBy, emails)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			c, ok, err := stream.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				if i != len(want) {
+					t.Errorf("%s: streamed %d customers, want %d", rankBy, i, len(want))
+				}
+				break
+			}
+			if i >= len(want) || c != want[i] {
+				t.Fatalf("%s: customer %d: got %+v, want %+v", rankBy, i, c, want[i])
+			}
+		}
+		stream.Close()
+
+		// statistics streamed from disk match the in-memory ones
+		spec := bucketSpec{Method: methodEqualCount, Quantile: 0.1, Ties: tiesKeepHigher, RankBy: rankBy}
+		stream, _ = sp.open(rankBy, emails)
+		got, err := streamQuantiles(stream.next, spec, sp.n, sp.total)
+		stream.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exact, _ := computeQuantiles(want, spec)
+		for i := range exact {
+			g, w := got[i], exact[i]
+			if g.NbClients != w.NbClients || g.TotalCA != w.TotalCA || g.MinValue != w.MinValue || g.MaxValue != w.MaxValue ||
+				!floatEqual(g.StdDevCA, w.StdDevCA, 1e-6) || !floatEqual(g.MedianCA, w.MedianCA, 1e-9) {
+				t.Errorf("%s bucket %d: got %+v, want %+v", rankBy, i, g, w)
+			}
+		}
+	}
+}
+
+// randomEvents returns purchases and refunds of n events over customers,
+// some of contents without price
+func randomEvents(seed int64, n, customers int) []EventRow {
+	r := rand.New(rand.NewSource(seed))
+	events := make([]EventRow, n)
+	for i := range events {
+		typ := 6
+		if r.Intn(8) == 0 {
+			typ = 7
+		}
+		events[i] = EventRow{
+			EventDataID: int64(i + 1),
+			CustomerID:  int64(r.Intn(customers)),
+			ContentID:   r.Intn(12), // contents 10 and 11 have no price
+			EventTypeID: typ,
+			Quantity:    1 + r.Intn(3),
+			EventDate:   mustParseDate("2021-01-01").Add(time.Duration(r.Intn(400*24)) * time.Hour),
+			InsertDate:  mustParseDate("2022-01-01").Add(time.Duration(r.Intn(1000)) * time.Minute),
+		}
+	}
+	return events
+}
+
+func testPrices() map[int]Money {
+	prices := make(map[int]Money)
+	for i := 0; i < 10; i++ {
+		prices[i] = Money(i+1) * 137
+	}
+	return prices
+}
+
+func TestSpillerMultiPassMerge(t *testing.T) {
+	events := randomEvents(19, 4000, 500)
+	et := eventTypes{Purchase: []int{6}, Refund: []int{7}}
+	mem := newCAAggregator(testPrices()).withEventTypes(et)
+	sp, err := newSpiller(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	sp.fanIn = 3 // several passes over the partial files and the sort runs
+	disk := newCAAggregator(testPrices()).withEventTypes(et).withSpill(sp)
+	for i, e := range events {
+		mem.add(e)
+		disk.add(e)
+		if i%100 == 99 {
+			if err := disk.maybeSpill(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := sp.spillPartial(disk.ca, disk.metrics); err != nil {
+		t.Fatal(err)
+	}
+	nParts := len(sp.parts)
+	if err := sp.sortRuns(metricCA); err != nil {
+		t.Fatal(err)
+	}
+	nRuns := len(sp.runs)
+	if nParts <= 9 || nRuns <= 9 {
+		t.Fatalf("expected more than two passes, got %d partial files and %d sort runs", nParts, nRuns)
+	}
+	stream, err := sp.open(metricCA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if len(sp.parts) > 3 || len(sp.runs) > 3 {
+		t.Errorf("merged %d partial files and %d runs at once, want at most 3", len(sp.parts), len(sp.runs))
+	}
+
+	want := mem.customers(nil, metricCA)
+	for i := 0; ; i++ {
+		c, ok, err := stream.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			if i != len(want) {
+				t.Errorf("streamed %d customers, want %d", i, len(want))
+			}
+			break
+		}
+		if i >= len(want) || c != want[i] {
+			t.Fatalf("customer %d: got %+v, want %+v", i, c, want[i])
+		}
+	}
+	if sp.n != len(want) {
+		t.Errorf("merged %d customers, want %d", sp.n, len(want))
+	}
+}
+
+func TestFlushSpillMetricsOnly(t *testing.T) {
+	sp, err := newSpiller(1) // every maybeSpill writes a partial file
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	agg := newCAAggregator(map[int]Money{1: 500}).withSpill(sp)
+	agg.add(EventRow{EventDataID: 1, CustomerID: 42, ContentID: 1, EventTypeID: 6, Quantity: 1, EventDate: mustParseDate("2021-01-01")})
+	if err := agg.maybeSpill(); err != nil {
+		t.Fatal(err)
+	}
+	// the last chunk only holds an unpriced purchase: no CA but metrics
+	agg.add(EventRow{EventDataID: 2, CustomerID: 42, ContentID: 2, EventTypeID: 6, Quantity: 2, EventDate: mustParseDate("2021-03-01")})
+	if err := agg.flushSpill(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sp.parts) != 2 {
+		t.Fatalf("got %d partial files, want 2", len(sp.parts))
+	}
+	if err := sp.sortRuns(metricCA); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := sp.open(metricCA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	c, ok, err := stream.next()
+	if err != nil || !ok {
+		t.Fatalf("next: ok=%v err=%v", ok, err)
+	}
+	if c.CA != 500 || c.Purchases != 2 || c.Quantity != 3 || !c.LastPurchase.Equal(mustParseDate("2021-03-01")) {
+		t.Errorf("got %+v, want CA 500, 2 purchases, quantity 3, last purchase 2021-03-01", c)
+	}
+}